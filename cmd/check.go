@@ -0,0 +1,288 @@
+// GNU General Public License version 3
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/criteo-forks/espoke/probe"
+	"github.com/pkg/errors"
+)
+
+// Nagios plugin states, which are also the exit codes of the check command
+const (
+	stateOK = iota
+	stateWarning
+	stateCritical
+	stateUnknown
+)
+
+var stateNames = []string{"OK", "WARNING", "CRITICAL", "UNKNOWN"}
+
+// CheckCmd runs one probe against one elasticsearch cluster as a Nagios/Icinga plugin, it takes
+// the probe flags of serve
+type CheckCmd struct {
+	Cluster                  string        `help:"cluster to check, as registered in consul (names it when --endpoint is set)"`
+	Endpoint                 string        `help:"elasticsearch endpoint to check without consul, eg. https://es.example.com:9200"`
+	Probe                    string        `required:"" enum:"nodes,durability,latency,restore" help:"probe to run (nodes, durability, latency or restore)"`
+	WarningLatency           time.Duration `default:"0s" help:"latency of a step above which the check is WARNING, 0 disables it"`
+	CriticalLatency          time.Duration `default:"0s" help:"latency of a step above which the check is CRITICAL, 0 disables it"`
+	YellowState              string        `default:"warning" enum:"ok,warning,critical" help:"state of the check when an index is yellow (ok, warning or critical)"`
+	RedState                 string        `default:"critical" enum:"ok,warning,critical" help:"state of the check when an index is red (ok, warning or critical)"`
+	WarningMissingDocuments  int           `default:"0" help:"number of missing durability documents above which the check is WARNING"`
+	CriticalMissingDocuments int           `default:"0" help:"number of missing durability documents above which the check is CRITICAL"`
+	Timeout                  time.Duration `default:"1m" help:"time given to the whole check, the check is UNKNOWN when consul discovery times out"`
+
+	ProbeFlags `embed:""`
+}
+
+func (r *CheckCmd) Run() error {
+	// Plugins only print their result on stdout
+	initLogger(os.Stderr, r.LogLevel)
+	state, output := r.check()
+	fmt.Fprint(os.Stdout, output)
+	os.Exit(state)
+	return nil
+}
+
+// check runs the probe and returns the plugin state and output
+func (r *CheckCmd) check() (int, string) {
+	title := fmt.Sprintf("elasticsearch %s %s", clusterName(r.Cluster, r.Endpoint), r.Probe)
+	unknown := func(err error) (int, string) {
+		return stateUnknown, fmt.Sprintf("ESPOKE %s - %s: %s\n", stateNames[stateUnknown], title, err)
+	}
+	if r.Cluster == "" && r.Endpoint == "" {
+		return unknown(fmt.Errorf("either --cluster or --endpoint is required"))
+	}
+	if r.WarningLatency > 0 && r.CriticalLatency > 0 && r.WarningLatency > r.CriticalLatency {
+		return unknown(fmt.Errorf("--warning-latency is above --critical-latency"))
+	}
+	if checkState(r.RedState) < checkState(r.YellowState) {
+		return unknown(fmt.Errorf("--red-state is below --yellow-state"))
+	}
+	if r.WarningMissingDocuments < 0 || r.CriticalMissingDocuments < 0 {
+		return unknown(fmt.Errorf("the missing documents thresholds must not be negative"))
+	}
+	if r.WarningMissingDocuments > r.CriticalMissingDocuments {
+		return unknown(fmt.Errorf("--warning-missing-documents is above --critical-missing-documents"))
+	}
+	config, err := r.buildConfig()
+	if err != nil {
+		return unknown(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.Timeout)
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go func() {
+		select {
+		case <-signals:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	var steps []probe.StepResult
+	start := time.Now()
+	p, _, err := discover(ctx, config, r.Cluster, r.Endpoint)
+	if err != nil {
+		// A cluster which does not answer on its endpoint is down, as it is when its nodes fail
+		// through consul: only failing to create the probe is UNKNOWN
+		var unreachable *probe.UnreachableError
+		if !errors.As(err, &unreachable) {
+			return unknown(err)
+		}
+		steps = append(steps, probe.StepResult{
+			Name:      "discovery",
+			Status:    probe.StepFailed,
+			LatencyMs: float64(time.Since(start).Microseconds()) / 1000,
+			Error:     err.Error(),
+		})
+	} else {
+		steps = p.(probe.Checker).Check(ctx, probe.CheckOptions{Probes: []string{r.Probe}})
+	}
+	if len(steps) == 0 {
+		return unknown(fmt.Errorf("the probe ran no step"))
+	}
+
+	var out strings.Builder
+	expected := config.ForCluster("elasticsearch", clusterName(r.Cluster, r.Endpoint)).ElasticsearchNumberOfDurabilityDocuments
+	state, problems := r.evaluate(steps, expected)
+	summary := fmt.Sprintf("all steps ok (%d)", len(steps))
+	if len(problems) > 0 {
+		summary = strings.Join(problems, ", ")
+	}
+	fmt.Fprintf(&out, "ESPOKE %s - %s: %s | %s\n", stateNames[state], title, summary, r.perfdata(steps, expected))
+	printCheckSteps(&out, steps)
+	return state, out.String()
+}
+
+// evaluate returns the worst state of the steps and a description of every problem, expected
+// being the number of durability documents
+func (r *CheckCmd) evaluate(steps []probe.StepResult, expected int) (int, []string) {
+	state := stateOK
+	var problems []string
+	raise := func(s int, problem string) {
+		if s > state {
+			state = s
+		}
+		problems = append(problems, problem)
+	}
+	for _, step := range steps {
+		latency := time.Duration(step.LatencyMs * float64(time.Millisecond))
+		message := step.Detail
+		if step.Error != "" {
+			message = step.Error
+		}
+		switch {
+		case step.Value != nil && isIndexStatusStep(step.Name):
+			if s := r.indexStatusState(*step.Value); s > stateOK {
+				raise(s, step.Name+": "+message)
+				continue
+			}
+		case step.Value != nil && isDocumentsCountStep(step.Name):
+			if s := r.documentsState(expected - int(*step.Value)); s > stateOK {
+				raise(s, step.Name+": "+message)
+				continue
+			}
+		case step.Status == probe.StepFailed:
+			raise(stateCritical, step.Name+": "+message)
+			continue
+		case step.Status == probe.StepWarning:
+			raise(stateWarning, step.Name+": "+message)
+			continue
+		}
+		switch {
+		case r.CriticalLatency > 0 && latency > r.CriticalLatency:
+			raise(stateCritical, fmt.Sprintf("%s: %.1fms > %s", step.Name, step.LatencyMs, r.CriticalLatency))
+		case r.WarningLatency > 0 && latency > r.WarningLatency:
+			raise(stateWarning, fmt.Sprintf("%s: %.1fms > %s", step.Name, step.LatencyMs, r.WarningLatency))
+		}
+	}
+	return state, problems
+}
+
+// indexStatusState returns the state of an index status, 0 green, 1 yellow and 2 red
+func (r *CheckCmd) indexStatusState(status float64) int {
+	switch {
+	case status >= 2:
+		return checkState(r.RedState)
+	case status >= 1:
+		return checkState(r.YellowState)
+	default:
+		return stateOK
+	}
+}
+
+// documentsState returns the state of a number of missing durability documents
+func (r *CheckCmd) documentsState(missing int) int {
+	switch {
+	case missing > r.CriticalMissingDocuments:
+		return stateCritical
+	case missing > r.WarningMissingDocuments:
+		return stateWarning
+	default:
+		return stateOK
+	}
+}
+
+// checkState returns the state named by a flag
+func checkState(name string) int {
+	for state, stateName := range stateNames {
+		if strings.EqualFold(name, stateName) {
+			return state
+		}
+	}
+	return stateUnknown
+}
+
+func isIndexStatusStep(name string) bool {
+	return strings.HasSuffix(name, "index status")
+}
+
+func isDocumentsCountStep(name string) bool {
+	return name == "durability count" || name == "restore count"
+}
+
+// perfdata formats the latency and the value of every step as plugin performance data, expected
+// being the number of durability documents
+func (r *CheckCmd) perfdata(steps []probe.StepResult, expected int) string {
+	var data []string
+	for _, step := range steps {
+		label := perfdataLabel(step.Name)
+		data = append(data, fmt.Sprintf("%s_latency=%sms;%s;%s;0", label, formatFloat(step.LatencyMs), thresholdMs(r.WarningLatency), thresholdMs(r.CriticalLatency)))
+		if step.Value == nil {
+			continue
+		}
+		switch {
+		case isIndexStatusStep(step.Name):
+			// 0 green, 1 yellow, 2 red as exported by es_index_probe_status: the thresholds are the
+			// highest status which is not WARNING, respectively CRITICAL
+			data = append(data, fmt.Sprintf("%s=%s;%s;%s;0;2", label, formatFloat(*step.Value), r.statusThreshold(stateWarning), r.statusThreshold(stateCritical)))
+		case isDocumentsCountStep(step.Name):
+			// Fewer documents than the start of the range raise the state
+			data = append(data, fmt.Sprintf("%s=%s;%d:;%d:;0", label, formatFloat(*step.Value), expected-r.WarningMissingDocuments, expected-r.CriticalMissingDocuments))
+		default:
+			data = append(data, fmt.Sprintf("%s=%s;;;0", label, formatFloat(*step.Value)))
+		}
+	}
+	return strings.Join(data, " ")
+}
+
+// statusThreshold returns the highest index status whose state is below state, empty when every
+// status is
+func (r *CheckCmd) statusThreshold(state int) string {
+	for status := 0.0; status < 2; status++ {
+		if r.indexStatusState(status+1) >= state {
+			return formatFloat(status)
+		}
+	}
+	return ""
+}
+
+// perfdataLabel turns a step name into a label which does not need quoting
+func perfdataLabel(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '=', '\'', '|':
+			return '_'
+		}
+		return r
+	}, name)
+}
+
+func thresholdMs(d time.Duration) string {
+	if d <= 0 {
+		return ""
+	}
+	return formatFloat(float64(d) / float64(time.Millisecond))
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// printCheckSteps prints a line per step as the long output of the plugin
+func printCheckSteps(out io.Writer, steps []probe.StepResult) {
+	for _, step := range steps {
+		detail := step.Detail
+		if step.Error != "" {
+			detail = step.Error
+		}
+		fmt.Fprintf(out, "%s: %s (%.1fms)", step.Name, step.Status, step.LatencyMs)
+		if detail != "" {
+			fmt.Fprintf(out, " %s", detail)
+		}
+		fmt.Fprintln(out)
+	}
+}
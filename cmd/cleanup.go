@@ -0,0 +1,104 @@
+// GNU General Public License version 3
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/criteo-forks/espoke/probe"
+	"github.com/pkg/errors"
+)
+
+// CleanupCmd removes the indices and documents espoke wrote to an elasticsearch cluster, it takes
+// the probe flags of serve
+type CleanupCmd struct {
+	Cluster       string        `help:"cluster to clean, as registered in consul (names it when --endpoint is set)"`
+	Endpoint      string        `help:"elasticsearch endpoint to clean without consul, eg. for a cluster no longer registered"`
+	DryRun        bool          `default:"false" help:"list what would be removed without removing anything"`
+	DocumentsOnly bool          `default:"false" help:"keep the indices and only remove the documents left behind by the latency probe"`
+	Output        string        `default:"table" enum:"table,json" short:"o" help:"output format (table or json)"`
+	Timeout       time.Duration `default:"5m" help:"time given to the whole cleanup"`
+
+	ProbeFlags `embed:""`
+}
+
+func (r *CleanupCmd) Run() error {
+	// Keep stdout for the result
+	initLogger(os.Stderr, r.LogLevel)
+	if r.Cluster == "" && r.Endpoint == "" {
+		return errors.New("either --cluster or --endpoint is required")
+	}
+
+	config, err := r.buildConfig()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.Timeout)
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go func() {
+		select {
+		case <-signals:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	p, _, err := discover(ctx, config, r.Cluster, r.Endpoint)
+	if err != nil {
+		return err
+	}
+	artifacts, err := p.(probe.Cleaner).Cleanup(ctx, probe.CleanupOptions{DryRun: r.DryRun, DocumentsOnly: r.DocumentsOnly})
+	if err != nil {
+		return err
+	}
+
+	if r.Output == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(artifacts)
+	} else {
+		err = printArtifacts(os.Stdout, clusterName(r.Cluster, r.Endpoint), artifacts)
+	}
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, artifact := range artifacts {
+		if artifact.Action == probe.ArtifactFailed {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return errors.Errorf("failed to remove %d of %d artifacts", failed, len(artifacts))
+	}
+	return nil
+}
+
+// printArtifacts prints the artifacts as a table followed by a summary
+func printArtifacts(out io.Writer, cluster string, artifacts []probe.Artifact) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "INDEX\tTYPE\tDOCUMENTS\tMANAGED\tACTION\tDETAIL")
+	actions := make(map[string]int)
+	for _, artifact := range artifacts {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%t\t%s\t%s\n", artifact.Index, artifact.Type, artifact.Documents, artifact.Managed, artifact.Action, artifact.Detail)
+		actions[artifact.Action]++
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(out, "\nelasticsearch %s: %d artifacts, %d deleted, %d would be deleted, %d skipped, %d failed\n", cluster, len(artifacts),
+		actions[probe.ArtifactDeleted], actions[probe.ArtifactWouldDelete], actions[probe.ArtifactSkipped], actions[probe.ArtifactFailed])
+	return err
+}
@@ -0,0 +1,170 @@
+// GNU General Public License version 3
+
+package cmd
+
+import (
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/alecthomas/kong"
+	"github.com/criteo-forks/espoke/common"
+	"github.com/criteo-forks/espoke/probe"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// ConfigCmd groups the configuration commands
+type ConfigCmd struct {
+	Dump ConfigDumpCmd `cmd:"" help:"Print the effective settings of every cluster discovered in consul"`
+}
+
+// ConfigDumpCmd takes the probe flags of serve, the settings of the probing daemon only are left
+// out of the dump
+type ConfigDumpCmd struct {
+	ProbeFlags `embed:""`
+}
+
+// clusterConfigDump is the effective configuration of a cluster
+type clusterConfigDump struct {
+	Service  string          `yaml:"service"`
+	Cluster  string          `yaml:"cluster"`
+	Settings common.Settings `yaml:"settings"`
+}
+
+func (r *ConfigDumpCmd) Run() error {
+	// Keep stdout for the dump
+	initLogger(os.Stderr, r.LogLevel)
+
+	config, err := r.buildConfig()
+	if err != nil {
+		return err
+	}
+	consulClient, err := common.NewClient(config.ConsulApi)
+	if err != nil {
+		return err
+	}
+
+	var dump []clusterConfigDump
+	for _, kind := range probe.Kinds() {
+		services, err := common.GetServices(consulClient, kind.ConsulTag(config))
+		if err != nil {
+			return err
+		}
+		var clusters []string
+		for cluster := range services {
+			clusters = append(clusters, cluster)
+		}
+		sort.Strings(clusters)
+		for _, cluster := range clusters {
+			settings := config.ForCluster(kind.Name, cluster).Settings()
+			settings.ProbeJitter, settings.OverlapPolicies = nil, nil
+			settings.ElasticsearchCleanupOnStop, settings.ElasticsearchCleanupGracePeriod = nil, nil
+			dump = append(dump, clusterConfigDump{
+				Service:  kind.Name,
+				Cluster:  cluster,
+				Settings: settings,
+			})
+		}
+	}
+	return yaml.NewEncoder(os.Stdout).Encode(dump)
+}
+
+// ConfigLoader loads the configuration file given with --config, its defaults set the flags
+// which are neither on the command line nor in the environment
+func ConfigLoader(r io.Reader) (kong.Resolver, error) {
+	file, err := common.ParseConfigFile(r)
+	if err != nil {
+		return nil, err
+	}
+	return configResolver(file.Defaults), nil
+}
+
+func loadConfigFile(path string) (*common.ConfigFile, error) {
+	f, err := os.Open(kong.ExpandPath(path))
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to open configuration file")
+	}
+	defer f.Close()
+	return common.ParseConfigFile(f)
+}
+
+// configResolver resolves flags from the defaults of the configuration file, keyed by flag name
+type configResolver map[string]interface{}
+
+// Validate rejects defaults which are not flags
+func (c configResolver) Validate(app *kong.Application) error {
+	flags := make(map[string]bool)
+	_ = kong.Visit(app, func(node kong.Visitable, next kong.Next) error {
+		if flag, ok := node.(*kong.Flag); ok {
+			flags[flag.Name] = true
+		}
+		return next(nil)
+	})
+	for name := range c {
+		if !flags[name] {
+			return errors.Errorf("Unknown setting %s in configuration file defaults", name)
+		}
+	}
+	return nil
+}
+
+func (c configResolver) Resolve(context *kong.Context, parent *kong.Path, flag *kong.Flag) (interface{}, error) {
+	// Environment variables win over the file, kong only lets command line flags do so
+	if flag.Env != "" && os.Getenv(flag.Env) != "" {
+		return nil, nil
+	}
+	return c[flag.Name], nil
+}
+
+// validateSettings checks the settings of a probe type or clusters with the limits applied to flags
+func validateSettings(settings common.Settings) error {
+	if settings.ProbePeriod != nil && *settings.ProbePeriod < 20*time.Second {
+		return errors.New("probe-period must be at least 20s")
+	}
+	if settings.KibanaFunctionalProbePeriod != nil && *settings.KibanaFunctionalProbePeriod < 20*time.Second {
+		return errors.New("kibana-functional-probe-period must be at least 20s")
+	}
+	if settings.RestorePeriod != nil && *settings.RestorePeriod <= 0 {
+		return errors.New("restore-period must be positive")
+	}
+	if settings.LatencyProbeRatePerMin != nil && *settings.LatencyProbeRatePerMin <= 0 {
+		return errors.New("latency-probe-rate-per-min must be positive")
+	}
+	if settings.ProbeJitter != nil && (*settings.ProbeJitter < 0 || *settings.ProbeJitter >= 1) {
+		return errors.New("probe-jitter must be between 0 and 1")
+	}
+	for _, auth := range []*string{settings.ElasticsearchAuth, settings.KibanaAuth} {
+		if auth != nil && *auth != "basic" && *auth != "api_key" && *auth != "bearer" {
+			return errors.Errorf("invalid auth mode %s, expected basic, api_key or bearer", *auth)
+		}
+	}
+	if settings.ElasticsearchIndexShards != nil && *settings.ElasticsearchIndexShards < 0 {
+		return errors.New("elasticsearch-index-shards must not be negative")
+	}
+	if settings.ElasticsearchIndexReplicas != nil && *settings.ElasticsearchIndexReplicas < 0 {
+		return errors.New("elasticsearch-index-replicas must not be negative")
+	}
+	if drift := settings.ElasticsearchIndexDrift; drift != nil && *drift != "update" && *drift != "report" {
+		return errors.Errorf("invalid elasticsearch-index-drift %s, expected update or report", *drift)
+	}
+	if settings.ElasticsearchIndexSettingsPeriod != nil && *settings.ElasticsearchIndexSettingsPeriod < time.Minute {
+		return errors.New("elasticsearch-index-settings-period must be at least 1m")
+	}
+	if settings.ElasticsearchLatencyIndexRecreatePeriod != nil && *settings.ElasticsearchLatencyIndexRecreatePeriod < 0 {
+		return errors.New("elasticsearch-latency-index-recreate-period must not be negative")
+	}
+	if cleanup := settings.ElasticsearchCleanupOnStop; cleanup != nil && *cleanup != "never" && *cleanup != "removed" && *cleanup != "always" {
+		return errors.Errorf("invalid elasticsearch-cleanup-on-stop %s, expected never, removed or always", *cleanup)
+	}
+	if settings.ElasticsearchCleanupGracePeriod != nil && *settings.ElasticsearchCleanupGracePeriod < 0 {
+		return errors.New("elasticsearch-cleanup-grace-period must not be negative")
+	}
+	for operation, policy := range settings.OverlapPolicies {
+		if err := checkOverlapPolicy(operation, policy); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+// GNU General Public License version 3
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/criteo-forks/espoke/common"
+	"github.com/criteo-forks/espoke/probe"
+)
+
+// DiscoverCmd prints what the watcher finds in consul without probing anything, it takes the
+// probe flags of serve
+type DiscoverCmd struct {
+	Output string `default:"table" enum:"table,json" short:"o" help:"output format (table or json)"`
+
+	ProbeFlags `embed:""`
+}
+
+// discoveredService is a consul service as seen by the watcher
+type discoveredService struct {
+	Service       string           `json:"service"`
+	ConsulService string           `json:"consul_service"`
+	Cluster       string           `json:"cluster"`
+	Scheme        string           `json:"scheme"`
+	Version       string           `json:"version"`
+	Endpoint      string           `json:"endpoint,omitempty"`
+	Nodes         []discoveredNode `json:"nodes"`
+	Probed        bool             `json:"probed"`
+	Warnings      []string         `json:"warnings,omitempty"`
+}
+
+type discoveredNode struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+	Scheme  string `json:"scheme"`
+	Cluster string `json:"cluster"`
+}
+
+func (r *DiscoverCmd) Run() error {
+	// Keep stdout for the result
+	initLogger(os.Stderr, r.LogLevel)
+
+	config, err := r.buildConfig()
+	if err != nil {
+		return err
+	}
+	consulClient, err := common.NewClient(config.ConsulApi)
+	if err != nil {
+		return err
+	}
+
+	var discovered []discoveredService
+	for _, kind := range probe.Kinds() {
+		services, err := common.DiscoverServices(consulClient, kind.ConsulTag(config))
+		if err != nil {
+			return err
+		}
+		for _, service := range services {
+			d := discoveredService{
+				Service:       kind.Name,
+				ConsulService: service.Name,
+				Cluster:       service.Cluster,
+				Scheme:        service.Scheme,
+				Version:       service.Version,
+				Probed:        service.DuplicateOf == "",
+			}
+			if service.Cluster == "" {
+				d.Warnings = append(d.Warnings, "no cluster_name-<name> tag, the cluster name is empty")
+			}
+			if service.Version == "" {
+				d.Warnings = append(d.Warnings, "no version-<version> tag")
+			}
+			if service.DuplicateOf != "" {
+				d.Warnings = append(d.Warnings, fmt.Sprintf("skipped, cluster name %q is already used by service %s", service.Cluster, service.DuplicateOf))
+			}
+
+			// Only elasticsearch probes go through the cluster endpoint
+			if kind.Name == "elasticsearch" {
+				clusterConfig := config.ForCluster(kind.Name, service.Cluster)
+				d.Endpoint, err = common.GetEndpointFromConsul(consulClient, service.Name, clusterConfig.ElasticsearchEndpointSuffix, clusterConfig.ElasticsearchEndpointPort)
+				if err != nil {
+					d.Warnings = append(d.Warnings, "no endpoint: "+err.Error())
+				}
+			}
+
+			nodes, err := common.DiscoverNodesForService(consulClient, service.Name)
+			if err != nil {
+				d.Warnings = append(d.Warnings, "no nodes: "+err.Error())
+			} else if len(nodes) == 0 {
+				d.Warnings = append(d.Warnings, "no nodes registered")
+			}
+			for _, node := range nodes {
+				d.Nodes = append(d.Nodes, discoveredNode{
+					Name:    node.Name,
+					Address: fmt.Sprintf("%s:%d", node.Ip, node.Port),
+					Scheme:  node.Scheme,
+					Cluster: node.Cluster,
+				})
+				if node.Cluster != service.Cluster {
+					d.Warnings = append(d.Warnings, fmt.Sprintf("node %s has cluster name %q, its metrics are labeled with it", node.Name, node.Cluster))
+				}
+			}
+			discovered = append(discovered, d)
+		}
+	}
+
+	if r.Output == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(discovered)
+	}
+	return printDiscovered(os.Stdout, discovered)
+}
+
+// printDiscovered prints a block per service followed by a summary
+func printDiscovered(out io.Writer, discovered []discoveredService) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	probed, warnings := 0, 0
+	for _, d := range discovered {
+		status := ""
+		if d.Probed {
+			probed++
+		} else {
+			status = " (skipped)"
+		}
+		fmt.Fprintf(w, "%s %s%s\n", d.Service, d.Cluster, status)
+		fmt.Fprintf(w, "  consul service:\t%s\n", d.ConsulService)
+		fmt.Fprintf(w, "  scheme:\t%s\n", d.Scheme)
+		fmt.Fprintf(w, "  version:\t%s\n", d.Version)
+		if d.Endpoint != "" {
+			fmt.Fprintf(w, "  endpoint:\t%s\n", d.Endpoint)
+		}
+		var nodes []string
+		for _, node := range d.Nodes {
+			nodes = append(nodes, fmt.Sprintf("%s (%s://%s)", node.Name, node.Scheme, node.Address))
+		}
+		fmt.Fprintf(w, "  nodes:\t%s\n", strings.Join(nodes, ", "))
+		for _, warning := range d.Warnings {
+			fmt.Fprintf(w, "  warning:\t%s\n", warning)
+		}
+		warnings += len(d.Warnings)
+		fmt.Fprintln(w)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(out, "%d services found, %d clusters probed, %d warnings\n", len(discovered), probed, warnings)
+	return err
+}
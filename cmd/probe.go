@@ -0,0 +1,205 @@
+// GNU General Public License version 3
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/signal"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/criteo-forks/espoke/common"
+	"github.com/criteo-forks/espoke/probe"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ProbeCmd probes a single elasticsearch cluster once, it takes the probe flags of serve
+type ProbeCmd struct {
+	Cluster  string        `help:"cluster to probe, as registered in consul (names it when --endpoint is set)"`
+	Endpoint string        `help:"elasticsearch endpoint to probe without consul, eg. https://es.example.com:9200"`
+	Output   string        `default:"table" enum:"table,json" short:"o" help:"output format (table or json)"`
+	Prepare  bool          `default:"false" help:"create the missing indices and durability documents first, as serve does"`
+	Timeout  time.Duration `default:"5m" help:"time given to the whole probe"`
+
+	ProbeFlags `embed:""`
+}
+
+// probeResult is the outcome of a one-shot probe
+type probeResult struct {
+	Service  string             `json:"service"`
+	Cluster  string             `json:"cluster"`
+	Endpoint string             `json:"endpoint,omitempty"`
+	Passed   bool               `json:"passed"`
+	Steps    []probe.StepResult `json:"steps"`
+}
+
+func (r *ProbeCmd) Run() error {
+	// Keep stdout for the result
+	initLogger(os.Stderr, r.LogLevel)
+	if r.Cluster == "" && r.Endpoint == "" {
+		return errors.New("either --cluster or --endpoint is required")
+	}
+
+	config, err := r.buildConfig()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.Timeout)
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go func() {
+		select {
+		case <-signals:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	result := probeResult{Service: "elasticsearch", Cluster: clusterName(r.Cluster, r.Endpoint)}
+	var p probe.Probe
+	start := time.Now()
+	p, result.Endpoint, err = discover(ctx, config, r.Cluster, r.Endpoint)
+	discovery := probe.StepResult{
+		Name:      "discovery",
+		Status:    probe.StepOK,
+		LatencyMs: float64(time.Since(start).Microseconds()) / 1000,
+		Detail:    result.Endpoint,
+	}
+	if err != nil {
+		discovery.Status = probe.StepFailed
+		discovery.Error = err.Error()
+	}
+	result.Steps = append(result.Steps, discovery)
+	if p != nil {
+		result.Steps = append(result.Steps, p.(probe.Checker).Check(ctx, probe.CheckOptions{Prepare: r.Prepare})...)
+	}
+
+	failed := 0
+	for _, step := range result.Steps {
+		if step.Status == probe.StepFailed {
+			failed++
+		}
+	}
+	result.Passed = failed == 0
+
+	if r.Output == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(result)
+	} else {
+		err = printProbeResult(os.Stdout, result)
+	}
+	if err != nil {
+		return err
+	}
+	if failed > 0 {
+		return errors.Errorf("%d of %d steps failed", failed, len(result.Steps))
+	}
+	return nil
+}
+
+// discover creates the probe of an elasticsearch cluster, from consul or from its endpoint when
+// it is set. Its metrics are registered on a registry of their own, which nothing exports.
+func discover(ctx context.Context, config *common.Config, cluster, endpoint string) (probe.Probe, string, error) {
+	var kind probe.Kind
+	for _, k := range probe.Kinds() {
+		if k.Name == "elasticsearch" {
+			kind = k
+		}
+	}
+
+	consulClient, err := common.NewClient(config.ConsulApi)
+	if err != nil {
+		return nil, "", err
+	}
+	metrics := common.NewMetrics(prometheus.NewRegistry())
+	name := clusterName(cluster, endpoint)
+	clusterConfig := config.ForCluster(kind.Name, name)
+	spec, fallback := kind.Credentials(clusterConfig)
+	credentials, err := common.NewCredentialsProvider(spec, fallback, consulClient, clusterConfig.CredentialsRefreshPeriod, metrics)
+	if err != nil {
+		return nil, "", err
+	}
+	transports := common.NewTransports(clusterConfig, metrics)
+
+	if endpoint != "" {
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return nil, "", errors.Wrapf(err, "Invalid endpoint %s", endpoint)
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return nil, "", errors.Errorf("Invalid endpoint %s, expected scheme://host:port", endpoint)
+		}
+		c := common.Cluster{Name: name, Scheme: u.Scheme, Endpoint: u.Host}
+		es, err := probe.NewEsProbeFromEndpoint(ctx, name, c, clusterConfig, credentials, transports, metrics)
+		if err != nil {
+			return nil, u.Host, err
+		}
+		return es, u.Host, nil
+	}
+
+	services, err := common.GetServices(consulClient, kind.ConsulTag(config))
+	if err != nil {
+		return nil, "", err
+	}
+	c, ok := services[name]
+	if !ok {
+		return nil, "", errors.Errorf("Cluster %s not found in consul with tag %s", name, kind.ConsulTag(config))
+	}
+	p, err := kind.New(name, c, probe.Dependencies{
+		Config:       clusterConfig,
+		ConsulClient: consulClient,
+		Transports:   transports,
+		Metrics:      metrics,
+		Credentials:  credentials,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return p, p.Cluster().Endpoint, nil
+}
+
+// clusterName returns the name of the probed cluster, the endpoint host when it is not given
+func clusterName(cluster, endpoint string) string {
+	if cluster != "" || endpoint == "" {
+		return cluster
+	}
+	if u, err := url.Parse(endpoint); err == nil {
+		return u.Hostname()
+	}
+	return endpoint
+}
+
+// printProbeResult prints the steps as a table followed by the overall result
+func printProbeResult(out io.Writer, result probeResult) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "STEP\tSTATUS\tLATENCY\tDETAIL")
+	failed := 0
+	for _, step := range result.Steps {
+		detail := step.Detail
+		if step.Error != "" {
+			failed++
+			detail = step.Error
+		}
+		fmt.Fprintf(w, "%s\t%s\t%.1fms\t%s\n", step.Name, step.Status, step.LatencyMs, detail)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	status := "PASSED"
+	if !result.Passed {
+		status = "FAILED"
+	}
+	_, err := fmt.Fprintf(out, "\n%s %s: %s (%d steps, %d failed)\n", result.Service, result.Cluster, status, len(result.Steps), failed)
+	return err
+}
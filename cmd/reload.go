@@ -0,0 +1,150 @@
+// GNU General Public License version 3
+
+package cmd
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/alecthomas/kong"
+	"github.com/criteo-forks/espoke/common"
+	"github.com/criteo-forks/espoke/watcher"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// watchReloads reloads the configuration on SIGHUP or when the configuration file changes, until
+// ctx is cancelled
+func (r *ServeCmd) watchReloads(ctx context.Context, w *watcher.Watcher, metrics *common.Metrics, kctx *kong.Context) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	defer signal.Stop(hangups)
+
+	var (
+		changes <-chan time.Time
+		modTime time.Time
+	)
+	if r.Config != "" && r.ConfigWatchPeriod > 0 {
+		ticker := time.NewTicker(r.ConfigWatchPeriod)
+		defer ticker.Stop()
+		changes = ticker.C
+		modTime = configModTime(string(r.Config))
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangups:
+			log.Info("Received SIGHUP, reloading configuration")
+		case <-changes:
+			current := configModTime(string(r.Config))
+			if current.Equal(modTime) {
+				continue
+			}
+			modTime = current
+			log.Info("Configuration file changed, reloading configuration")
+		}
+
+		if err := r.reload(w, kctx); err != nil {
+			log.Error("Failed to reload configuration, keeping the current one: ", err)
+			metrics.ConfigReloadsCount.WithLabelValues("failure").Inc()
+			metrics.ConfigLastReloadSuccessGauge.Set(0)
+			continue
+		}
+		metrics.ConfigReloadsCount.WithLabelValues("success").Inc()
+		metrics.ConfigLastReloadSuccessGauge.Set(1)
+		metrics.ConfigLastReloadSuccessTimestampGauge.SetToCurrentTime()
+	}
+}
+
+// configModTime returns when the configuration file was last modified, zero when it cannot be
+// read: a vanished file then counts as a change and its reload reports why
+func configModTime(path string) time.Time {
+	info, err := os.Stat(kong.ExpandPath(path))
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// commandLineFlags returns the names of the flags set on the command line, which win over the
+// configuration file on reload
+func commandLineFlags(kctx *kong.Context) map[string]bool {
+	explicit := make(map[string]bool)
+	for _, path := range kctx.Path {
+		if path.Flag != nil && !path.Resolved {
+			explicit[path.Flag.Name] = true
+		}
+	}
+	return explicit
+}
+
+// reload resolves the configuration file again over the flags parsed at startup by kctx and
+// applies the resulting configuration to the watcher: the command line and the environment keep
+// precedence
+func (r *ServeCmd) reload(w *watcher.Watcher, kctx *kong.Context) error {
+	reloaded, err := r.resolveConfigFile(kctx)
+	if err != nil {
+		return errors.Wrap(err, "Failed to parse configuration")
+	}
+	config, err := reloaded.buildConfig()
+	if err != nil {
+		return err
+	}
+
+	if reloaded.MetricsPort != r.MetricsPort {
+		log.Warningf("Changing the metrics port requires a restart, keeping %d", r.MetricsPort)
+	}
+	if reloaded.LogLevel != r.LogLevel {
+		initLogger(log.StandardLogger().Out, reloaded.LogLevel)
+		r.LogLevel = reloaded.LogLevel
+	}
+	return w.Reload(config)
+}
+
+// resolveConfigFile returns a copy of the flags where those missing from the command line are
+// reset to their environment variable or default, then resolved from the configuration file
+func (r *ServeCmd) resolveConfigFile(kctx *kong.Context) (*ServeCmd, error) {
+	reloaded := *r
+	if r.Config == "" {
+		return &reloaded, nil
+	}
+	file, err := loadConfigFile(string(r.Config))
+	if err != nil {
+		return nil, err
+	}
+	resolver := configResolver(file.Defaults)
+	if err := resolver.Validate(kctx.Model); err != nil {
+		return nil, err
+	}
+
+	// The model binds the flags to the copy, the running ones are left untouched
+	parser, err := kong.New(&reloaded)
+	if err != nil {
+		return nil, err
+	}
+	explicit := commandLineFlags(kctx)
+	for _, flag := range parser.Model.Flags {
+		if explicit[flag.Name] {
+			continue
+		}
+		if err := flag.Reset(); err != nil {
+			return nil, err
+		}
+		value, err := resolver.Resolve(nil, nil, flag)
+		if err != nil {
+			return nil, err
+		}
+		if value == nil {
+			continue
+		}
+		if err := flag.Parse(kong.Scan().PushTyped(value, kong.FlagValueToken), flag.Target); err != nil {
+			return nil, errors.Wrap(err, flag.ShortSummary())
+		}
+	}
+	return &reloaded, nil
+}
@@ -4,50 +4,164 @@
 package cmd
 
 import (
+	"context"
+	"github.com/alecthomas/kong"
 	"github.com/criteo-forks/espoke/common"
+	"github.com/criteo-forks/espoke/probe"
 	"github.com/criteo-forks/espoke/watcher"
+	"io"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 )
+
+// ProbeFlags are the flags of the connection to consul and the clusters and of the probes, shared
+// by every command
+type ProbeFlags struct {
+	Config                                   kong.ConfigFlag `short:"c" help:"YAML configuration file, flags and environment variables override its defaults"`
+	ConsulApi                                string          `default:"127.0.0.1:8500" help:"127.0.0.1:8500" help:"consul target api host:port" short:"a"`
+	ProbePeriod                              time.Duration   `default:"30s" help:"elasticsearch nodes probing interval for durability and nodes checks"`
+	RestorePeriod                            time.Duration   `default:"24h" help:"elasticsearch restore probing interval"`
+	ElasticsearchConsulTag                   string          `default:"maintenance-elasticsearch" help:"elasticsearch consul tag"`
+	ElasticsearchEndpointSuffix              string          `default:".service.{dc}.foo.bar" help:"Suffix to add after the consul service name to create a valid domain name"`
+	ElasticsearchEndpointPort                int             `default:"0" help:"Elasticsearch port used for cluster level calls"`
+	ElasticsearchUser                        string          `help:"Elasticsearch username" env:"ESPOKE_ELASTICSEARCH_USER"`
+	ElasticsearchPassword                    string          `help:"Elasticsearch password" env:"ESPOKE_ELASTICSEARCH_PASSWORD"`
+	ElasticsearchAuth                        string          `default:"basic" enum:"basic,api_key,bearer" help:"Elasticsearch auth mode (basic, api_key or bearer)"`
+	ElasticsearchApiKey                      string          `help:"Elasticsearch API key, either id:api_key or its base64 encoding" env:"ESPOKE_ELASTICSEARCH_API_KEY"`
+	ElasticsearchToken                       string          `help:"Elasticsearch bearer token (eg. service account token)" env:"ESPOKE_ELASTICSEARCH_TOKEN"`
+	ElasticsearchCredentials                 string          `help:"Per cluster Elasticsearch credentials source (file:<json file>, env:<prefix>, dir:<secrets dir> or consul:<kv path>), falls back to elasticsearch auth/user/password/api-key/token"`
+	ElasticsearchDurabilityIndex             string          `default:".espoke.durability" help:"Elasticsearch durability index"`
+	ElasticsearchLatencyIndex                string          `default:".espoke.latency" help:"Elasticsearch latency index"`
+	ElasticsearchNumberOfDurabilityDocuments int             `default:"100000" help:"Number of documents to stored in the durability index"`
+	ElasticsearchIndexShards                 int             `default:"1" help:"Number of primary shards of the durability and latency indices, 0 for one per data node"`
+	ElasticsearchIndexReplicas               int             `default:"1" help:"Number of replicas of the durability and latency indices"`
+	ElasticsearchIndexAutoExpandReplicas     string          `help:"Auto-expand replicas range of the durability and latency indices (eg. 0-all), overrides the number of replicas"`
+	ElasticsearchIndexRefreshInterval        string          `default:"1s" help:"Refresh interval of the durability and latency indices"`
+	ElasticsearchIndexDrift                  string          `default:"report" enum:"update,report" help:"What to do when the settings of the durability and latency indices differ from the managed ones: only report them or update them"`
+	ElasticsearchIndexSettingsPeriod         time.Duration   `default:"10m" help:"interval at which the settings of the durability and latency indices are checked"`
+	ElasticsearchLatencyIndexRecreatePeriod  time.Duration   `default:"0s" help:"interval at which the latency index is deleted and created again to get rid of deleted documents, 0 disables it"`
+	ElasticsearchRestore                     bool            `default:"false" help:"Perform Elasticsearch restore test"`
+	ElasticsearchRestoreSnapshotRepository   string          `default:"ceph_s3" help:"Name of the Elasticsearch snapshot repository"`
+	ElasticsearchRestoreSnapshotPolicy       string          `default:"probe-snapshot" help:"Name of the Elasticsearch snapshot policy"`
+	ElasticsearchAdoptIndices                bool            `default:"false" help:"Mark the durability, latency and restored indices created by earlier versions of espoke as managed by espoke, to let it manage and remove them"`
+	LatencyProbeRatePerMin                   int             `default:"120" help:"Rate of latency probing per minute (how many checks are done in a minute)"`
+	KibanaConsulTag                          string          `default:"maintenance-kibana" help:"kibana consul tag"`
+	LogstashConsulTag                        string          `default:"maintenance-logstash" help:"logstash consul tag"`
+	KibanaUser                               string          `help:"Kibana username, defaults to the elasticsearch one" env:"ESPOKE_KIBANA_USER"`
+	KibanaPassword                           string          `help:"Kibana password, defaults to the elasticsearch one" env:"ESPOKE_KIBANA_PASSWORD"`
+	KibanaAuth                               string          `default:"basic" enum:"basic,api_key,bearer" help:"Kibana auth mode (basic, api_key or bearer)"`
+	KibanaApiKey                             string          `help:"Kibana API key, either id:api_key or its base64 encoding" env:"ESPOKE_KIBANA_API_KEY"`
+	KibanaToken                              string          `help:"Kibana bearer token" env:"ESPOKE_KIBANA_TOKEN"`
+	KibanaCredentials                        string          `help:"Per cluster Kibana credentials source (file:<json file>, env:<prefix>, dir:<secrets dir> or consul:<kv path>), falls back to kibana auth/user/password/api-key/token"`
+	KibanaFunctionalProbe                    bool            `default:"false" help:"Perform Kibana functional probe (login, save an object, read it back, search through Kibana)"`
+	KibanaFunctionalProbePeriod              time.Duration   `default:"60s" help:"kibana functional probing interval"`
+	KibanaFunctionalSearchIndex              string          `default:".espoke.durability" help:"Index searched through the Kibana console proxy by the functional probe"`
+	CredentialsRefreshPeriod                 time.Duration   `default:"60s" help:"interval after which credentials are read again from their source"`
+	TLSCACert                                string          `help:"PEM CA bundle used, in addition to the system pool, to verify elasticsearch and kibana certificates" type:"path"`
+	TLSClientCert                            string          `help:"PEM client certificate presented to elasticsearch and kibana (mTLS)" type:"path"`
+	TLSClientKey                             string          `help:"PEM client key matching the client certificate" type:"path"`
+	TLSServerName                            string          `help:"Server name used to verify certificates instead of the endpoint or node name"`
+	TLSInsecureSkipVerify                    bool            `default:"false" help:"Skip certificate verification on every cluster"`
+	TLSInsecureClusters                      []string        `help:"Clusters on which certificate verification is skipped"`
+	HTTPDialTimeout                          time.Duration   `default:"5s" help:"timeout to establish TCP connections to clusters and nodes"`
+	HTTPTLSHandshakeTimeout                  time.Duration   `default:"5s" help:"timeout of TLS handshakes with clusters and nodes"`
+	HTTPResponseHeaderTimeout                time.Duration   `default:"10s" help:"timeout to receive response headers once a request is sent to a node (not to the cluster endpoint)"`
+	HTTPIdleConnTimeout                      time.Duration   `default:"90s" help:"duration after which idle pooled connections are closed"`
+	LogLevel                                 string          `default:"info" help:"log level" yaml:"log_level" short:"l"`
+}
+
+// ServeCmd takes the probe flags along with the ones of the probing daemon
 type ServeCmd struct {
-	ConsulApi                                string        `default:"127.0.0.1:8500" help:"127.0.0.1:8500" help:"consul target api host:port" short:"a"`
-	ConsulPeriod                             time.Duration `default:"120s" help:"nodes discovery update interval"`
-	ProbePeriod                              time.Duration `default:"30s" help:"elasticsearch nodes probing interval for durability and nodes checks"`
-	RestorePeriod                            time.Duration `default:"24h" help:"elasticsearch restore probing interval"`
-	CleaningPeriod                           time.Duration `default:"600s" help:"prometheus metrics cleaning interval (for vanished nodes)"`
-	ElasticsearchConsulTag                   string        `default:"maintenance-elasticsearch" help:"elasticsearch consul tag"`
-	ElasticsearchEndpointSuffix              string        `default:".service.{dc}.foo.bar" help:"Suffix to add after the consul service name to create a valid domain name"`
-	ElasticsearchEndpointPort                int           `default:"0" help:"Elasticsearch port used for cluster level calls"`
-	ElasticsearchUser                        string        `help:"Elasticsearch username"`
-	ElasticsearchPassword                    string        `help:"Elasticsearch password"`
-	ElasticsearchDurabilityIndex             string        `default:".espoke.durability" help:"Elasticsearch durability index"`
-	ElasticsearchLatencyIndex                string        `default:".espoke.latency" help:"Elasticsearch latency index"`
-	ElasticsearchNumberOfDurabilityDocuments int           `default:"100000" help:"Number of documents to stored in the durability index"`
-	ElasticsearchRestore                     bool          `default:"false" help:"Perform Elasticsearch restore test"`
-	ElasticsearchRestoreSnapshotRepository   string        `default:"ceph_s3" help:"Name of the Elasticsearch snapshot repository"`
-	ElasticsearchRestoreSnapshotPolicy       string        `default:"probe-snapshot" help:"Name of the Elasticsearch snapshot policy"`
-	LatencyProbeRatePerMin                   int           `default:"120" help:"Rate of latency probing per minute (how many checks are done in a minute)"`
-	KibanaConsulTag                          string        `default:"maintenance-kibana" help:"kibana consul tag"`
-	MetricsPort                              int           `default:"2112" help:"port where prometheus will expose metrics to" short:"p"`
-	LogLevel                                 string        `default:"info" help:"log level" yaml:"log_level" short:"l"`
+	ProbeFlags `embed:""`
+
+	ConfigWatchPeriod               time.Duration `default:"10s" help:"interval at which the configuration file is checked for changes to reload it, 0 disables it (SIGHUP always reloads)"`
+	ConsulPeriod                    time.Duration `default:"120s" help:"nodes discovery update interval"`
+	CleaningPeriod                  time.Duration `default:"600s" help:"prometheus metrics cleaning interval (for vanished nodes)"`
+	ShutdownTimeout                 time.Duration `default:"30s" help:"time given to running probes to terminate on SIGINT or SIGTERM"`
+	ProbeJitter                     float64       `default:"0.1" help:"random jitter applied to the interval of every probing operation, as a fraction of the interval"`
+	StateFile                       string        `default:"/var/lib/espoke/state.json" type:"path" help:"file where the clusters paused through the admin API are persisted"`
+	OverlapPolicies                 []string      `help:"overlap policy of probing operations as operation=policy, policy being skip, queue or cancel (e.g. es_latency=cancel)"`
+	ElasticsearchCleanupOnStop      string        `default:"never" enum:"never,removed,always" help:"remove the espoke indices of a cluster when its probe stops: never, when the cluster is removed from consul (removed), or also when espoke stops (always)"`
+	ElasticsearchCleanupGracePeriod time.Duration `default:"30m" help:"time a cluster must stay out of consul before its espoke indices are removed with elasticsearch-cleanup-on-stop, confirmed by a discovery"`
+	MetricsPort                     int           `default:"2112" help:"port where prometheus will expose metrics to" short:"p"`
+}
+
+func (r *ServeCmd) Run(kctx *kong.Context) error {
+	initLogger(os.Stdout, r.LogLevel)
+
+	log.Info("Entering serve main loop")
+	registry := prometheus.NewRegistry()
+	if err := common.RegisterRuntimeMetrics(registry); err != nil {
+		return err
+	}
+	metrics := common.NewMetrics(registry)
+	mux := common.NewMetricsMux(registry, registry)
+	metricsServer := common.StartMetricsEndpoint(r.MetricsPort, mux)
+
+	config, err := r.buildConfig()
+	if err != nil {
+		return err
+	}
+	metrics.ConfigLastReloadSuccessGauge.Set(1)
+	metrics.ConfigLastReloadSuccessTimestampGauge.SetToCurrentTime()
+
+	w, err := watcher.NewWatcher(config, metrics)
+	if err != nil {
+		return err
+	}
+	log.Info("Serving admin API on ", watcher.AdminPathPrefix)
+	mux.Handle(watcher.AdminPathPrefix, w.AdminHandler())
+	mux.Handle("/healthz", w.HealthHandler())
+	mux.Handle("/readyz", w.ReadyHandler())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Infof("Received %s, shutting down", sig)
+		// A second signal kills the process right away
+		signal.Stop(signals)
+		cancel()
+	}()
+	go r.watchReloads(ctx, w, metrics, kctx)
+
+	if err := w.WatchPools(ctx); err != nil {
+		return err
+	}
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer shutdownCancel()
+	if err := metricsServer.Shutdown(shutdownCtx); err != nil {
+		log.Warning("Failed to stop Prometheus /metrics endpoint: ", err)
+	}
+	log.Info("Shutdown complete")
+	return nil
 }
 
-func (r *ServeCmd) Run() error {
-	// Init logger
-	log.SetOutput(os.Stdout)
-	lvl, err := log.ParseLevel(r.LogLevel)
+// initLogger sets the logger output and level
+func initLogger(out io.Writer, level string) {
+	log.SetOutput(out)
+	lvl, err := log.ParseLevel(level)
 	if err != nil {
 		log.Warning("Log level not recognized, fallback to default level (INFO)")
 		lvl = log.InfoLevel
 	}
 	log.SetLevel(lvl)
 	log.Info("Logger initialized")
+}
 
-	log.Info("Entering serve main loop")
-	common.StartMetricsEndpoint(r.MetricsPort)
-
+// buildConfig checks the flags and builds the configuration, along with the per probe type and
+// per cluster settings of the configuration file
+func (r *ServeCmd) buildConfig() (*common.Config, error) {
 	log.Info("Initializing tickers")
 	if r.ConsulPeriod < 60*time.Second {
 		log.Warning("Refreshing discovery more than once a minute is not allowed, fallback to 60s")
@@ -55,46 +169,163 @@ func (r *ServeCmd) Run() error {
 	}
 	log.Info("Discovery update interval: ", r.ConsulPeriod.String())
 
-	if r.ProbePeriod < 20*time.Second {
-		log.Warning("Probing elasticsearch nodes more than 3 times a minute is not allowed, fallback to 20s")
-		r.ProbePeriod = 20 * time.Second
-	}
-	log.Info("Probing interval: ", r.ProbePeriod.String())
-
 	if r.CleaningPeriod < 240*time.Second {
 		log.Warning("Cleaning Metrics faster than every 4 minutes is not allowed, fallback to 240s")
 		r.CleaningPeriod = 240 * time.Second
 	}
 	log.Info("Metrics pruning interval: ", r.CleaningPeriod.String())
 
+	if r.ElasticsearchCleanupGracePeriod < 0 {
+		log.Warning("The cleanup grace period must not be negative, fallback to 0s")
+		r.ElasticsearchCleanupGracePeriod = 0
+	}
+
+	if r.ProbeJitter < 0 || r.ProbeJitter >= 1 {
+		log.Warning("Probe jitter must be between 0 and 1, fallback to 0.1")
+		r.ProbeJitter = 0.1
+	}
+
+	overlapPolicies, err := parseOverlapPolicies(r.OverlapPolicies)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := r.ProbeFlags.buildConfig()
+	if err != nil {
+		return nil, err
+	}
+	config.ConsulPeriod = r.ConsulPeriod
+	config.CleaningPeriod = r.CleaningPeriod
+	config.ShutdownTimeout = r.ShutdownTimeout
+	config.ProbeJitter = r.ProbeJitter
+	config.OverlapPolicies = overlapPolicies
+	config.StateFile = r.StateFile
+	config.ElasticsearchCleanupOnStop = r.ElasticsearchCleanupOnStop
+	config.ElasticsearchCleanupGracePeriod = r.ElasticsearchCleanupGracePeriod
+	return config, nil
+}
+
+// buildConfig checks the probe flags and builds the configuration, without the daemon settings,
+// along with the per probe type and per cluster settings of the configuration file
+func (r *ProbeFlags) buildConfig() (*common.Config, error) {
+	if r.ProbePeriod < 20*time.Second {
+		log.Warning("Probing elasticsearch nodes more than 3 times a minute is not allowed, fallback to 20s")
+		r.ProbePeriod = 20 * time.Second
+	}
+	log.Info("Probing interval: ", r.ProbePeriod.String())
+
 	if r.ElasticsearchRestore {
 		log.Info("Restore interval: ", r.RestorePeriod.String())
 	}
 
+	if r.ElasticsearchIndexSettingsPeriod < time.Minute {
+		log.Warning("Checking the settings of the probe indices more than once a minute is not allowed, fallback to 60s")
+		r.ElasticsearchIndexSettingsPeriod = time.Minute
+	}
+
+	// Also checked when disabled, the configuration file can enable it for some clusters
+	if r.KibanaFunctionalProbePeriod < 20*time.Second {
+		log.Warning("Kibana functional probing more than 3 times a minute is not allowed, fallback to 20s")
+		r.KibanaFunctionalProbePeriod = 20 * time.Second
+	}
+	if r.KibanaFunctionalProbe {
+		log.Info("Kibana functional probing interval: ", r.KibanaFunctionalProbePeriod.String())
+	}
+
 	config := &common.Config{
 		ElasticsearchConsulTag:                   r.ElasticsearchConsulTag,
 		ElasticsearchEndpointSuffix:              r.ElasticsearchEndpointSuffix,
 		ElasticsearchEndpointPort:                r.ElasticsearchEndpointPort,
 		ElasticsearchUser:                        r.ElasticsearchUser,
 		ElasticsearchPassword:                    r.ElasticsearchPassword,
+		ElasticsearchAuth:                        r.ElasticsearchAuth,
+		ElasticsearchApiKey:                      r.ElasticsearchApiKey,
+		ElasticsearchToken:                       r.ElasticsearchToken,
+		ElasticsearchCredentials:                 r.ElasticsearchCredentials,
 		ElasticsearchDurabilityIndex:             r.ElasticsearchDurabilityIndex,
 		ElasticsearchLatencyIndex:                r.ElasticsearchLatencyIndex,
 		ElasticsearchNumberOfDurabilityDocuments: r.ElasticsearchNumberOfDurabilityDocuments,
+		ElasticsearchIndexShards:                 r.ElasticsearchIndexShards,
+		ElasticsearchIndexReplicas:               r.ElasticsearchIndexReplicas,
+		ElasticsearchIndexAutoExpandReplicas:     r.ElasticsearchIndexAutoExpandReplicas,
+		ElasticsearchIndexRefreshInterval:        r.ElasticsearchIndexRefreshInterval,
+		ElasticsearchIndexDrift:                  r.ElasticsearchIndexDrift,
+		ElasticsearchIndexSettingsPeriod:         r.ElasticsearchIndexSettingsPeriod,
+		ElasticsearchLatencyIndexRecreatePeriod:  r.ElasticsearchLatencyIndexRecreatePeriod,
 		ElasticsearchRestore:                     r.ElasticsearchRestore,
 		ElasticsearchRestoreSnapshotRepository:   r.ElasticsearchRestoreSnapshotRepository,
 		ElasticsearchRestoreSnapshotPolicy:       r.ElasticsearchRestoreSnapshotPolicy,
+		ElasticsearchAdoptIndices:                r.ElasticsearchAdoptIndices,
 		LatencyProbeRatePerMin:                   r.LatencyProbeRatePerMin,
 		KibanaConsulTag:                          r.KibanaConsulTag,
+		LogstashConsulTag:                        r.LogstashConsulTag,
+		KibanaUser:                               r.KibanaUser,
+		KibanaPassword:                           r.KibanaPassword,
+		KibanaAuth:                               r.KibanaAuth,
+		KibanaApiKey:                             r.KibanaApiKey,
+		KibanaToken:                              r.KibanaToken,
+		KibanaCredentials:                        r.KibanaCredentials,
+		KibanaFunctionalProbe:                    r.KibanaFunctionalProbe,
+		KibanaFunctionalProbePeriod:              r.KibanaFunctionalProbePeriod,
+		KibanaFunctionalSearchIndex:              r.KibanaFunctionalSearchIndex,
+		CredentialsRefreshPeriod:                 r.CredentialsRefreshPeriod,
+		TLSCACert:                                r.TLSCACert,
+		TLSClientCert:                            r.TLSClientCert,
+		TLSClientKey:                             r.TLSClientKey,
+		TLSServerName:                            r.TLSServerName,
+		TLSInsecureSkipVerify:                    r.TLSInsecureSkipVerify,
+		TLSInsecureClusters:                      r.TLSInsecureClusters,
+		HTTPDialTimeout:                          r.HTTPDialTimeout,
+		HTTPTLSHandshakeTimeout:                  r.HTTPTLSHandshakeTimeout,
+		HTTPResponseHeaderTimeout:                r.HTTPResponseHeaderTimeout,
+		HTTPIdleConnTimeout:                      r.HTTPIdleConnTimeout,
 		ConsulApi:                                r.ConsulApi,
-		ConsulPeriod:                             r.ConsulPeriod,
 		ProbePeriod:                              r.ProbePeriod,
 		RestorePeriod:                            r.RestorePeriod,
-		CleaningPeriod:                           r.CleaningPeriod,
 	}
 
-	w, err := watcher.NewWatcher(config)
-	if err != nil {
-		return err
+	if r.Config != "" {
+		file, err := loadConfigFile(string(r.Config))
+		if err != nil {
+			return nil, err
+		}
+		for probe, settings := range file.Probes {
+			if err := validateSettings(settings); err != nil {
+				return nil, errors.Wrapf(err, "Invalid %s settings in configuration file", probe)
+			}
+		}
+		for _, settings := range file.Clusters {
+			if err := validateSettings(settings.Settings); err != nil {
+				return nil, errors.Wrapf(err, "Invalid settings of clusters matching %s in configuration file", settings.Match)
+			}
+		}
+		config.Probes = file.Probes
+		config.Clusters = file.Clusters
+	}
+	return config, nil
+}
+
+// parseOverlapPolicies parses operation=policy pairs
+func parseOverlapPolicies(values []string) (map[string]string, error) {
+	policies := make(map[string]string, len(values))
+	for _, value := range values {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, errors.Errorf("invalid overlap policy %q, expected operation=policy", value)
+		}
+		if err := checkOverlapPolicy(parts[0], parts[1]); err != nil {
+			return nil, err
+		}
+		policies[parts[0]] = parts[1]
+	}
+	return policies, nil
+}
+
+func checkOverlapPolicy(operation, policy string) error {
+	switch policy {
+	case probe.OverlapSkip, probe.OverlapQueue, probe.OverlapCancel:
+		return nil
+	default:
+		return errors.Errorf("invalid overlap policy %q for %s, expected skip, queue or cancel", policy, operation)
 	}
-	return w.WatchPools()
 }
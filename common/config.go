@@ -0,0 +1,170 @@
+// Copyright © 2018 Barthelemy Vessemont
+// GNU General Public License version 3
+
+package common
+
+import (
+	"io"
+	"io/ioutil"
+	"path"
+	"reflect"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// ConfigFile is the YAML configuration file
+type ConfigFile struct {
+	// Defaults are global settings keyed by flag name, flags and environment variables override them
+	Defaults map[string]interface{} `yaml:"defaults"`
+	// Probes are settings of every cluster of a probe type
+	Probes map[string]Settings `yaml:"probes"`
+	// Clusters are settings of the clusters matching a name or glob, applied in order after the
+	// probe type ones
+	Clusters []ClusterSettings `yaml:"clusters"`
+}
+
+// ClusterSettings are settings of the clusters whose name matches Match
+type ClusterSettings struct {
+	// Match is a cluster name or a glob, eg. "prod-*"
+	Match string `yaml:"match"`
+	// Probe restricts the settings to clusters of a probe type, eg. "elasticsearch"
+	Probe    string `yaml:"probe,omitempty"`
+	Settings `yaml:",inline"`
+}
+
+// Settings are the settings overridable per probe type or cluster, unset ones keep the global
+// value. Fields are named after the Config fields they override.
+type Settings struct {
+	ProbePeriod                              *time.Duration    `yaml:"probe-period,omitempty"`
+	RestorePeriod                            *time.Duration    `yaml:"restore-period,omitempty"`
+	ProbeJitter                              *float64          `yaml:"probe-jitter,omitempty"`
+	OverlapPolicies                          map[string]string `yaml:"overlap-policies,omitempty"`
+	LatencyProbeRatePerMin                   *int              `yaml:"latency-probe-rate-per-min,omitempty"`
+	ElasticsearchEndpointSuffix              *string           `yaml:"elasticsearch-endpoint-suffix,omitempty"`
+	ElasticsearchEndpointPort                *int              `yaml:"elasticsearch-endpoint-port,omitempty"`
+	ElasticsearchUser                        *string           `yaml:"elasticsearch-user,omitempty"`
+	ElasticsearchPassword                    *string           `yaml:"elasticsearch-password,omitempty" secret:"true"`
+	ElasticsearchAuth                        *string           `yaml:"elasticsearch-auth,omitempty"`
+	ElasticsearchApiKey                      *string           `yaml:"elasticsearch-api-key,omitempty" secret:"true"`
+	ElasticsearchToken                       *string           `yaml:"elasticsearch-token,omitempty" secret:"true"`
+	ElasticsearchCredentials                 *string           `yaml:"elasticsearch-credentials,omitempty"`
+	ElasticsearchDurabilityIndex             *string           `yaml:"elasticsearch-durability-index,omitempty"`
+	ElasticsearchLatencyIndex                *string           `yaml:"elasticsearch-latency-index,omitempty"`
+	ElasticsearchNumberOfDurabilityDocuments *int              `yaml:"elasticsearch-number-of-durability-documents,omitempty"`
+	ElasticsearchIndexShards                 *int              `yaml:"elasticsearch-index-shards,omitempty"`
+	ElasticsearchIndexReplicas               *int              `yaml:"elasticsearch-index-replicas,omitempty"`
+	ElasticsearchIndexAutoExpandReplicas     *string           `yaml:"elasticsearch-index-auto-expand-replicas,omitempty"`
+	ElasticsearchIndexRefreshInterval        *string           `yaml:"elasticsearch-index-refresh-interval,omitempty"`
+	ElasticsearchIndexDrift                  *string           `yaml:"elasticsearch-index-drift,omitempty"`
+	ElasticsearchIndexSettingsPeriod         *time.Duration    `yaml:"elasticsearch-index-settings-period,omitempty"`
+	ElasticsearchLatencyIndexRecreatePeriod  *time.Duration    `yaml:"elasticsearch-latency-index-recreate-period,omitempty"`
+	ElasticsearchRestore                     *bool             `yaml:"elasticsearch-restore,omitempty"`
+	ElasticsearchRestoreSnapshotRepository   *string           `yaml:"elasticsearch-restore-snapshot-repository,omitempty"`
+	ElasticsearchRestoreSnapshotPolicy       *string           `yaml:"elasticsearch-restore-snapshot-policy,omitempty"`
+	ElasticsearchAdoptIndices                *bool             `yaml:"elasticsearch-adopt-indices,omitempty"`
+	ElasticsearchCleanupOnStop               *string           `yaml:"elasticsearch-cleanup-on-stop,omitempty"`
+	ElasticsearchCleanupGracePeriod          *time.Duration    `yaml:"elasticsearch-cleanup-grace-period,omitempty"`
+	KibanaUser                               *string           `yaml:"kibana-user,omitempty"`
+	KibanaPassword                           *string           `yaml:"kibana-password,omitempty" secret:"true"`
+	KibanaAuth                               *string           `yaml:"kibana-auth,omitempty"`
+	KibanaApiKey                             *string           `yaml:"kibana-api-key,omitempty" secret:"true"`
+	KibanaToken                              *string           `yaml:"kibana-token,omitempty" secret:"true"`
+	KibanaCredentials                        *string           `yaml:"kibana-credentials,omitempty"`
+	KibanaFunctionalProbe                    *bool             `yaml:"kibana-functional-probe,omitempty"`
+	KibanaFunctionalProbePeriod              *time.Duration    `yaml:"kibana-functional-probe-period,omitempty"`
+	KibanaFunctionalSearchIndex              *string           `yaml:"kibana-functional-search-index,omitempty"`
+	TLSCACert                                *string           `yaml:"tls-ca-cert,omitempty"`
+	TLSClientCert                            *string           `yaml:"tls-client-cert,omitempty"`
+	TLSClientKey                             *string           `yaml:"tls-client-key,omitempty"`
+	TLSServerName                            *string           `yaml:"tls-server-name,omitempty"`
+	TLSInsecureSkipVerify                    *bool             `yaml:"tls-insecure-skip-verify,omitempty"`
+}
+
+// ParseConfigFile parses a YAML configuration file, unknown settings are rejected
+func ParseConfigFile(r io.Reader) (*ConfigFile, error) {
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to read configuration file")
+	}
+	var file ConfigFile
+	if err := yaml.UnmarshalStrict(content, &file); err != nil {
+		return nil, errors.Wrap(err, "Failed to parse configuration file")
+	}
+	for _, cluster := range file.Clusters {
+		if cluster.Match == "" {
+			return nil, errors.New("Cluster settings without match in configuration file")
+		}
+		if _, err := path.Match(cluster.Match, ""); err != nil {
+			return nil, errors.Wrapf(err, "Invalid cluster match %q in configuration file", cluster.Match)
+		}
+	}
+	return &file, nil
+}
+
+// apply sets the settings which are set on config
+func (s *Settings) apply(config *Config) {
+	settings := reflect.ValueOf(s).Elem()
+	target := reflect.ValueOf(config).Elem()
+	for i := 0; i < settings.NumField(); i++ {
+		value := settings.Field(i)
+		if value.IsNil() {
+			continue
+		}
+		field := target.FieldByName(settings.Type().Field(i).Name)
+		switch value.Kind() {
+		case reflect.Ptr:
+			field.Set(value.Elem())
+		case reflect.Map:
+			// Maps are merged, so that a cluster only overrides some of the entries
+			merged := reflect.MakeMap(value.Type())
+			for _, m := range []reflect.Value{field, value} {
+				for _, key := range m.MapKeys() {
+					merged.SetMapIndex(key, m.MapIndex(key))
+				}
+			}
+			field.Set(merged)
+		}
+	}
+}
+
+// ForCluster returns the configuration of a cluster: the global one with the settings of its
+// probe type and of the cluster settings matching its name applied
+func (c *Config) ForCluster(probe, cluster string) *Config {
+	config := *c
+	if settings, ok := c.Probes[probe]; ok {
+		settings.apply(&config)
+	}
+	for _, settings := range c.Clusters {
+		if settings.Probe != "" && settings.Probe != probe {
+			continue
+		}
+		if matched, _ := path.Match(settings.Match, cluster); matched {
+			settings.Settings.apply(&config)
+		}
+	}
+	return &config
+}
+
+// Settings returns the overridable settings of config, secrets are redacted
+func (c *Config) Settings() Settings {
+	var s Settings
+	settings := reflect.ValueOf(&s).Elem()
+	source := reflect.ValueOf(c).Elem()
+	for i := 0; i < settings.NumField(); i++ {
+		field := settings.Type().Field(i)
+		value := source.FieldByName(field.Name)
+		if field.Tag.Get("secret") == "true" && value.String() != "" {
+			value = reflect.ValueOf("<redacted>")
+		}
+		if field.Type.Kind() != reflect.Ptr {
+			settings.Field(i).Set(value)
+			continue
+		}
+		pointer := reflect.New(field.Type.Elem())
+		pointer.Elem().Set(value)
+		settings.Field(i).Set(pointer)
+	}
+	return s
+}
@@ -0,0 +1,316 @@
+// Copyright © 2018 Barthelemy Vessemont
+// GNU General Public License version 3
+
+package common
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Supported authentication modes
+const (
+	AuthBasic  = "basic"
+	AuthApiKey = "api_key"
+	AuthBearer = "bearer"
+)
+
+// Credentials are the secrets used to authenticate against a cluster
+type Credentials struct {
+	Auth     string `json:"auth"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	ApiKey   string `json:"api_key"`
+	Token    string `json:"token"`
+}
+
+// IsEmpty reports whether no secret is set at all
+func (c Credentials) IsEmpty() bool {
+	return c.Username == "" && c.Password == "" && c.ApiKey == "" && c.Token == ""
+}
+
+// Apply sets the Authorization header matching the authentication mode on req
+func (c Credentials) Apply(req *http.Request) error {
+	switch c.Auth {
+	case AuthBasic, "":
+		if c.Username != "" || c.Password != "" {
+			req.SetBasicAuth(c.Username, c.Password)
+		}
+	case AuthApiKey:
+		if c.ApiKey == "" {
+			return errors.New("Auth mode api_key requires an api key")
+		}
+		req.Header.Set("Authorization", "ApiKey "+encodeApiKey(c.ApiKey))
+	case AuthBearer:
+		if c.Token == "" {
+			return errors.New("Auth mode bearer requires a token")
+		}
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	default:
+		return errors.Errorf("Unknown auth mode %q, expected one of basic, api_key or bearer", c.Auth)
+	}
+	return nil
+}
+
+// encodeApiKey accepts both the "id:api_key" pair returned by the create API key call
+// and its already base64 encoded form
+func encodeApiKey(apiKey string) string {
+	if strings.Contains(apiKey, ":") {
+		return base64.StdEncoding.EncodeToString([]byte(apiKey))
+	}
+	return apiKey
+}
+
+// CredentialsProvider resolves the credentials to use for a given cluster
+type CredentialsProvider interface {
+	Credentials(cluster string) (Credentials, error)
+}
+
+// credentialsSource reads credentials of a cluster from its backend, ok is false when the
+// backend has no entry for this cluster
+type credentialsSource interface {
+	read(cluster string) (creds Credentials, ok bool, err error)
+}
+
+type cachedCredentials struct {
+	creds     Credentials
+	fetchedAt time.Time
+}
+
+// refreshingCredentialsProvider re-reads its source once the cached credentials are older
+// than refreshPeriod, so rotated secrets are picked up without restarting espoke
+type refreshingCredentialsProvider struct {
+	source        credentialsSource
+	fallback      Credentials
+	refreshPeriod time.Duration
+	metrics       *Metrics
+
+	mu    sync.Mutex
+	cache map[string]cachedCredentials
+}
+
+// NewCredentialsProvider builds a provider from a source spec:
+//   - "" uses fallback for every cluster
+//   - "file:/path/to/credentials.json" reads a JSON object keyed by cluster name
+//   - "env:PREFIX" reads PREFIX_<CLUSTER>_{AUTH,USERNAME,PASSWORD,API_KEY,TOKEN}
+//   - "dir:/path/to/secrets" reads /path/to/secrets/<cluster>/{auth,username,password,api_key,token}
+//   - "consul:path/in/kv" reads the JSON value stored at path/in/kv/<cluster>
+//
+// Clusters without an entry in the source use fallback, entries without an auth mode use the
+// fallback one. Failures to refresh credentials are counted in metrics.
+func NewCredentialsProvider(spec string, fallback Credentials, consulClient *api.Client, refreshPeriod time.Duration, metrics *Metrics) (CredentialsProvider, error) {
+	if spec == "" {
+		return staticCredentialsProvider(fallback), nil
+	}
+
+	var source credentialsSource
+	kind, location := splitCredentialsSpec(spec)
+	switch kind {
+	case "file":
+		source = fileCredentialsSource{path: location}
+	case "env":
+		source = envCredentialsSource{prefix: location}
+	case "dir":
+		source = dirCredentialsSource{path: location}
+	case "consul":
+		if consulClient == nil {
+			return nil, errors.Errorf("Credentials source %s requires a consul client", spec)
+		}
+		source = consulCredentialsSource{kv: consulClient.KV(), prefix: strings.Trim(location, "/")}
+	default:
+		return nil, errors.Errorf("Unknown credentials source %q, expected one of file:, env:, dir: or consul:", spec)
+	}
+	if location == "" {
+		return nil, errors.Errorf("Credentials source %q has an empty location", spec)
+	}
+
+	return &refreshingCredentialsProvider{
+		source:        source,
+		fallback:      fallback,
+		refreshPeriod: refreshPeriod,
+		metrics:       metrics,
+		cache:         make(map[string]cachedCredentials),
+	}, nil
+}
+
+func (p *refreshingCredentialsProvider) Credentials(cluster string) (Credentials, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	cached, known := p.cache[cluster]
+	if known && time.Since(cached.fetchedAt) < p.refreshPeriod {
+		return cached.creds, nil
+	}
+
+	creds, ok, err := p.source.read(cluster)
+	if err != nil {
+		if known {
+			// Keep serving the last known secret rather than failing every request
+			log.Errorf("Unable to refresh credentials for cluster %s, using last known ones: %s", cluster, err.Error())
+			p.metrics.ErrorsCount.Inc()
+			return cached.creds, nil
+		}
+		return Credentials{}, errors.Wrapf(err, "Failed to read credentials for cluster %s", cluster)
+	}
+	if !ok {
+		creds = p.fallback
+	}
+	if creds.Auth == "" {
+		creds.Auth = p.fallback.Auth
+	}
+
+	if known && creds != cached.creds {
+		log.Infof("Credentials rotated for cluster %s", cluster)
+	}
+	p.cache[cluster] = cachedCredentials{creds: creds, fetchedAt: time.Now()}
+	return creds, nil
+}
+
+type staticCredentialsProvider Credentials
+
+func (p staticCredentialsProvider) Credentials(string) (Credentials, error) {
+	return Credentials(p), nil
+}
+
+type fileCredentialsSource struct {
+	path string
+}
+
+func (s fileCredentialsSource) read(cluster string) (Credentials, bool, error) {
+	content, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return Credentials{}, false, err
+	}
+	var all map[string]Credentials
+	if err := json.Unmarshal(content, &all); err != nil {
+		return Credentials{}, false, errors.Wrapf(err, "Failed to parse credentials file %s", s.path)
+	}
+	creds, ok := all[cluster]
+	return creds, ok, nil
+}
+
+type envCredentialsSource struct {
+	prefix string
+}
+
+var envUnsafeChars = regexp.MustCompile("[^A-Z0-9_]")
+
+func (s envCredentialsSource) read(cluster string) (Credentials, bool, error) {
+	name := fmt.Sprintf("%s_%s", s.prefix, envUnsafeChars.ReplaceAllString(strings.ToUpper(cluster), "_"))
+	found := false
+	lookup := func(suffix string) string {
+		value, ok := os.LookupEnv(name + suffix)
+		found = found || ok
+		return value
+	}
+	creds := Credentials{
+		Auth:     lookup("_AUTH"),
+		Username: lookup("_USERNAME"),
+		Password: lookup("_PASSWORD"),
+		ApiKey:   lookup("_API_KEY"),
+		Token:    lookup("_TOKEN"),
+	}
+	return creds, found, nil
+}
+
+type dirCredentialsSource struct {
+	path string
+}
+
+func (s dirCredentialsSource) read(cluster string) (Credentials, bool, error) {
+	clusterDir := filepath.Join(s.path, filepath.Base(cluster))
+	if _, err := os.Stat(clusterDir); os.IsNotExist(err) {
+		return Credentials{}, false, nil
+	}
+
+	var creds Credentials
+	for file, target := range map[string]*string{
+		"auth":     &creds.Auth,
+		"username": &creds.Username,
+		"password": &creds.Password,
+		"api_key":  &creds.ApiKey,
+		"token":    &creds.Token,
+	} {
+		value, err := readSecretFile(filepath.Join(clusterDir, file))
+		if err != nil {
+			return Credentials{}, false, err
+		}
+		*target = value
+	}
+	return creds, true, nil
+}
+
+// readSecretFile returns the trimmed content of a secret file or an empty string if it does not exist
+func readSecretFile(path string) (string, error) {
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(content)), nil
+}
+
+type consulCredentialsSource struct {
+	kv     *api.KV
+	prefix string
+}
+
+func (s consulCredentialsSource) read(cluster string) (Credentials, bool, error) {
+	key := fmt.Sprintf("%s/%s", s.prefix, cluster)
+	pair, _, err := s.kv.Get(key, &api.QueryOptions{AllowStale: true, RequireConsistent: false})
+	if err != nil {
+		return Credentials{}, false, errors.Wrapf(err, "Failed to read consul key %s", key)
+	}
+	if pair == nil {
+		return Credentials{}, false, nil
+	}
+	var creds Credentials
+	if err := json.Unmarshal(pair.Value, &creds); err != nil {
+		return Credentials{}, false, errors.Wrapf(err, "Failed to parse consul key %s", key)
+	}
+	return creds, true, nil
+}
+
+func splitCredentialsSpec(spec string) (string, string) {
+	splitted := strings.SplitN(spec, ":", 2)
+	if len(splitted) != 2 {
+		return splitted[0], ""
+	}
+	return splitted[0], splitted[1]
+}
+
+// AuthTransport sets the credentials of a cluster on every request it forwards. Credentials
+// are resolved per request so a rotation is applied to already created clients.
+type AuthTransport struct {
+	Next        http.RoundTripper
+	Credentials CredentialsProvider
+	Cluster     string
+}
+
+func (t *AuthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	creds, err := t.Credentials.Credentials(t.Cluster)
+	if err != nil {
+		return nil, err
+	}
+	// A RoundTripper must not modify the original request
+	req = req.Clone(req.Context())
+	if err := creds.Apply(req); err != nil {
+		return nil, errors.Wrapf(err, "Failed to authenticate request on cluster %s", t.Cluster)
+	}
+	return t.Next.RoundTrip(req)
+}
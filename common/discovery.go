@@ -13,7 +13,6 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-//TODO detect probe stuck
 func UpdateEverKnownNodes(allEverKnownNodes []string, nodes []Node) []string {
 	for _, node := range nodes {
 		// TODO: Replace by a real struct instead of a string concatenation...
@@ -32,7 +31,6 @@ func NewClient(consulTarget string) (*api.Client, error) {
 	consulConfig.Address = consulTarget
 	consul, err := api.NewClient(consulConfig)
 	if err != nil {
-		ErrorsCount.Inc()
 		return nil, errors.Wrapf(err, "Failed to create consul client with target %s", consulTarget)
 	}
 	return consul, nil
@@ -45,7 +43,6 @@ func DiscoverNodesForService(consul *api.Client, serviceName string) ([]Node, er
 	)
 	if err != nil {
 		log.Error("Consul Discovery failed: ", err.Error())
-		ErrorsCount.Inc()
 		return nil, err
 	}
 
@@ -77,31 +74,72 @@ func DiscoverNodesForService(consul *api.Client, serviceName string) ([]Node, er
 	return nodeList, nil
 }
 
-func GetServices(consul *api.Client, consulTag string) (map[string]Cluster, error) {
+// Service is a consul service carrying the tag of a kind of cluster
+type Service struct {
+	// Name is the consul service name
+	Name string
+	Tags []string
+	// Cluster is the cluster name from the cluster_name-* tag
+	Cluster string
+	Scheme  string
+	Version string
+	// DuplicateOf is the service kept for the same cluster name, this one is then not probed
+	DuplicateOf string
+}
+
+// DiscoverServices returns the consul services tagged with consulTag sorted by name. When several
+// services have the same cluster name, the first one is probed.
+func DiscoverServices(consul *api.Client, consulTag string) ([]Service, error) {
 	consulServices, _, err := consul.Catalog().Services(nil)
 	if err != nil {
 		return nil, errors.Wrapf(err, "Failed to get services from consul")
 	}
 
+	var names []string
+	for serviceName, tags := range consulServices {
+		if contains(tags, consulTag) {
+			names = append(names, serviceName)
+		}
+	}
+	sort.Strings(names)
+
+	var services []Service
+	kept := make(map[string]string)
+	for _, serviceName := range names {
+		tags := consulServices[serviceName]
+		service := Service{
+			Name:    serviceName,
+			Tags:    tags,
+			Cluster: valueFromTags("cluster_name", tags),
+			// TODO ensure we use https when available?
+			Scheme:  schemeFromTags(tags),
+			Version: valueFromTags("version", tags),
+		}
+		if first, ok := kept[service.Cluster]; ok {
+			service.DuplicateOf = first
+		} else {
+			kept[service.Cluster] = serviceName
+		}
+		services = append(services, service)
+	}
+	return services, nil
+}
+
+func GetServices(consul *api.Client, consulTag string) (map[string]Cluster, error) {
+	discovered, err := DiscoverServices(consul, consulTag)
+	if err != nil {
+		return nil, err
+	}
+
 	var services = make(map[string]Cluster)
-	var service Cluster
-	for serviceName := range consulServices {
-		for i := range consulServices[serviceName] {
-			if consulServices[serviceName][i] == consulTag {
-				// Check cluster not already added
-				cluster := valueFromTags("cluster_name", consulServices[serviceName])
-				// TODO ensure we use https when available?
-				_, ok := services[cluster]
-				if !ok {
-					service = Cluster{
-						Name:    serviceName,
-						Scheme:  schemeFromTags(consulServices[serviceName]),
-						Version: valueFromTags("version", consulServices[serviceName]),
-					}
-					services[cluster] = service
-				}
-				break
-			}
+	for _, service := range discovered {
+		if service.DuplicateOf != "" {
+			continue
+		}
+		services[service.Cluster] = Cluster{
+			Name:    service.Name,
+			Scheme:  service.Scheme,
+			Version: service.Version,
 		}
 	}
 	return services, nil
@@ -6,129 +6,529 @@ package common
 import (
 	"fmt"
 	"net/http"
+	"runtime"
 	"strings"
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
 )
 
+// Metrics holds the metrics exported by espoke, they are registered on the registerer given to
+// NewMetrics rather than on the default registry
+type Metrics struct {
+	IndexProbeStatus                      *prometheus.GaugeVec
+	ClusterDurabilityDocumentsCount       *prometheus.GaugeVec
+	ClusterRestoreDocumentsCount          *prometheus.GaugeVec
+	ClusterDurabilitySearchDocumentsHits  *prometheus.GaugeVec
+	ClusterRestoreCount                   *prometheus.GaugeVec
+	IndexSettingsDriftGauge               *prometheus.GaugeVec
+	ClusterLatencyIndexRecreationsCount   *prometheus.CounterVec
+	ClusterLatencySummary                 *prometheus.SummaryVec
+	ClusterLatencyHistogram               *prometheus.HistogramVec
+	ClusterRestoreErrorsCount             *prometheus.CounterVec
+	ClusterErrorsCount                    *prometheus.CounterVec
+	ErrorsCount                           prometheus.Counter
+	ElasticNodeAvailabilityGauge          *prometheus.GaugeVec
+	KibanaNodeAvailabilityGauge           *prometheus.GaugeVec
+	KibanaNodeStatusGauge                 *prometheus.GaugeVec
+	KibanaNodeServiceStatusGauge          *prometheus.GaugeVec
+	KibanaNodePluginStatusGauge           *prometheus.GaugeVec
+	KibanaNodeInfoGauge                   *prometheus.GaugeVec
+	KibanaNodeLatencySummary              *prometheus.SummaryVec
+	KibanaNodeLatencyHistogram            *prometheus.HistogramVec
+	KibanaClusterErrorsCount              *prometheus.CounterVec
+	KibanaClusterNodesGauge               *prometheus.GaugeVec
+	KibanaClusterAvailableNodesGauge      *prometheus.GaugeVec
+	KibanaFunctionalSuccessGauge          *prometheus.GaugeVec
+	KibanaFunctionalStepSuccessGauge      *prometheus.GaugeVec
+	KibanaFunctionalStepLatencySummary    *prometheus.SummaryVec
+	LogstashNodeAvailabilityGauge         *prometheus.GaugeVec
+	LogstashPipelineEventsGauge           *prometheus.GaugeVec
+	LogstashPipelineQueueEventsGauge      *prometheus.GaugeVec
+	LogstashPipelineReloadFailuresGauge   *prometheus.GaugeVec
+	LogstashPipelineWorkersGauge          *prometheus.GaugeVec
+	LogstashClusterErrorsCount            *prometheus.CounterVec
+	NodeCatLatencySummary                 *prometheus.SummaryVec
+	TLSCertificateExpiryGauge             *prometheus.GaugeVec
+	HTTPPhaseLatencyHistogram             *prometheus.HistogramVec
+	ProbeStateGauge                       *prometheus.GaugeVec
+	ProbeRestartsCount                    *prometheus.CounterVec
+	ProbeLastRunGauge                     *prometheus.GaugeVec
+	ProbeStaleGauge                       *prometheus.GaugeVec
+	ProbeSkippedRunsCount                 *prometheus.CounterVec
+	ClusterProbePausedGauge               *prometheus.GaugeVec
+	ClusterProbeReadyGauge                *prometheus.GaugeVec
+	ClusterProbePrepareErrorsCount        *prometheus.CounterVec
+	ClusterProbeLastPrepareErrorGauge     *prometheus.GaugeVec
+	ConfigReloadsCount                    *prometheus.CounterVec
+	ConfigLastReloadSuccessGauge          prometheus.Gauge
+	ConfigLastReloadSuccessTimestampGauge prometheus.Gauge
+}
+
+// NewMetrics creates the espoke metrics and registers them on registerer
+func NewMetrics(registerer prometheus.Registerer) *Metrics {
+	factory := promauto.With(registerer)
+	return &Metrics{
+		IndexProbeStatus: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "es_index_probe_status",
+				Help: "Indicate index probe status (green is 0, yellow is 1 and red is 2)",
+			},
+			[]string{"cluster", "index"},
+		),
+
+		ClusterDurabilityDocumentsCount: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "es_cluster_durability_documents_count",
+				Help: "Reports number of documents count in durability index",
+			},
+			[]string{"cluster"}),
+
+		ClusterRestoreDocumentsCount: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "es_cluster_restore_documents_count",
+				Help: "Reports number of documents count in restore index",
+			},
+			[]string{"cluster"}),
+
+		ClusterDurabilitySearchDocumentsHits: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "es_cluster_durability_search_documents_hits",
+				Help: "Reports number of documents hits from the search on durability index",
+			},
+			[]string{"cluster", "index"}),
+
+		ClusterRestoreCount: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "es_cluster_restore_count",
+				Help: "Reports number of restore launched",
+			},
+			[]string{"cluster"}),
+
+		IndexSettingsDriftGauge: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "es_index_settings_drift",
+				Help: "Indicate whether a managed setting of a probe index differs from its expected value (1) or not (0)",
+			},
+			[]string{"cluster", "index", "setting"}),
+
+		ClusterLatencyIndexRecreationsCount: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "es_cluster_latency_index_recreations_count",
+				Help: "Reports number of times the latency index was deleted and created again",
+			},
+			[]string{"cluster"}),
+
+		ClusterLatencySummary: factory.NewSummaryVec(
+			prometheus.SummaryOpts{
+				Name:       "es_cluster_latency_ms",
+				Help:       "Measure latency to do operation",
+				MaxAge:     20 * time.Minute, // default value * 2
+				AgeBuckets: 20,               // default value * 4
+				BufCap:     2000,             // default value * 4
+			},
+			[]string{"cluster", "index", "operation"},
+		),
+
+		ClusterLatencyHistogram: factory.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "es_cluster_latency_histogram_ms",
+				Help:    "Measure latency to do operation",
+				Buckets: []float64{1, 2.5, 5, 7.5, 10, 15, 20, 35, 50, 75, 100, 250, 500, 1000, 5000, 10000},
+			},
+			[]string{"cluster", "index", "operation"},
+		),
+
+		ClusterRestoreErrorsCount: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "es_cluster_restore_errors_count",
+				Help: "Reports errors doing restore with a cluster",
+			},
+			[]string{"cluster"}),
+
+		ClusterErrorsCount: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "es_cluster_errors_count",
+				Help: "Reports Espoke errors doing action with a cluster",
+			},
+			[]string{"cluster"}),
+
+		ErrorsCount: factory.NewCounter(prometheus.CounterOpts{
+			Name: "es_probe_errors_count",
+			Help: "Reports Espoke internal errors absolute counter since start",
+		}),
+
+		ElasticNodeAvailabilityGauge: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "es_node_availability",
+				Help: "Reflects elasticsearch node availability : 1 is OK, 0 means node unavailable ",
+			},
+			[]string{"cluster", "node_name"},
+		),
+
+		KibanaNodeAvailabilityGauge: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "kibana_node_availability",
+				Help: "Reflects kibana node availability : 1 is OK, 0 means node unavailable ",
+			},
+			[]string{"cluster", "node_name"},
+		),
+
+		KibanaNodeStatusGauge: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "kibana_node_status",
+				Help: "Reflects kibana node overall status level : 0 is available/green, 1 degraded/yellow, 2 unavailable/red and 3 critical",
+			},
+			[]string{"cluster", "node_name"},
+		),
+
+		KibanaNodeServiceStatusGauge: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "kibana_node_service_status",
+				Help: "Reflects kibana core service status level : 0 is available/green, 1 degraded/yellow, 2 unavailable/red and 3 critical",
+			},
+			[]string{"cluster", "node_name", "service"},
+		),
+
+		KibanaNodePluginStatusGauge: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "kibana_node_plugin_status",
+				Help: "Reflects kibana plugin status level : 0 is available/green, 1 degraded/yellow, 2 unavailable/red and 3 critical",
+			},
+			[]string{"cluster", "node_name", "plugin"},
+		),
+
+		KibanaNodeInfoGauge: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "kibana_node_info",
+				Help: "Reports kibana node version, always 1",
+			},
+			[]string{"cluster", "node_name", "version"},
+		),
+
+		KibanaNodeLatencySummary: factory.NewSummaryVec(
+			prometheus.SummaryOpts{
+				Name:       "kibana_node_latency_ms",
+				Help:       "Measure latency to query status api for every kibana node",
+				MaxAge:     20 * time.Minute, // default value * 2
+				AgeBuckets: 20,               // default value * 4
+				BufCap:     2000,             // default value * 4
+			},
+			[]string{"cluster", "node_name"},
+		),
+
+		KibanaNodeLatencyHistogram: factory.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "kibana_node_latency_histogram_ms",
+				Help:    "Measure latency to query status api for every kibana node",
+				Buckets: []float64{1, 2.5, 5, 7.5, 10, 15, 20, 35, 50, 75, 100, 250, 500, 1000, 5000, 10000},
+			},
+			[]string{"cluster", "node_name"},
+		),
+
+		KibanaClusterErrorsCount: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "kibana_cluster_errors_count",
+				Help: "Reports Espoke errors probing a kibana cluster by reason (timeout, request, http_status, json, state, credentials, functional)",
+			},
+			[]string{"cluster", "reason"}),
+
+		KibanaClusterNodesGauge: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "kibana_cluster_nodes",
+				Help: "Reports number of probed kibana nodes in a cluster",
+			},
+			[]string{"cluster"}),
+
+		KibanaClusterAvailableNodesGauge: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "kibana_cluster_available_nodes",
+				Help: "Reports number of available kibana nodes in a cluster",
+			},
+			[]string{"cluster"}),
+
+		KibanaFunctionalSuccessGauge: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "kibana_functional_probe_success",
+				Help: "Reflects kibana functional probe result : 1 is every step succeeded, 0 means one failed",
+			},
+			[]string{"cluster"},
+		),
+
+		KibanaFunctionalStepSuccessGauge: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "kibana_functional_probe_step_success",
+				Help: "Reflects kibana functional probe step (login, save, read, search, cleanup) result : 1 is OK, 0 means step failed or was not run",
+			},
+			[]string{"cluster", "step"},
+		),
+
+		KibanaFunctionalStepLatencySummary: factory.NewSummaryVec(
+			prometheus.SummaryOpts{
+				Name:       "kibana_functional_probe_step_latency_ms",
+				Help:       "Measure latency of every successful kibana functional probe step",
+				MaxAge:     20 * time.Minute, // default value * 2
+				AgeBuckets: 20,               // default value * 4
+				BufCap:     2000,             // default value * 4
+			},
+			[]string{"cluster", "step"},
+		),
+
+		LogstashNodeAvailabilityGauge: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "logstash_node_availability",
+				Help: "Reflects logstash node availability : 1 is OK, 0 means node unavailable ",
+			},
+			[]string{"cluster", "node_name"},
+		),
+
+		LogstashPipelineEventsGauge: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "logstash_pipeline_events",
+				Help: "Reports number of events (in, out, filtered) processed by a logstash pipeline since the node started",
+			},
+			[]string{"cluster", "node_name", "pipeline", "type"},
+		),
+
+		LogstashPipelineQueueEventsGauge: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "logstash_pipeline_queue_events",
+				Help: "Reports number of events waiting in a logstash pipeline queue",
+			},
+			[]string{"cluster", "node_name", "pipeline"},
+		),
+
+		LogstashPipelineReloadFailuresGauge: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "logstash_pipeline_reload_failures",
+				Help: "Reports number of failed reloads of a logstash pipeline since the node started",
+			},
+			[]string{"cluster", "node_name", "pipeline"},
+		),
+
+		LogstashPipelineWorkersGauge: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "logstash_pipeline_workers",
+				Help: "Reports number of workers of a logstash pipeline",
+			},
+			[]string{"cluster", "node_name", "pipeline"},
+		),
+
+		LogstashClusterErrorsCount: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "logstash_cluster_errors_count",
+				Help: "Reports Espoke errors probing a logstash cluster",
+			},
+			[]string{"cluster"}),
+
+		NodeCatLatencySummary: factory.NewSummaryVec(
+			prometheus.SummaryOpts{
+				Name:       "es_node_cat_latency",
+				Help:       "Measure latency to query cat api for every node (quantiles - in ns)",
+				MaxAge:     20 * time.Minute, // default value * 2
+				AgeBuckets: 20,               // default value * 4
+				BufCap:     2000,             // default value * 4
+			},
+			[]string{"cluster", "node_name"},
+		),
+
+		TLSCertificateExpiryGauge: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "espoke_tls_certificate_expiry_timestamp_seconds",
+				Help: "Expiry date of the earliest expiring certificate presented by an endpoint (unix timestamp)",
+			},
+			[]string{"service", "cluster", "endpoint"},
+		),
+
+		HTTPPhaseLatencyHistogram: factory.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "espoke_http_phase_latency_histogram_ms",
+				Help:    "Measure latency of each phase (dns, connect, tls, ttfb) of HTTP requests",
+				Buckets: []float64{1, 2.5, 5, 7.5, 10, 15, 20, 35, 50, 75, 100, 250, 500, 1000, 5000, 10000},
+			},
+			[]string{"service", "cluster", "endpoint", "phase"},
+		),
+
+		ProbeStateGauge: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "espoke_probe_state",
+				Help: "Indicate the state of a cluster probe, 1 for its current state (running, restarting or failed) and 0 for the others",
+			},
+			[]string{"service", "cluster", "state"},
+		),
+
+		ProbeRestartsCount: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "espoke_probe_restarts_count",
+				Help: "Reports restarts of a cluster probe after it panicked or exited",
+			},
+			[]string{"service", "cluster"},
+		),
+
+		ProbeLastRunGauge: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "espoke_probe_last_run_timestamp_seconds",
+				Help: "Last time a probing operation (probe label) of a cluster ran (unix timestamp)",
+			},
+			[]string{"cluster", "probe"},
+		),
+
+		ProbeStaleGauge: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "espoke_probe_stale",
+				Help: "Reflects whether a probing operation of a cluster missed several runs : 1 means the probe looks stuck",
+			},
+			[]string{"cluster", "probe"},
+		),
+
+		ProbeSkippedRunsCount: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "espoke_probe_skipped_runs_count",
+				Help: "Reports runs of a probing operation skipped or cancelled because its previous run was not over",
+			},
+			[]string{"cluster", "probe", "policy"},
+		),
+
+		ClusterProbePausedGauge: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "es_cluster_probe_paused",
+				Help: "Reflects whether probing a cluster is paused through the admin API",
+			},
+			[]string{"service", "cluster"},
+		),
+
+		ClusterProbeReadyGauge: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "es_cluster_probe_ready",
+				Help: "Reflects whether a cluster discovered in consul is probed : 1 is OK, 0 means its probe could not be created or prepared yet",
+			},
+			[]string{"service", "cluster"},
+		),
+
+		ClusterProbePrepareErrorsCount: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "es_cluster_probe_prepare_errors_count",
+				Help: "Reports failures to create or prepare the probe of a cluster",
+			},
+			[]string{"service", "cluster"},
+		),
+
+		ClusterProbeLastPrepareErrorGauge: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "es_cluster_probe_last_prepare_error",
+				Help: "Last error preventing a cluster from being probed, the value is the time of the failure (unix timestamp)",
+			},
+			[]string{"service", "cluster", "error"},
+		),
+
+		ConfigReloadsCount: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "espoke_config_reloads_count",
+				Help: "Reports reloads of the configuration on SIGHUP or configuration file change, by result (success or failure)",
+			},
+			[]string{"result"},
+		),
+
+		ConfigLastReloadSuccessGauge: factory.NewGauge(prometheus.GaugeOpts{
+			Name: "espoke_config_last_reload_successful",
+			Help: "Reflects whether the last configuration reload succeeded : 1 is OK, 0 means espoke runs with the previous configuration",
+		}),
+
+		ConfigLastReloadSuccessTimestampGauge: factory.NewGauge(prometheus.GaugeOpts{
+			Name: "espoke_config_last_reload_success_timestamp_seconds",
+			Help: "Last time the configuration was successfully loaded (unix timestamp)",
+		}),
+	}
+}
+
+// States of espoke_probe_state
+const (
+	ProbeStateRunning    = "running"
+	ProbeStateRestarting = "restarting"
+	ProbeStateFailed     = "failed"
+)
+
+var probeStates = []string{ProbeStateRunning, ProbeStateRestarting, ProbeStateFailed}
+
+// Reasons of kibana_cluster_errors_count
+const (
+	KibanaErrorTimeout     = "timeout"
+	KibanaErrorRequest     = "request"
+	KibanaErrorHTTPStatus  = "http_status"
+	KibanaErrorJSON        = "json"
+	KibanaErrorState       = "state"
+	KibanaErrorCredentials = "credentials"
+	KibanaErrorFunctional  = "functional"
+)
+
+// Settings of es_index_settings_drift, the settings espoke manages on its probe indices
+const (
+	IndexSettingShards             = "index.number_of_shards"
+	IndexSettingReplicas           = "index.number_of_replicas"
+	IndexSettingAutoExpandReplicas = "index.auto_expand_replicas"
+	IndexSettingRefreshInterval    = "index.refresh_interval"
+)
+
+var ManagedIndexSettings = []string{IndexSettingShards, IndexSettingReplicas, IndexSettingAutoExpandReplicas, IndexSettingRefreshInterval}
+
+// Version and Revision of espoke, exported in espoke_build_info. They are set when building
+// with -ldflags "-X github.com/criteo-forks/espoke/common.Version=..."
 var (
-	IndexProbeStatus = promauto.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "es_index_probe_status",
-			Help: "Indicate index probe status (green is 0, yellow is 1 and red is 2)",
-		},
-		[]string{"cluster", "index"},
-	)
-
-	ClusterDurabilityDocumentsCount = promauto.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "es_cluster_durability_documents_count",
-			Help: "Reports number of documents count in durability index",
-		},
-		[]string{"cluster"})
-
-	ClusterRestoreDocumentsCount = promauto.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "es_cluster_restore_documents_count",
-			Help: "Reports number of documents count in restore index",
-		},
-		[]string{"cluster"})
-
-	ClusterDurabilitySearchDocumentsHits = promauto.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "es_cluster_durability_search_documents_hits",
-			Help: "Reports number of documents hits from the search on durability index",
-		},
-		[]string{"cluster", "index"})
-
-	ClusterRestoreCount = promauto.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "es_cluster_restore_count",
-			Help: "Reports number of restore launched",
-		},
-		[]string{"cluster"})
-
-	ClusterLatencySummary = promauto.NewSummaryVec(
-		prometheus.SummaryOpts{
-			Name:       "es_cluster_latency_ms",
-			Help:       "Measure latency to do operation",
-			MaxAge:     20 * time.Minute, // default value * 2
-			AgeBuckets: 20,               // default value * 4
-			BufCap:     2000,             // default value * 4
-		},
-		[]string{"cluster", "index", "operation"},
-	)
-
-	ClusterLatencyHistogram = promauto.NewHistogramVec(
-		prometheus.HistogramOpts{
-			Name:    "es_cluster_latency_histogram_ms",
-			Help:    "Measure latency to do operation",
-			Buckets: []float64{1, 2.5, 5, 7.5, 10, 15, 20, 35, 50, 75, 100, 250, 500, 1000, 5000, 10000},
-		},
-		[]string{"cluster", "index", "operation"},
-	)
-
-	ClusterRestoreErrorsCount = promauto.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "es_cluster_restore_errors_count",
-			Help: "Reports errors doing restore with a cluster",
-		},
-		[]string{"cluster"})
-
-	ClusterErrorsCount = promauto.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "es_cluster_errors_count",
-			Help: "Reports Espoke errors doing action with a cluster",
-		},
-		[]string{"cluster"})
-
-	ErrorsCount = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "es_probe_errors_count",
-		Help: "Reports Espoke internal errors absolute counter since start",
+	Version  = "dev"
+	Revision = "unknown"
+)
+
+// RegisterRuntimeMetrics registers espoke_build_info along with the Go runtime and process
+// metrics on registerer
+func RegisterRuntimeMetrics(registerer prometheus.Registerer) error {
+	buildInfo := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name:        "espoke_build_info",
+		Help:        "Reports the version, revision and Go version espoke was built with, always 1",
+		ConstLabels: prometheus.Labels{"version": Version, "revision": Revision, "goversion": runtime.Version()},
 	})
+	buildInfo.Set(1)
 
-	ElasticNodeAvailabilityGauge = promauto.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "es_node_availability",
-			Help: "Reflects elasticsearch node availability : 1 is OK, 0 means node unavailable ",
-		},
-		[]string{"cluster", "node_name"},
-	)
-
-	KibanaNodeAvailabilityGauge = promauto.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "kibana_node_availability",
-			Help: "Reflects kibana node availability : 1 is OK, 0 means node unavailable ",
-		},
-		[]string{"cluster", "node_name"},
-	)
-
-	NodeCatLatencySummary = promauto.NewSummaryVec(
-		prometheus.SummaryOpts{
-			Name:       "es_node_cat_latency",
-			Help:       "Measure latency to query cat api for every node (quantiles - in ns)",
-			MaxAge:     20 * time.Minute, // default value * 2
-			AgeBuckets: 20,               // default value * 4
-			BufCap:     2000,             // default value * 4
-		},
-		[]string{"cluster", "node_name"},
-	)
-)
+	collectors := []prometheus.Collector{
+		buildInfo,
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	}
+	for _, collector := range collectors {
+		if err := registerer.Register(collector); err != nil {
+			return errors.Wrap(err, "Failed to register runtime metrics")
+		}
+	}
+	return nil
+}
 
-func StartMetricsEndpoint(metricsPort int) {
+// NewMetricsMux returns a mux serving on /metrics what gatherer collects, the requests to it
+// being counted on registerer. The caller adds its own handlers to it.
+func NewMetricsMux(registerer prometheus.Registerer, gatherer prometheus.Gatherer) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.InstrumentMetricHandler(registerer, promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{})))
+	return mux
+}
+
+// StartMetricsEndpoint serves handler on metricsPort until the returned server is shut down
+func StartMetricsEndpoint(metricsPort int, handler http.Handler) *http.Server {
 	log.Info("Starting Prometheus /metrics endpoint on port ", metricsPort)
-	http.Handle("/metrics", promhttp.Handler())
+	server := &http.Server{Addr: fmt.Sprintf(":%v", metricsPort), Handler: handler}
 	go func() {
-		log.Fatal(http.ListenAndServe(fmt.Sprintf(":%v", metricsPort), nil))
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
 	}()
+	return server
 }
 
+// CleanNodeMetrics removes the metrics of the nodes of a service (elasticsearch, kibana or
+// logstash) which vanished, the metrics of the other services are left untouched
 // TODO add cluster ones to be cleaned
-func CleanNodeMetrics(nodes []Node, allEverKnownNodes []string) {
+func (m *Metrics) CleanNodeMetrics(service string, nodes []Node, allEverKnownNodes []string) {
 	for _, nodeSerializedString := range allEverKnownNodes {
 		n := strings.SplitN(nodeSerializedString, "|", 2) // [0]: name , [1] cluster
 
@@ -141,26 +541,75 @@ func CleanNodeMetrics(nodes []Node, allEverKnownNodes []string) {
 			}
 		}
 		if deleteThisNodeMetrics {
-			log.Info("Metrics removed for vanished node ", n[0], " from cluster ", n[1])
-			ElasticNodeAvailabilityGauge.DeleteLabelValues(n[1], n[0])
-			NodeCatLatencySummary.DeleteLabelValues(n[1], n[0])
-			KibanaNodeAvailabilityGauge.DeleteLabelValues(n[1], n[0])
+			log.Info("Metrics removed for vanished ", service, " node ", n[0], " from cluster ", n[1])
+			switch service {
+			case "elasticsearch":
+				m.ElasticNodeAvailabilityGauge.DeleteLabelValues(n[1], n[0])
+				m.NodeCatLatencySummary.DeleteLabelValues(n[1], n[0])
+			case "kibana":
+				m.KibanaNodeAvailabilityGauge.DeleteLabelValues(n[1], n[0])
+				m.KibanaNodeLatencySummary.DeleteLabelValues(n[1], n[0])
+				m.KibanaNodeLatencyHistogram.DeleteLabelValues(n[1], n[0])
+			case "logstash":
+				m.LogstashNodeAvailabilityGauge.DeleteLabelValues(n[1], n[0])
+			}
+			m.CleanTransportMetrics(service, n[1], []string{n[0]})
 		}
 	}
 }
 
-func CleanClusterMetrics(clusterName string, indexes []string) {
-	ClusterDurabilityDocumentsCount.DeleteLabelValues(clusterName)
-	ClusterErrorsCount.DeleteLabelValues(clusterName)
-	ClusterRestoreCount.DeleteLabelValues(clusterName)
-	ClusterRestoreErrorsCount.DeleteLabelValues(clusterName)
-	ClusterRestoreDocumentsCount.DeleteLabelValues(clusterName)
+func (m *Metrics) CleanClusterMetrics(clusterName string, indexes []string) {
+	m.ClusterDurabilityDocumentsCount.DeleteLabelValues(clusterName)
+	m.ClusterErrorsCount.DeleteLabelValues(clusterName)
+	m.ClusterRestoreCount.DeleteLabelValues(clusterName)
+	m.ClusterRestoreErrorsCount.DeleteLabelValues(clusterName)
+	m.ClusterRestoreDocumentsCount.DeleteLabelValues(clusterName)
+	m.ClusterLatencyIndexRecreationsCount.DeleteLabelValues(clusterName)
 	for _, index := range indexes {
-		IndexProbeStatus.DeleteLabelValues(clusterName, index)
-		ClusterDurabilitySearchDocumentsHits.DeleteLabelValues(clusterName, index)
+		for _, setting := range ManagedIndexSettings {
+			m.IndexSettingsDriftGauge.DeleteLabelValues(clusterName, index, setting)
+		}
+		m.IndexProbeStatus.DeleteLabelValues(clusterName, index)
+		m.ClusterDurabilitySearchDocumentsHits.DeleteLabelValues(clusterName, index)
 		for _, operation := range []string{"count", "index", "get", "search", "delete"} {
-			ClusterLatencySummary.DeleteLabelValues(clusterName, index, operation)
-			ClusterLatencyHistogram.DeleteLabelValues(clusterName, index, operation)
+			m.ClusterLatencySummary.DeleteLabelValues(clusterName, index, operation)
+			m.ClusterLatencyHistogram.DeleteLabelValues(clusterName, index, operation)
 		}
 	}
 }
+
+func (m *Metrics) CleanKibanaClusterMetrics(clusterName string) {
+	m.KibanaClusterNodesGauge.DeleteLabelValues(clusterName)
+	m.KibanaClusterAvailableNodesGauge.DeleteLabelValues(clusterName)
+	for _, reason := range []string{KibanaErrorTimeout, KibanaErrorRequest, KibanaErrorHTTPStatus, KibanaErrorJSON, KibanaErrorState, KibanaErrorCredentials, KibanaErrorFunctional} {
+		m.KibanaClusterErrorsCount.DeleteLabelValues(clusterName, reason)
+	}
+}
+
+func (m *Metrics) CleanLogstashPipelineMetrics(clusterName, nodeName, pipeline string) {
+	for _, eventType := range []string{"in", "out", "filtered"} {
+		m.LogstashPipelineEventsGauge.DeleteLabelValues(clusterName, nodeName, pipeline, eventType)
+	}
+	m.LogstashPipelineQueueEventsGauge.DeleteLabelValues(clusterName, nodeName, pipeline)
+	m.LogstashPipelineReloadFailuresGauge.DeleteLabelValues(clusterName, nodeName, pipeline)
+	m.LogstashPipelineWorkersGauge.DeleteLabelValues(clusterName, nodeName, pipeline)
+}
+
+// SetProbeState exports state as the current state of a cluster probe
+func (m *Metrics) SetProbeState(service, cluster, state string) {
+	for _, s := range probeStates {
+		value := 0.0
+		if s == state {
+			value = 1
+		}
+		m.ProbeStateGauge.WithLabelValues(service, cluster, s).Set(value)
+	}
+}
+
+// CleanProbeStateMetrics removes the state and restarts metrics of a cluster probe
+func (m *Metrics) CleanProbeStateMetrics(service, cluster string) {
+	for _, s := range probeStates {
+		m.ProbeStateGauge.DeleteLabelValues(service, cluster, s)
+	}
+	m.ProbeRestartsCount.DeleteLabelValues(service, cluster)
+}
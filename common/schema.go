@@ -23,17 +23,59 @@ type Config struct {
 	ElasticsearchEndpointPort                int
 	ElasticsearchUser                        string
 	ElasticsearchPassword                    string
+	ElasticsearchAuth                        string
+	ElasticsearchApiKey                      string
+	ElasticsearchToken                       string
+	ElasticsearchCredentials                 string
 	ElasticsearchDurabilityIndex             string
 	ElasticsearchLatencyIndex                string
 	ElasticsearchNumberOfDurabilityDocuments int
+	ElasticsearchIndexShards                 int
+	ElasticsearchIndexReplicas               int
+	ElasticsearchIndexAutoExpandReplicas     string
+	ElasticsearchIndexRefreshInterval        string
+	ElasticsearchIndexDrift                  string
+	ElasticsearchIndexSettingsPeriod         time.Duration
+	ElasticsearchLatencyIndexRecreatePeriod  time.Duration
 	ElasticsearchRestore                     bool
 	ElasticsearchRestoreSnapshotRepository   string
 	ElasticsearchRestoreSnapshotPolicy       string
+	ElasticsearchAdoptIndices                bool
+	ElasticsearchCleanupOnStop               string
+	ElasticsearchCleanupGracePeriod          time.Duration
 	LatencyProbeRatePerMin                   int
 	KibanaConsulTag                          string
+	LogstashConsulTag                        string
+	KibanaUser                               string
+	KibanaPassword                           string
+	KibanaAuth                               string
+	KibanaApiKey                             string
+	KibanaToken                              string
+	KibanaCredentials                        string
+	KibanaFunctionalProbe                    bool
+	KibanaFunctionalProbePeriod              time.Duration
+	KibanaFunctionalSearchIndex              string
+	CredentialsRefreshPeriod                 time.Duration
+	TLSCACert                                string
+	TLSClientCert                            string
+	TLSClientKey                             string
+	TLSServerName                            string
+	TLSInsecureSkipVerify                    bool
+	TLSInsecureClusters                      []string
+	HTTPDialTimeout                          time.Duration
+	HTTPTLSHandshakeTimeout                  time.Duration
+	HTTPResponseHeaderTimeout                time.Duration
+	HTTPIdleConnTimeout                      time.Duration
 	ConsulApi                                string
 	ConsulPeriod                             time.Duration
 	ProbePeriod                              time.Duration
 	RestorePeriod                            time.Duration
 	CleaningPeriod                           time.Duration
+	ShutdownTimeout                          time.Duration
+	ProbeJitter                              float64
+	OverlapPolicies                          map[string]string
+	StateFile                                string
+	// Probes and Clusters are the settings overridden per probe type and per cluster
+	Probes   map[string]Settings
+	Clusters []ClusterSettings
 }
@@ -0,0 +1,67 @@
+// Copyright © 2018 Barthelemy Vessemont
+// GNU General Public License version 3
+
+package common
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// NewTLSConfig builds the TLS configuration used to reach a cluster, config being the one of the
+// cluster. Certificates are verified against the system pool and the configured CA bundle unless
+// verification is disabled for every cluster or for this one.
+func NewTLSConfig(config *Config, cluster string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: config.TLSServerName,
+	}
+
+	if config.TLSInsecureSkipVerify || contains(config.TLSInsecureClusters, cluster) {
+		log.Warningf("TLS certificate verification is disabled for cluster %s", cluster)
+		tlsConfig.InsecureSkipVerify = true
+	}
+
+	if config.TLSCACert != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		bundle, err := ioutil.ReadFile(config.TLSCACert)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to read CA bundle %s", config.TLSCACert)
+		}
+		if !pool.AppendCertsFromPEM(bundle) {
+			return nil, errors.Errorf("No certificate found in CA bundle %s", config.TLSCACert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if config.TLSClientCert != "" || config.TLSClientKey != "" {
+		certificate, err := tls.LoadX509KeyPair(config.TLSClientCert, config.TLSClientKey)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to load client certificate %s", config.TLSClientCert)
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+
+	return tlsConfig, nil
+}
+
+// ObserveCertificateExpiry exports the earliest expiry date of the certificates presented by endpoint
+func (m *Metrics) ObserveCertificateExpiry(service, cluster, endpoint string, state *tls.ConnectionState) {
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return
+	}
+	notAfter := state.PeerCertificates[0].NotAfter
+	for _, certificate := range state.PeerCertificates[1:] {
+		if certificate.NotAfter.Before(notAfter) {
+			notAfter = certificate.NotAfter
+		}
+	}
+	m.TLSCertificateExpiryGauge.WithLabelValues(service, cluster, endpoint).Set(float64(notAfter.Unix()))
+}
@@ -0,0 +1,199 @@
+// Copyright © 2018 Barthelemy Vessemont
+// GNU General Public License version 3
+
+package common
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+type transportKey struct {
+	service    string
+	cluster    string
+	serverName string
+}
+
+type pooledClient struct {
+	transport *http.Transport
+	client    *http.Client
+}
+
+// Transports keeps the pooled HTTP transports used to reach clusters and their nodes, so
+// connections are reused between probes instead of being opened on every call
+type Transports struct {
+	config  *Config
+	metrics *Metrics
+
+	mu         sync.Mutex
+	tlsConfigs map[transportKey]*tls.Config
+	clients    map[transportKey]pooledClient
+}
+
+// NewTransports creates an empty pool of transports, their requests are observed in metrics
+func NewTransports(config *Config, metrics *Metrics) *Transports {
+	return &Transports{
+		config:     config,
+		metrics:    metrics,
+		tlsConfigs: make(map[transportKey]*tls.Config),
+		clients:    make(map[transportKey]pooledClient),
+	}
+}
+
+// Client returns the pooled client used to reach serverName on a cluster. serverName is the
+// node name for node level calls (its certificate is verified against it) and empty for the
+// cluster endpoint.
+func (t *Transports) Client(service, cluster, serverName string) (*http.Client, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := transportKey{service: service, cluster: cluster, serverName: serverName}
+	if pooled, ok := t.clients[key]; ok {
+		return pooled.client, nil
+	}
+
+	// TLS settings can be overridden per probe type and cluster
+	tlsKey := transportKey{service: service, cluster: cluster}
+	tlsConfig, ok := t.tlsConfigs[tlsKey]
+	if !ok {
+		var err error
+		tlsConfig, err = NewTLSConfig(t.config.ForCluster(service, cluster), cluster)
+		if err != nil {
+			return nil, err
+		}
+		t.tlsConfigs[tlsKey] = tlsConfig
+	}
+	if serverName != "" {
+		tlsConfig = tlsConfig.Clone()
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName = serverName
+		}
+	}
+
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   t.config.HTTPDialTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: t.config.HTTPTLSHandshakeTimeout,
+		IdleConnTimeout:     t.config.HTTPIdleConnTimeout,
+		MaxIdleConnsPerHost: 4,
+	}
+	if serverName != "" {
+		// Cluster level calls, eg. a restore waiting for completion, can take longer: they are
+		// bounded by their context
+		transport.ResponseHeaderTimeout = t.config.HTTPResponseHeaderTimeout
+	}
+	pooled := pooledClient{
+		transport: transport,
+		client: &http.Client{
+			Transport: &TracingTransport{
+				Next:     transport,
+				Metrics:  t.metrics,
+				Service:  service,
+				Cluster:  cluster,
+				Endpoint: serverName,
+			},
+		},
+	}
+	t.clients[key] = pooled
+	return pooled.client, nil
+}
+
+// Retain closes the transports of a cluster whose server name is not in serverNames, the one
+// of the cluster endpoint excepted
+func (t *Transports) Retain(service, cluster string, serverNames []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for key, pooled := range t.clients {
+		if key.service == service && key.cluster == cluster && key.serverName != "" && !contains(serverNames, key.serverName) {
+			pooled.transport.CloseIdleConnections()
+			delete(t.clients, key)
+		}
+	}
+}
+
+// Close closes every transport of a cluster
+func (t *Transports) Close(service, cluster string) {
+	t.Retain(service, cluster, nil)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := transportKey{service: service, cluster: cluster}
+	if pooled, ok := t.clients[key]; ok {
+		pooled.transport.CloseIdleConnections()
+		delete(t.clients, key)
+	}
+	delete(t.tlsConfigs, key)
+}
+
+// TracingTransport breaks down the latency of every request into DNS, connect, TLS and time
+// to first byte phases, and exports the certificate expiry of the reached endpoint
+type TracingTransport struct {
+	Next     http.RoundTripper
+	Metrics  *Metrics
+	Service  string
+	Cluster  string
+	Endpoint string // defaults to the request host
+}
+
+func (t *TracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	endpoint := t.Endpoint
+	if endpoint == "" {
+		endpoint = req.URL.Host
+	}
+	// Dial hooks may be called from the transport dialing goroutine
+	var mu sync.Mutex
+	observe := func(phase string, phaseStart *time.Time) {
+		mu.Lock()
+		defer mu.Unlock()
+		if phaseStart.IsZero() {
+			return
+		}
+		durationMilliSec := float64(time.Since(*phaseStart).Microseconds()) / 1000
+		t.Metrics.HTTPPhaseLatencyHistogram.WithLabelValues(t.Service, t.Cluster, endpoint, phase).Observe(durationMilliSec)
+	}
+
+	// Phases only happen on new connections, reused ones only report time to first byte
+	var dnsStart, connectStart, tlsStart time.Time
+	mark := func(phaseStart *time.Time) {
+		mu.Lock()
+		defer mu.Unlock()
+		*phaseStart = time.Now()
+	}
+	start := time.Now()
+	trace := &httptrace.ClientTrace{
+		DNSStart:             func(httptrace.DNSStartInfo) { mark(&dnsStart) },
+		DNSDone:              func(httptrace.DNSDoneInfo) { observe("dns", &dnsStart) },
+		ConnectStart:         func(string, string) { mark(&connectStart) },
+		ConnectDone:          func(string, string, error) { observe("connect", &connectStart) },
+		TLSHandshakeStart:    func() { mark(&tlsStart) },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { observe("tls", &tlsStart) },
+		GotFirstResponseByte: func() { observe("ttfb", &start) },
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+	resp, err := t.Next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	t.Metrics.ObserveCertificateExpiry(t.Service, t.Cluster, endpoint, resp.TLS)
+	return resp, nil
+}
+
+// CleanTransportMetrics removes the metrics of every endpoint of a cluster
+func (m *Metrics) CleanTransportMetrics(service, cluster string, endpoints []string) {
+	for _, endpoint := range endpoints {
+		m.TLSCertificateExpiryGauge.DeleteLabelValues(service, cluster, endpoint)
+		for _, phase := range []string{"dns", "connect", "tls", "ttfb"} {
+			m.HTTPPhaseLatencyHistogram.DeleteLabelValues(service, cluster, endpoint, phase)
+		}
+	}
+}
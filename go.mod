@@ -11,4 +11,5 @@ require (
 	github.com/prometheus/client_golang v1.8.0
 	github.com/sirupsen/logrus v1.7.0
 	github.com/valyala/fastjson v1.6.3
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -27,11 +27,16 @@ var CLI struct {
 	 * run an empty search query against every discovered indexes, data servers & clusters
 	 * expose latency metrics with tags for clusters and nodes
 	 * expose avaibility metrics with tags for clusters and nodes*/
-	Serve cmd.ServeCmd `cmd help:"espoke is a whitebox probing tool for Elasticsearch clusters"`
+	Serve    cmd.ServeCmd    `cmd:"" help:"espoke is a whitebox probing tool for Elasticsearch clusters"`
+	Config   cmd.ConfigCmd   `cmd:"" help:"Inspect the configuration"`
+	Probe    cmd.ProbeCmd    `cmd:"" help:"Probe an elasticsearch cluster once and report the result of every step"`
+	Discover cmd.DiscoverCmd `cmd:"" help:"Print the services espoke finds in consul, without probing them"`
+	Check    cmd.CheckCmd    `cmd:"" help:"Run one probe against one elasticsearch cluster as a Nagios/Icinga plugin"`
+	Cleanup  cmd.CleanupCmd  `cmd:"" help:"Remove the indices and documents espoke wrote to an elasticsearch cluster"`
 }
 
 func main() {
-	ctx := kong.Parse(&CLI)
+	ctx := kong.Parse(&CLI, kong.Configuration(cmd.ConfigLoader))
 	err := ctx.Run()
 	ctx.FatalIfErrorf(err)
 }
@@ -0,0 +1,78 @@
+// GNU General Public License version 3
+
+package probe
+
+import (
+	"context"
+	"time"
+)
+
+// Statuses of a step of a one-shot check
+const (
+	StepOK      = "ok"
+	StepWarning = "warning"
+	StepFailed  = "failed"
+)
+
+// Probes a one-shot check can be restricted to
+const (
+	CheckNodes      = "nodes"
+	CheckDurability = "durability"
+	CheckLatency    = "latency"
+	CheckRestore    = "restore"
+)
+
+// StepResult is the outcome of a step of a one-shot check
+type StepResult struct {
+	Name      string  `json:"name"`
+	Status    string  `json:"status"`
+	LatencyMs float64 `json:"latency_ms"`
+	// Value is what the step measured besides its latency, eg. a number of documents
+	Value  *float64 `json:"value,omitempty"`
+	Detail string   `json:"detail,omitempty"`
+	Error  string   `json:"error,omitempty"`
+}
+
+// CheckOptions select what a one-shot check runs
+type CheckOptions struct {
+	// Prepare creates the missing indices and documents first
+	Prepare bool
+	// Probes restricts the check to some probes, every enabled one runs when empty
+	Probes []string
+}
+
+// Checker is implemented by probes which can run their probing operations once and report the
+// result of every step instead of exporting metrics
+type Checker interface {
+	Check(ctx context.Context, options CheckOptions) []StepResult
+}
+
+// stepWarning is returned by steps which succeeded in a degraded state
+type stepWarning string
+
+func (w stepWarning) Error() string {
+	return string(w)
+}
+
+// checkSteps records the results of the steps of a check
+type checkSteps []StepResult
+
+// run runs a step, which may set the detail and value of its result, and records the result. It
+// returns false when the step failed.
+func (s *checkSteps) run(name string, step func(result *StepResult) error) bool {
+	result := StepResult{Name: name, Status: StepOK}
+	start := time.Now()
+	err := step(&result)
+	result.LatencyMs = float64(time.Since(start).Microseconds()) / 1000
+	switch e := err.(type) {
+	case nil:
+	case stepWarning:
+		result.Status = StepWarning
+		result.Detail = string(e)
+	default:
+		result.Status = StepFailed
+		result.Error = err.Error()
+	}
+	*s = append(*s, result)
+	return result.Status != StepFailed
+}
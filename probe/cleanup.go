@@ -0,0 +1,41 @@
+// GNU General Public License version 3
+
+package probe
+
+import "context"
+
+// Actions taken on an artifact by a cleanup
+const (
+	ArtifactDeleted     = "deleted"
+	ArtifactWouldDelete = "would delete"
+	ArtifactKept        = "kept"
+	ArtifactSkipped     = "skipped"
+	ArtifactFailed      = "failed"
+)
+
+// Artifact is something espoke writes to a probed cluster: an index, or the documents of an index
+// left behind by a probe
+type Artifact struct {
+	Type      string `json:"type"`
+	Index     string `json:"index"`
+	Documents int    `json:"documents"`
+	// Managed is whether the index carries the marker espoke sets on the indices it creates
+	Managed bool   `json:"managed"`
+	Action  string `json:"action"`
+	Detail  string `json:"detail,omitempty"`
+}
+
+// CleanupOptions select what a cleanup removes
+type CleanupOptions struct {
+	// DryRun lists the artifacts without removing anything
+	DryRun bool
+	// DocumentsOnly keeps the indices and only removes the documents left behind by probes, for
+	// clusters which are still probed
+	DocumentsOnly bool
+}
+
+// Cleaner is implemented by probes which can remove what they wrote to the probed cluster.
+// Indices espoke did not create are never removed.
+type Cleaner interface {
+	Cleanup(ctx context.Context, options CleanupOptions) ([]Artifact, error)
+}
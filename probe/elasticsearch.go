@@ -5,13 +5,15 @@ package probe
 
 import (
 	"bytes"
-	"crypto/tls"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/criteo-forks/espoke/common"
 	"github.com/google/uuid"
 	"github.com/hashicorp/consul/api"
 	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"strconv"
 	"strings"
@@ -27,10 +29,33 @@ var (
 		"depending on the nature of a document, a kilobyte can hold about half of a page of text, while a megabyte " +
 		"holds about 500 pages of text."
 	INDEX_RESTORE = ".espoke.restored"
+	// MANAGED_BY is the _meta.managed_by marker of the indices created by espoke
+	MANAGED_BY = "espoke"
 )
 
 const millisecondInMinute = 60_000
 
+var elasticsearchKind = Kind{
+	Name: "elasticsearch",
+	ConsulTag: func(config *common.Config) string {
+		return config.ElasticsearchConsulTag
+	},
+	Credentials: func(config *common.Config) (string, common.Credentials) {
+		return config.ElasticsearchCredentials, elasticsearchDefaultCredentials(config)
+	},
+	New: newElasticsearchProbe,
+}
+
+func elasticsearchDefaultCredentials(config *common.Config) common.Credentials {
+	return common.Credentials{
+		Auth:     config.ElasticsearchAuth,
+		Username: config.ElasticsearchUser,
+		Password: config.ElasticsearchPassword,
+		ApiKey:   config.ElasticsearchApiKey,
+		Token:    config.ElasticsearchToken,
+	}
+}
+
 type EsDocument struct {
 	Name     string
 	EventTye string
@@ -43,264 +68,393 @@ type EsProbe struct {
 	clusterName   string
 	clusterConfig common.Cluster
 	config        *common.Config
+	endpoint      string
 	client        *elasticsearch7.Client
+	credentials   common.CredentialsProvider
+	transports    *common.Transports
+	metrics       *common.Metrics
 
 	consulClient *api.Client
 
-	timeout time.Duration
+	heartbeat *Heartbeat
+	scheduler *scheduler
 
-	updateDiscoveryTicker                 *time.Ticker
-	cleanMetricsTicker                    *time.Ticker
-	executeClusterDurabilityProbingTicker *time.Ticker
-	executeClusterLatencyProbingTicker    *time.Ticker
-	executeNodeProbingTicker              *time.Ticker
-	executeRestoreProbingTicker           *time.Ticker
+	// latencyIndexMu is held for writing while the latency index is recreated
+	latencyIndexMu sync.RWMutex
 
+	// mu guards the nodes lists, updated and read by operations running concurrently, and the
+	// warnings already logged about the probe indices
+	mu                  sync.RWMutex
 	esNodesList         []common.Node
 	allEverKnownEsNodes []string
+	indexWarnings       map[string]bool
+}
 
-	controlChan chan bool
+// newElasticsearchProbe builds the cluster endpoint from consul and creates its probe
+func newElasticsearchProbe(clusterName string, clusterConfig common.Cluster, deps Dependencies) (Probe, error) {
+	endpoint, err := common.GetEndpointFromConsul(deps.ConsulClient, clusterConfig.Name, deps.Config.ElasticsearchEndpointSuffix, deps.Config.ElasticsearchEndpointPort)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Could not generate endpoint from consul for cluster %s", clusterName)
+	}
+	clusterConfig.Endpoint = endpoint
+	return NewEsProbe(clusterName, endpoint, clusterConfig, deps.Config, deps.ConsulClient, deps.Credentials, deps.Transports, deps.Metrics)
 }
 
-func NewEsProbe(clusterName, endpoint string, clusterConfig common.Cluster, config *common.Config, consulClient *api.Client, controlChan chan bool) (EsProbe, error) {
-	var allEverKnownEsNodes []string
+func NewEsProbe(clusterName, endpoint string, clusterConfig common.Cluster, config *common.Config, consulClient *api.Client, credentials common.CredentialsProvider, transports *common.Transports, metrics *common.Metrics) (*EsProbe, error) {
 	esNodesList, err := common.DiscoverNodesForService(consulClient, clusterConfig.Name)
 	if err != nil {
-		return EsProbe{}, errors.Wrapf(err, "Impossible to discover ES nodes during bootstrap for cluster %s", clusterName)
+		return nil, errors.Wrapf(err, "Impossible to discover ES nodes during bootstrap for cluster %s", clusterName)
 	}
-	allEverKnownEsNodes = common.UpdateEverKnownNodes(allEverKnownEsNodes, esNodesList)
+	return newEsProbe(clusterName, endpoint, clusterConfig, config, consulClient, esNodesList, credentials, transports, metrics)
+}
 
-	client, err := initEsClient(clusterConfig.Scheme, endpoint, config.ElasticsearchUser, config.ElasticsearchPassword)
+// NewEsProbeFromEndpoint creates the probe of a cluster which is not in consul, its nodes are
+// listed by the cluster itself. It can only be checked once, not started.
+func NewEsProbeFromEndpoint(ctx context.Context, clusterName string, clusterConfig common.Cluster, config *common.Config, credentials common.CredentialsProvider, transports *common.Transports, metrics *common.Metrics) (*EsProbe, error) {
+	es, err := newEsProbe(clusterName, clusterConfig.Endpoint, clusterConfig, config, nil, nil, credentials, transports, metrics)
+	if err != nil {
+		return nil, err
+	}
+	nodes, err := es.discoverNodes(ctx)
 	if err != nil {
-		return EsProbe{}, errors.Wrapf(err, "Failed to init elasticsearch client for cluster %s", clusterName)
+		return nil, &UnreachableError{err: errors.Wrapf(err, "Impossible to discover ES nodes of %s", clusterConfig.Endpoint)}
 	}
+	es.esNodesList = nodes
+	es.allEverKnownEsNodes = common.UpdateEverKnownNodes(nil, nodes)
+	es.heartbeat.setNodes(nodes)
+	return es, nil
+}
 
-	return EsProbe{
+// UnreachableError is returned by NewEsProbeFromEndpoint when the cluster failed to list its nodes,
+// as opposed to errors of its configuration
+type UnreachableError struct {
+	err error
+}
+
+func (e *UnreachableError) Error() string {
+	return e.err.Error()
+}
+
+func newEsProbe(clusterName, endpoint string, clusterConfig common.Cluster, config *common.Config, consulClient *api.Client, esNodesList []common.Node, credentials common.CredentialsProvider, transports *common.Transports, metrics *common.Metrics) (*EsProbe, error) {
+	allEverKnownEsNodes := common.UpdateEverKnownNodes(nil, esNodesList)
+	heartbeat := newHeartbeat(clusterName, metrics, metrics.ElasticNodeAvailabilityGauge)
+	heartbeat.setNodes(esNodesList)
+
+	client, err := initEsClient(clusterConfig.Scheme, endpoint, clusterName, credentials, transports)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to init elasticsearch client for cluster %s", clusterName)
+	}
+
+	es := &EsProbe{
 		clusterName:   clusterName,
 		clusterConfig: clusterConfig,
 		config:        config,
+		endpoint:      endpoint,
 		client:        client,
+		credentials:   credentials,
+		transports:    transports,
+		metrics:       metrics,
 
 		consulClient: consulClient,
 
-		timeout: config.ProbePeriod - 2*time.Second,
-
-		updateDiscoveryTicker:                 time.NewTicker(config.ConsulPeriod),
-		executeClusterDurabilityProbingTicker: time.NewTicker(config.ProbePeriod),
-		executeClusterLatencyProbingTicker:    time.NewTicker(time.Duration(millisecondInMinute/config.LatencyProbeRatePerMin) * time.Millisecond),
-		executeNodeProbingTicker:              time.NewTicker(config.ProbePeriod),
-		executeRestoreProbingTicker:           time.NewTicker(config.RestorePeriod),
-		cleanMetricsTicker:                    time.NewTicker(config.CleaningPeriod),
+		heartbeat: heartbeat,
 
 		esNodesList:         esNodesList,
 		allEverKnownEsNodes: allEverKnownEsNodes,
+		indexWarnings:       make(map[string]bool),
+	}
 
-		controlChan: controlChan,
-	}, nil
+	es.scheduler = newScheduler(clusterName, heartbeat, config, metrics)
+	es.scheduler.add("es_discovery", consulPeriod, OverlapQueue, es.updateNodes)
+	es.scheduler.add("es_durability", probePeriod, OverlapSkip, es.probeDurability)
+	es.scheduler.add("es_latency", latencyPeriod, OverlapSkip, es.probeLatency)
+	es.scheduler.add("es_nodes", probePeriod, OverlapSkip, es.probeNodes)
+	es.scheduler.add("es_restore", restorePeriod, OverlapSkip, es.probeRestore)
+	es.scheduler.add("es_cleaning", cleaningPeriod, OverlapQueue, es.cleanMetrics)
+	es.scheduler.add("es_index_settings", indexSettingsPeriod, OverlapSkip, es.checkIndexSettings)
+	if config.ElasticsearchLatencyIndexRecreatePeriod > 0 {
+		es.scheduler.add("es_latency_recreate", latencyRecreatePeriod, OverlapSkip, es.recreateLatencyIndex)
+	}
+	return es, nil
 }
 
-func (es *EsProbe) PrepareEsProbing() error {
-	// TODO: recreate latency index
+func latencyPeriod(config *common.Config) time.Duration {
+	return time.Duration(millisecondInMinute/config.LatencyProbeRatePerMin) * time.Millisecond
+}
+
+func restorePeriod(config *common.Config) time.Duration {
+	return config.RestorePeriod
+}
+
+func (es *EsProbe) Name() string {
+	return es.clusterName
+}
+
+func (es *EsProbe) Cluster() common.Cluster {
+	return es.clusterConfig
+}
+
+func (es *EsProbe) Heartbeat() *Heartbeat {
+	return es.heartbeat
+}
+
+func (es *EsProbe) Trigger(operation string) error {
+	return es.scheduler.trigger(operation)
+}
+
+func (es *EsProbe) Reschedule(config *common.Config) {
+	es.scheduler.reschedule(config)
+}
+
+// nodes returns the current and ever known nodes of the cluster
+func (es *EsProbe) nodes() ([]common.Node, []string) {
+	es.mu.RLock()
+	defer es.mu.RUnlock()
+	return es.esNodesList, es.allEverKnownEsNodes
+}
+
+func (es *EsProbe) Prepare(ctx context.Context) error {
+	// Indices created by earlier versions of espoke get the marker when enabled, so that they are
+	// managed
+	if es.config.ElasticsearchAdoptIndices {
+		for _, index := range []string{es.config.ElasticsearchDurabilityIndex, es.config.ElasticsearchLatencyIndex, INDEX_RESTORE} {
+			if _, _, err := es.adoptIndex(ctx, index); err != nil {
+				log.Error(err)
+				es.metrics.ClusterErrorsCount.WithLabelValues(es.clusterName).Add(1)
+			}
+		}
+	}
+
 	// Check index available
-	if err := es.createMissingIndex(es.config.ElasticsearchDurabilityIndex); err != nil {
+	if err := es.createMissingIndex(ctx, es.config.ElasticsearchDurabilityIndex); err != nil {
 		return err
 	}
-	if err := es.createMissingIndex(es.config.ElasticsearchLatencyIndex); err != nil {
+	if err := es.createMissingIndex(ctx, es.config.ElasticsearchLatencyIndex); err != nil {
 		return err
 	}
 
 	// Count docs on durability index and put docs if needed
-	number_of_current_durability_documents, _, err := es.countNumberOfDurabilityDocs(es.config.ElasticsearchDurabilityIndex)
+	number_of_current_durability_documents, _, err := es.countNumberOfDurabilityDocs(ctx, es.config.ElasticsearchDurabilityIndex)
 	if err != nil {
 		return err
 	}
 
-	if err := es.fillDurabilityBucketWithMissingDocs(number_of_current_durability_documents); err != nil {
+	if err := es.fillDurabilityBucketWithMissingDocs(ctx, number_of_current_durability_documents); err != nil {
 		return err
 	}
 
+	// Drifts are logged and exported, they do not keep the probe from starting
+	_ = es.checkIndexSettings(ctx)
 	return nil
 }
 
-func (es *EsProbe) StartEsProbing() error {
-	for {
-		select {
-		case <-es.controlChan:
-			log.Infof("Terminating es probe on %s", es.clusterName)
-			es.cleanMetricsTicker.Stop()
-			es.updateDiscoveryTicker.Stop()
-			es.executeClusterDurabilityProbingTicker.Stop()
-			es.executeClusterLatencyProbingTicker.Stop()
-			es.executeNodeProbingTicker.Stop()
-			es.executeRestoreProbingTicker.Stop()
-			common.CleanNodeMetrics(es.esNodesList, es.allEverKnownEsNodes)
-			common.CleanClusterMetrics(es.clusterName, []string{es.config.ElasticsearchDurabilityIndex, es.config.ElasticsearchLatencyIndex})
-			return nil
-
-		case <-es.cleanMetricsTicker.C:
-			//TODO move this to the update node and only remove the node deleted
-			log.Infof("Cleaning Prometheus metrics for unreferenced nodes for cluster %s", es.clusterName)
-			common.CleanNodeMetrics(es.esNodesList, es.allEverKnownEsNodes)
-
-		case <-es.updateDiscoveryTicker.C:
-			// Elasticsearch
-			log.Infof("Starting updating ES nodes list on cluster %s", es.clusterName)
-			updatedList, err := common.DiscoverNodesForService(es.consulClient, es.clusterConfig.Name)
-			if err != nil {
-				log.Error("Unable to update ES nodes, using last known state:", err)
-				common.ErrorsCount.Inc()
-				continue
-			}
+func (es *EsProbe) Start(ctx context.Context) error {
+	es.scheduler.run(ctx)
+
+	log.Infof("Terminating es probe on %s", es.clusterName)
+	es.scheduler.clean()
+	es.heartbeat.clean()
+	nodes, allEverKnownNodes := es.nodes()
+	es.metrics.CleanNodeMetrics("elasticsearch", nodes, allEverKnownNodes)
+	es.metrics.CleanClusterMetrics(es.clusterName, []string{es.config.ElasticsearchDurabilityIndex, es.config.ElasticsearchLatencyIndex})
+	es.metrics.CleanTransportMetrics("elasticsearch", es.clusterName, []string{es.endpoint})
+	es.transports.Close("elasticsearch", es.clusterName)
+	return nil
+}
 
-			log.Infof("Updating ES nodes list on cluster %s", es.clusterName)
-			es.allEverKnownEsNodes = common.UpdateEverKnownNodes(es.allEverKnownEsNodes, updatedList)
-			es.esNodesList = updatedList
-
-		case <-es.executeClusterDurabilityProbingTicker.C:
-			sem := new(sync.WaitGroup)
-			log.Infof("Starting probing durability for cluster %s", es.clusterName)
-			// Send index state green=> 0, yellow=>...
-			sem.Add(1)
-			// Check index status
-			go func() {
-				defer sem.Done()
-				if err := es.setIndexStatus(es.config.ElasticsearchDurabilityIndex); err != nil {
-					log.Error(err)
-					common.ClusterErrorsCount.WithLabelValues(es.clusterName).Add(1)
-				}
-			}()
-			// Durability check
-			// TODO read documents and compare to expected values
-			sem.Add(1)
-			go func() {
-				defer sem.Done()
-				number_of_current_durability_documents, durationMilliSec, err := es.countNumberOfDurabilityDocs(es.config.ElasticsearchDurabilityIndex)
-				if err != nil {
-					common.ClusterErrorsCount.WithLabelValues(es.clusterName).Add(1)
-					log.Error(err)
-				}
-				common.ClusterLatencySummary.WithLabelValues(es.clusterName, es.config.ElasticsearchDurabilityIndex, "count").Observe(durationMilliSec)
-				common.ClusterLatencyHistogram.WithLabelValues(es.clusterName, es.config.ElasticsearchDurabilityIndex, "count").Observe(durationMilliSec)
-				common.ClusterDurabilityDocumentsCount.WithLabelValues(es.clusterName).Set(number_of_current_durability_documents)
-
-				if err := es.searchDurabilityDocuments(); err != nil {
-					common.ClusterErrorsCount.WithLabelValues(es.clusterName).Add(1)
-					log.Error(err)
-				}
-			}()
-			sem.Wait()
-		case <-es.executeClusterLatencyProbingTicker.C:
-			sem := new(sync.WaitGroup)
-			log.Debugf("Starting probing latency cluster %s", es.clusterName)
-			// Send index state green=> 0, yellow=>...
-			sem.Add(1)
-			// Check index status
-			go func() {
-				defer sem.Done()
-				if err := es.setIndexStatus(es.config.ElasticsearchLatencyIndex); err != nil {
-					log.Error(err)
-					common.ClusterErrorsCount.WithLabelValues(es.clusterName).Add(1)
-				}
-			}()
-			// TODO later search check -> move it to a special tick to do it more often
-			// Ingestion/Get/Delete latency
-			sem.Add(1)
-			go func() {
-				defer sem.Done()
-				// Set event
-				uuid := uuid.New()
-				documentID := fmt.Sprintf("search-document-%s", uuid)
-				esDoc := &EsDocument{
-					Name:     documentID,
-					Counter:  1,
-					EventTye: "search",
-					Team:     "nosql",
-					Data:     DATA_ES_DOC,
-				}
-				durationMilliSec, err := es.indexDocument(es.config.ElasticsearchLatencyIndex, documentID, esDoc)
-				if err != nil {
-					common.ClusterErrorsCount.WithLabelValues(es.clusterName).Add(1)
-					log.Error(err)
-				}
-				common.ClusterLatencySummary.WithLabelValues(es.clusterName, es.config.ElasticsearchLatencyIndex, "index").Observe(durationMilliSec)
-				common.ClusterLatencyHistogram.WithLabelValues(es.clusterName, es.config.ElasticsearchLatencyIndex, "index").Observe(durationMilliSec)
-
-				// Get event
-				if err := es.getDocument(es.config.ElasticsearchLatencyIndex, documentID); err != nil {
-					common.ClusterErrorsCount.WithLabelValues(es.clusterName).Add(1)
-					log.Error(err)
-				}
-
-				// Delete event
-				if err := es.deleteDocument(es.config.ElasticsearchLatencyIndex, documentID); err != nil {
-					common.ClusterErrorsCount.WithLabelValues(es.clusterName).Add(1)
-					log.Error(err)
-				}
-			}()
-			sem.Wait()
-		case <-es.executeNodeProbingTicker.C:
-			sem := new(sync.WaitGroup)
-			log.Infof("Starting probing ES nodes for cluster %s", es.clusterName)
-			for _, node := range es.esNodesList {
-				sem.Add(1)
-				go func(esNode common.Node) {
-					defer sem.Done()
-					if err := probeElasticsearchNode(&esNode, es.timeout, es.config.ElasticsearchUser, es.config.ElasticsearchPassword); err != nil {
-						common.ElasticNodeAvailabilityGauge.WithLabelValues(esNode.Cluster, esNode.Name).Set(0)
-						common.ClusterErrorsCount.WithLabelValues(es.clusterName).Add(1)
-						log.Error(err)
-					}
-				}(node)
-			}
-			sem.Wait()
-		case <-es.executeRestoreProbingTicker.C:
-			if !es.config.ElasticsearchRestore || strings.HasPrefix(es.clusterConfig.Version, "6") {
-				continue
-			}
-			sem := new(sync.WaitGroup)
-			log.Infof("Starting probing ES restore for cluster %s", es.clusterName)
-
-			sem.Add(1)
-			go func() {
-				defer sem.Done()
-				// Check snapshot policy exist and get last success snapshot
-				snapshotName, policyExist, err := es.getLatestSuccessSnapshot()
-				if err != nil {
-					log.Error(err)
-					common.ClusterRestoreErrorsCount.WithLabelValues(es.clusterName).Add(1)
-					return
-				}
-				// Do nothing if policy doesn't exist. It means that the ES cluster doesn't use snapshot feature
-				if !policyExist {
-					log.Debugf("Policy %s doesn't exist on cluster %s", es.config.ElasticsearchRestoreSnapshotPolicy, es.clusterName)
-					return
-				}
-				// Restore the durability index
-				common.ClusterRestoreCount.WithLabelValues(es.clusterName).Add(1)
-				if err := es.restoreDurabilityIndex(snapshotName); err != nil {
-					log.Error(err)
-					common.ClusterRestoreErrorsCount.WithLabelValues(es.clusterName).Add(1)
-					return
-				}
-				// Count number of documents on the restored index
-				numberOfCurrentDocuments, _, err := es.countNumberOfDurabilityDocs(INDEX_RESTORE)
-				if err != nil {
-					log.Error(err)
-					common.ClusterRestoreErrorsCount.WithLabelValues(es.clusterName).Add(1)
-					return
-				}
-				common.ClusterRestoreDocumentsCount.WithLabelValues(es.clusterName).Set(numberOfCurrentDocuments)
-
-			}()
-			sem.Wait()
+// updateNodes refreshes the nodes of the cluster from consul
+func (es *EsProbe) updateNodes(ctx context.Context) error {
+	// Elasticsearch
+	log.Infof("Starting updating ES nodes list on cluster %s", es.clusterName)
+	updatedList, err := common.DiscoverNodesForService(es.consulClient, es.clusterConfig.Name)
+	if err != nil {
+		log.Error("Unable to update ES nodes, using last known state:", err)
+		es.metrics.ErrorsCount.Inc()
+		return err
+	}
+
+	log.Infof("Updating ES nodes list on cluster %s", es.clusterName)
+	es.mu.Lock()
+	es.allEverKnownEsNodes = common.UpdateEverKnownNodes(es.allEverKnownEsNodes, updatedList)
+	es.esNodesList = updatedList
+	es.mu.Unlock()
+	es.heartbeat.setNodes(updatedList)
+	return nil
+}
+
+// cleanMetrics removes the metrics of vanished nodes
+func (es *EsProbe) cleanMetrics(ctx context.Context) error {
+	//TODO move this to the update node and only remove the node deleted
+	log.Infof("Cleaning Prometheus metrics for unreferenced nodes for cluster %s", es.clusterName)
+	nodes, allEverKnownNodes := es.nodes()
+	es.metrics.CleanNodeMetrics("elasticsearch", nodes, allEverKnownNodes)
+	es.transports.Retain("elasticsearch", es.clusterName, nodeNames(nodes))
+	return nil
+}
+
+// probeDurability checks the durability index status and documents
+func (es *EsProbe) probeDurability(ctx context.Context) error {
+	sem := new(probeGroup)
+	log.Infof("Starting probing durability for cluster %s", es.clusterName)
+	// Send index state green=> 0, yellow=>...
+	// Check index status
+	sem.Go(func() {
+		if _, err := es.setIndexStatus(ctx, es.config.ElasticsearchDurabilityIndex); err != nil {
+			log.Error(err)
+			es.metrics.ClusterErrorsCount.WithLabelValues(es.clusterName).Add(1)
+			sem.fail(err)
 		}
+	})
+	// Durability check
+	// TODO read documents and compare to expected values
+	sem.Go(func() {
+		number_of_current_durability_documents, durationMilliSec, err := es.countNumberOfDurabilityDocs(ctx, es.config.ElasticsearchDurabilityIndex)
+		if err != nil {
+			es.metrics.ClusterErrorsCount.WithLabelValues(es.clusterName).Add(1)
+			log.Error(err)
+			sem.fail(err)
+		}
+		es.metrics.ClusterLatencySummary.WithLabelValues(es.clusterName, es.config.ElasticsearchDurabilityIndex, "count").Observe(durationMilliSec)
+		es.metrics.ClusterLatencyHistogram.WithLabelValues(es.clusterName, es.config.ElasticsearchDurabilityIndex, "count").Observe(durationMilliSec)
+		es.metrics.ClusterDurabilityDocumentsCount.WithLabelValues(es.clusterName).Set(number_of_current_durability_documents)
+
+		if err := es.searchDurabilityDocuments(ctx); err != nil {
+			es.metrics.ClusterErrorsCount.WithLabelValues(es.clusterName).Add(1)
+			log.Error(err)
+			sem.fail(err)
+		}
+	})
+	return sem.Wait()
+}
+
+// probeLatency measures the latency of indexing, getting and deleting a document
+func (es *EsProbe) probeLatency(ctx context.Context) error {
+	es.latencyIndexMu.RLock()
+	defer es.latencyIndexMu.RUnlock()
+	sem := new(probeGroup)
+	log.Debugf("Starting probing latency cluster %s", es.clusterName)
+	// Send index state green=> 0, yellow=>...
+	// Check index status
+	sem.Go(func() {
+		if _, err := es.setIndexStatus(ctx, es.config.ElasticsearchLatencyIndex); err != nil {
+			log.Error(err)
+			es.metrics.ClusterErrorsCount.WithLabelValues(es.clusterName).Add(1)
+			sem.fail(err)
+		}
+	})
+	// TODO later search check -> move it to a special tick to do it more often
+	// Ingestion/Get/Delete latency
+	sem.Go(func() {
+		// Set event
+		uuid := uuid.New()
+		documentID := fmt.Sprintf("search-document-%s", uuid)
+		esDoc := &EsDocument{
+			Name:     documentID,
+			Counter:  1,
+			EventTye: "search",
+			Team:     "nosql",
+			Data:     DATA_ES_DOC,
+		}
+		durationMilliSec, err := es.indexDocument(ctx, es.config.ElasticsearchLatencyIndex, documentID, esDoc)
+		if err != nil {
+			es.metrics.ClusterErrorsCount.WithLabelValues(es.clusterName).Add(1)
+			log.Error(err)
+			sem.fail(err)
+		}
+		es.metrics.ClusterLatencySummary.WithLabelValues(es.clusterName, es.config.ElasticsearchLatencyIndex, "index").Observe(durationMilliSec)
+		es.metrics.ClusterLatencyHistogram.WithLabelValues(es.clusterName, es.config.ElasticsearchLatencyIndex, "index").Observe(durationMilliSec)
+
+		// Get event
+		if err := es.getDocument(ctx, es.config.ElasticsearchLatencyIndex, documentID); err != nil {
+			es.metrics.ClusterErrorsCount.WithLabelValues(es.clusterName).Add(1)
+			log.Error(err)
+			sem.fail(err)
+		}
+
+		// Delete event
+		if err := es.deleteDocument(ctx, es.config.ElasticsearchLatencyIndex, documentID); err != nil {
+			es.metrics.ClusterErrorsCount.WithLabelValues(es.clusterName).Add(1)
+			log.Error(err)
+			sem.fail(err)
+		}
+	})
+	return sem.Wait()
+}
+
+// probeNodes checks the availability of every node
+func (es *EsProbe) probeNodes(ctx context.Context) error {
+	sem := new(probeGroup)
+	log.Infof("Starting probing ES nodes for cluster %s", es.clusterName)
+	creds, err := es.credentials.Credentials(es.clusterName)
+	if err != nil {
+		es.metrics.ClusterErrorsCount.WithLabelValues(es.clusterName).Add(1)
+		log.Error(err)
+		return err
+	}
+	nodes, _ := es.nodes()
+	for _, node := range nodes {
+		esNode := node
+		sem.Go(func() {
+			if err := es.probeElasticsearchNode(ctx, &esNode, creds); err != nil {
+				es.metrics.ElasticNodeAvailabilityGauge.WithLabelValues(esNode.Cluster, esNode.Name).Set(0)
+				es.metrics.ClusterErrorsCount.WithLabelValues(es.clusterName).Add(1)
+				log.Error(err)
+				sem.fail(err)
+			}
+		})
 	}
+	return sem.Wait()
 }
 
-func (es *EsProbe) getLatestSuccessSnapshot() (string, bool, error) {
+// probeRestore restores the durability index from the last snapshot and counts its documents
+func (es *EsProbe) probeRestore(ctx context.Context) error {
+	if !es.config.ElasticsearchRestore || strings.HasPrefix(es.clusterConfig.Version, "6") {
+		return nil
+	}
+	sem := new(probeGroup)
+	log.Infof("Starting probing ES restore for cluster %s", es.clusterName)
+
+	sem.Go(func() {
+		// Check snapshot policy exist and get last success snapshot
+		snapshotName, policyExist, err := es.getLatestSuccessSnapshot(ctx)
+		if err != nil {
+			log.Error(err)
+			es.metrics.ClusterRestoreErrorsCount.WithLabelValues(es.clusterName).Add(1)
+			sem.fail(err)
+			return
+		}
+		// Do nothing if policy doesn't exist. It means that the ES cluster doesn't use snapshot feature
+		if !policyExist {
+			log.Debugf("Policy %s doesn't exist on cluster %s", es.config.ElasticsearchRestoreSnapshotPolicy, es.clusterName)
+			return
+		}
+		// Restore the durability index
+		es.metrics.ClusterRestoreCount.WithLabelValues(es.clusterName).Add(1)
+		if err := es.restoreDurabilityIndex(ctx, snapshotName); err != nil {
+			log.Error(err)
+			es.metrics.ClusterRestoreErrorsCount.WithLabelValues(es.clusterName).Add(1)
+			sem.fail(err)
+			return
+		}
+		// Count number of documents on the restored index
+		numberOfCurrentDocuments, _, err := es.countNumberOfDurabilityDocs(ctx, INDEX_RESTORE)
+		if err != nil {
+			log.Error(err)
+			es.metrics.ClusterRestoreErrorsCount.WithLabelValues(es.clusterName).Add(1)
+			sem.fail(err)
+			return
+		}
+		es.metrics.ClusterRestoreDocumentsCount.WithLabelValues(es.clusterName).Set(numberOfCurrentDocuments)
+
+	})
+	return sem.Wait()
+}
+
+func (es *EsProbe) getLatestSuccessSnapshot(ctx context.Context) (string, bool, error) {
 	var r map[string]interface{}
 
 	res, err := es.client.SlmGetLifecycle(
+		es.client.SlmGetLifecycle.WithContext(ctx),
 		es.client.SlmGetLifecycle.WithPolicyID(es.config.ElasticsearchRestoreSnapshotPolicy))
 	if err != nil {
 		return "", false, err
@@ -335,9 +489,9 @@ func (es *EsProbe) getLatestSuccessSnapshot() (string, bool, error) {
 	return snapshot_name, true, nil
 }
 
-func (es *EsProbe) restoreDurabilityIndex(snapshotName string) error {
+func (es *EsProbe) restoreDurabilityIndex(ctx context.Context, snapshotName string) error {
 	// Delete index restore to be able to restore it from snapshot
-	es.deleteIndex(INDEX_RESTORE)
+	es.deleteIndex(ctx, INDEX_RESTORE)
 	// Restore index
 	var buf bytes.Buffer
 	restore := map[string]interface{}{
@@ -354,6 +508,7 @@ func (es *EsProbe) restoreDurabilityIndex(snapshotName string) error {
 	res, err := es.client.Snapshot.Restore(
 		es.config.ElasticsearchRestoreSnapshotRepository,
 		snapshotName,
+		es.client.Snapshot.Restore.WithContext(ctx),
 		es.client.Snapshot.Restore.WithBody(&buf),
 		es.client.Snapshot.Restore.WithWaitForCompletion(true),
 	)
@@ -369,27 +524,34 @@ func (es *EsProbe) restoreDurabilityIndex(snapshotName string) error {
 	return nil
 }
 
-func probeElasticsearchNode(node *common.Node, timeout time.Duration, username, password string) error {
-	http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
-	client := &http.Client{
-		Timeout: timeout,
+func (es *EsProbe) probeElasticsearchNode(ctx context.Context, node *common.Node, creds common.Credentials) error {
+	client, err := es.transports.Client("elasticsearch", es.clusterName, node.Name)
+	if err != nil {
+		return err
 	}
+	ctx, cancel := context.WithTimeout(ctx, es.scheduler.requestTimeout())
+	defer cancel()
 
 	probingURL := fmt.Sprintf("%v://%v:%v/_cat/health?v", node.Scheme, node.Ip, node.Port)
 	log.Debug("Start probing ", node.Name)
 
 	start := time.Now()
-	req, err := http.NewRequest("GET", probingURL, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", probingURL, nil)
 	if err != nil {
 		return err
 	}
-	req.SetBasicAuth(username, password)
+	if err := creds.Apply(req); err != nil {
+		return err
+	}
 	resp, err := client.Do(req)
 	if err != nil {
 		log.Debug("Probing failed for ", node.Name, ": ", probingURL, " ", err.Error())
 		return err
 	}
+	defer resp.Body.Close()
 	durationMilliSec := float64(time.Since(start).Milliseconds())
+	// Drain the body so the connection goes back to the pool
+	io.Copy(ioutil.Discard, resp.Body)
 
 	log.Debug("Probe result for ", node.Name, ": ", resp.Status)
 	if resp.StatusCode != 200 {
@@ -397,25 +559,28 @@ func probeElasticsearchNode(node *common.Node, timeout time.Duration, username,
 		return fmt.Errorf("ES Probing failed")
 	}
 
-	common.ElasticNodeAvailabilityGauge.WithLabelValues(node.Cluster, node.Name).Set(1)
-	common.NodeCatLatencySummary.WithLabelValues(node.Cluster, node.Name).Observe(durationMilliSec)
+	es.metrics.ElasticNodeAvailabilityGauge.WithLabelValues(node.Cluster, node.Name).Set(1)
+	es.metrics.NodeCatLatencySummary.WithLabelValues(node.Cluster, node.Name).Observe(durationMilliSec)
 
 	return nil
 }
 
-func initEsClient(scheme, endpoint, username, passsword string) (*elasticsearch7.Client, error) {
-	http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+func initEsClient(scheme, endpoint, clusterName string, credentials common.CredentialsProvider, transports *common.Transports) (*elasticsearch7.Client, error) {
+	httpClient, err := transports.Client("elasticsearch", clusterName, "")
+	if err != nil {
+		return nil, err
+	}
 
 	cfg := elasticsearch7.Config{
 		Addresses: []string{
 			fmt.Sprintf("%v://%v", scheme, endpoint),
 		},
-		Username: username,
-		Password: passsword,
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: true,
-			},
+		// Credentials are set by the transport on every request so rotated secrets are used
+		// without recreating the client
+		Transport: &common.AuthTransport{
+			Next:        httpClient.Transport,
+			Credentials: credentials,
+			Cluster:     clusterName,
 		},
 	}
 	es, err := elasticsearch7.NewClient(cfg)
@@ -426,11 +591,12 @@ func initEsClient(scheme, endpoint, username, passsword string) (*elasticsearch7
 	return es, nil
 }
 
-func (es *EsProbe) deleteDocument(index, documentID string) error {
+func (es *EsProbe) deleteDocument(ctx context.Context, index, documentID string) error {
 	start := time.Now()
 	res, err := es.client.Delete(
 		index,
-		documentID)
+		documentID,
+		es.client.Delete.WithContext(ctx))
 	durationMilliSec := float64(time.Since(start).Milliseconds())
 
 	if err != nil {
@@ -442,17 +608,18 @@ func (es *EsProbe) deleteDocument(index, documentID string) error {
 		return errors.Errorf("Error delete document %s on %s:%s: %s", documentID, es.clusterName, index, res.String())
 	}
 
-	common.ClusterLatencySummary.WithLabelValues(es.clusterName, index, "delete").Observe(durationMilliSec)
-	common.ClusterLatencyHistogram.WithLabelValues(es.clusterName, index, "delete").Observe(durationMilliSec)
+	es.metrics.ClusterLatencySummary.WithLabelValues(es.clusterName, index, "delete").Observe(durationMilliSec)
+	es.metrics.ClusterLatencyHistogram.WithLabelValues(es.clusterName, index, "delete").Observe(durationMilliSec)
 
 	return nil
 }
 
-func (es *EsProbe) getDocument(index, documentID string) error {
+func (es *EsProbe) getDocument(ctx context.Context, index, documentID string) error {
 	start := time.Now()
 	res, err := es.client.Get(
 		index,
-		documentID)
+		documentID,
+		es.client.Get.WithContext(ctx))
 	durationMilliSec := float64(time.Since(start).Milliseconds())
 
 	if err != nil {
@@ -464,16 +631,17 @@ func (es *EsProbe) getDocument(index, documentID string) error {
 		return errors.Errorf("Error get document %s on %s:%s: %s", documentID, es.clusterName, index, res.String())
 	}
 
-	common.ClusterLatencySummary.WithLabelValues(es.clusterName, index, "get").Observe(durationMilliSec)
-	common.ClusterLatencyHistogram.WithLabelValues(es.clusterName, index, "get").Observe(durationMilliSec)
+	es.metrics.ClusterLatencySummary.WithLabelValues(es.clusterName, index, "get").Observe(durationMilliSec)
+	es.metrics.ClusterLatencyHistogram.WithLabelValues(es.clusterName, index, "get").Observe(durationMilliSec)
 
 	return nil
 }
 
-func (es *EsProbe) countNumberOfDurabilityDocs(index string) (float64, float64, error) {
+func (es *EsProbe) countNumberOfDurabilityDocs(ctx context.Context, index string) (float64, float64, error) {
 	var r map[string]interface{}
 	start := time.Now()
 	res, err := es.client.Count(
+		es.client.Count.WithContext(ctx),
 		es.client.Count.WithIndex(index),
 	)
 	durationMilliSec := float64(time.Since(start).Milliseconds())
@@ -498,7 +666,7 @@ func (es *EsProbe) countNumberOfDurabilityDocs(index string) (float64, float64,
 	return number_of_current_durability_documents, durationMilliSec, nil
 }
 
-func (es *EsProbe) fillDurabilityBucketWithMissingDocs(number_of_current_durability_documents float64) error {
+func (es *EsProbe) fillDurabilityBucketWithMissingDocs(ctx context.Context, number_of_current_durability_documents float64) error {
 	// TODO improve this stage to be faster (bulk?)
 	if int(number_of_current_durability_documents) < es.config.ElasticsearchNumberOfDurabilityDocuments+1 {
 		esDoc := &EsDocument{
@@ -511,7 +679,7 @@ func (es *EsProbe) fillDurabilityBucketWithMissingDocs(number_of_current_durabil
 			esDoc.Name = fmt.Sprintf("document-%d", i)
 			esDoc.Counter = i
 
-			if _, err := es.indexDocument(es.config.ElasticsearchDurabilityIndex, strconv.Itoa(i), esDoc); err != nil {
+			if _, err := es.indexDocument(ctx, es.config.ElasticsearchDurabilityIndex, strconv.Itoa(i), esDoc); err != nil {
 				return err
 			}
 		}
@@ -519,7 +687,7 @@ func (es *EsProbe) fillDurabilityBucketWithMissingDocs(number_of_current_durabil
 	return nil
 }
 
-func (es *EsProbe) indexDocument(index, documentID string, esDoc *EsDocument) (float64, error) {
+func (es *EsProbe) indexDocument(ctx context.Context, index, documentID string, esDoc *EsDocument) (float64, error) {
 	jsonDoc, err := json.Marshal(esDoc)
 	if err != nil {
 		return 0, errors.Wrapf(err, "Failed to create json document in %s:%s", es.clusterName, index)
@@ -529,12 +697,13 @@ func (es *EsProbe) indexDocument(index, documentID string, esDoc *EsDocument) (f
 	res, err := es.client.Index(
 		index,
 		bytes.NewReader(jsonDoc),
+		es.client.Index.WithContext(ctx),
 		es.client.Index.WithDocumentID(documentID),
 	)
 	durationMilliSec := float64(time.Since(start).Milliseconds())
 
 	if err != nil {
-		return 0, errors.Wrapf(err, "Failed to index document in %s:%s %d", es.clusterName, index)
+		return 0, errors.Wrapf(err, "Failed to index document %s in %s:%s", documentID, es.clusterName, index)
 	}
 	defer res.Body.Close()
 
@@ -544,8 +713,8 @@ func (es *EsProbe) indexDocument(index, documentID string, esDoc *EsDocument) (f
 	return durationMilliSec, nil
 }
 
-func (es *EsProbe) indexExist(index string) (bool, error) {
-	res, err := es.client.Indices.Exists([]string{index})
+func (es *EsProbe) indexExist(ctx context.Context, index string) (bool, error) {
+	res, err := es.client.Indices.Exists([]string{index}, es.client.Indices.Exists.WithContext(ctx))
 	if err != nil {
 		return false, errors.Wrapf(err, "Failed to check if index %s exist", index)
 	}
@@ -559,32 +728,41 @@ func (es *EsProbe) indexExist(index string) (bool, error) {
 	return true, nil
 }
 
-func (es *EsProbe) deleteIndex(index string) error {
-	indexExist, err := es.indexExist(index)
+func (es *EsProbe) deleteIndex(ctx context.Context, index string) error {
+	indexExist, err := es.indexExist(ctx, index)
 	if err != nil {
 		return err
 	}
 	if indexExist {
-		res, err := es.client.Indices.Delete([]string{index})
+		res, err := es.client.Indices.Delete([]string{index}, es.client.Indices.Delete.WithContext(ctx))
 		if err != nil {
 			return errors.Wrapf(err, "Failed to delete index %s", index)
 		}
 		defer res.Body.Close()
 
 		if res.IsError() {
-			return errors.Errorf("Index creation for %s response error: %s", index, res.String())
+			return errors.Errorf("Index deletion for %s response error: %s", index, res.String())
 		}
 	}
 	return nil
 }
 
-func (es *EsProbe) createMissingIndex(index string) error {
-	indexExist, err := es.indexExist(index)
+func (es *EsProbe) createMissingIndex(ctx context.Context, index string) error {
+	indexExist, err := es.indexExist(ctx, index)
 	if err != nil {
 		return err
 	}
 	if !indexExist {
-		res, err := es.client.Indices.Create(index)
+		// Explicit settings and mappings take precedence over the templates of the cluster
+		settings, err := es.indexSettings(ctx)
+		if err != nil {
+			return err
+		}
+		var buf bytes.Buffer
+		if err := json.NewEncoder(&buf).Encode(map[string]interface{}{"settings": settings, "mappings": es.indexMappings()}); err != nil {
+			return errors.Wrapf(err, "Failed to encode the mappings of index %s", index)
+		}
+		res, err := es.client.Indices.Create(index, es.client.Indices.Create.WithContext(ctx), es.client.Indices.Create.WithBody(&buf))
 		if err != nil {
 			return errors.Wrapf(err, "Failed to create index %s", index)
 		}
@@ -597,7 +775,7 @@ func (es *EsProbe) createMissingIndex(index string) error {
 	return nil
 }
 
-func (es *EsProbe) searchDurabilityDocuments() error {
+func (es *EsProbe) searchDurabilityDocuments(ctx context.Context) error {
 	var buf bytes.Buffer
 	query := map[string]interface{}{
 		"query": map[string]interface{}{
@@ -615,6 +793,7 @@ func (es *EsProbe) searchDurabilityDocuments() error {
 
 	start := time.Now()
 	res, err := es.client.Search(
+		es.client.Search.WithContext(ctx),
 		es.client.Search.WithIndex(es.config.ElasticsearchDurabilityIndex),
 		es.client.Search.WithBody(&buf),
 		es.client.Search.WithTrackTotalHits(true),
@@ -644,56 +823,58 @@ func (es *EsProbe) searchDurabilityDocuments() error {
 	if strings.HasPrefix(es.clusterConfig.Version, "6") {
 		total, ok = indices["total"].(float64)
 		if !ok {
-			return errors.Errorf("Durability search response doesn't contains hits.total field for %s on cluster %s", es.clusterName)
+			return errors.Errorf("Durability search response doesn't contains hits.total field for %s on cluster %s", es.config.ElasticsearchDurabilityIndex, es.clusterName)
 		}
 	} else {
 		intermediate_total, ok := indices["total"].(map[string]interface{})
 		if !ok {
-			return errors.Errorf("Durability search response doesn't contains hits.total field for %s on cluster %s", es.clusterName)
+			return errors.Errorf("Durability search response doesn't contains hits.total field for %s on cluster %s", es.config.ElasticsearchDurabilityIndex, es.clusterName)
 		}
 		total, ok = intermediate_total["value"].(float64)
 		if !ok {
-			return errors.Errorf("Durability search response doesn't contains hits.total field for %s on cluster %s", es.clusterName)
+			return errors.Errorf("Durability search response doesn't contains hits.total field for %s on cluster %s", es.config.ElasticsearchDurabilityIndex, es.clusterName)
 		}
 	}
 
-	common.ClusterLatencySummary.WithLabelValues(es.clusterName, es.config.ElasticsearchDurabilityIndex, "search").Observe(durationMilliSec)
-	common.ClusterLatencyHistogram.WithLabelValues(es.clusterName, es.config.ElasticsearchDurabilityIndex, "search").Observe(durationMilliSec)
+	es.metrics.ClusterLatencySummary.WithLabelValues(es.clusterName, es.config.ElasticsearchDurabilityIndex, "search").Observe(durationMilliSec)
+	es.metrics.ClusterLatencyHistogram.WithLabelValues(es.clusterName, es.config.ElasticsearchDurabilityIndex, "search").Observe(durationMilliSec)
 
-	common.ClusterDurabilitySearchDocumentsHits.WithLabelValues(es.clusterName, es.config.ElasticsearchDurabilityIndex).Set(total)
+	es.metrics.ClusterDurabilitySearchDocumentsHits.WithLabelValues(es.clusterName, es.config.ElasticsearchDurabilityIndex).Set(total)
 	return nil
 }
 
-func (es *EsProbe) setIndexStatus(index string) error {
+// setIndexStatus exports the health status of an index and returns it
+func (es *EsProbe) setIndexStatus(ctx context.Context, index string) (string, error) {
 	var r map[string]interface{}
 	res, err := es.client.Cluster.Health(
+		es.client.Cluster.Health.WithContext(ctx),
 		es.client.Cluster.Health.WithIndex(index),
 		es.client.Cluster.Health.WithLevel("indices"),
 	)
 	if err != nil {
-		return err
+		return "", err
 	}
 	defer res.Body.Close()
 
 	if res.IsError() {
-		return errors.Errorf("Error checking index %s on cluster %s status: %s", index, es.clusterName, res.String())
+		return "", errors.Errorf("Error checking index %s on cluster %s status: %s", index, es.clusterName, res.String())
 	}
 
 	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
-		return errors.Wrapf(err, "Error reading index status response for %s on cluster %s", index, es.clusterName)
+		return "", errors.Wrapf(err, "Error reading index status response for %s on cluster %s", index, es.clusterName)
 	}
 
 	indices, ok := r["indices"].(map[string]interface{})
 	if !ok {
-		return errors.Errorf("Index status response doesn't contains indices field for %s on cluster %s", index, es.clusterName)
+		return "", errors.Errorf("Index status response doesn't contains indices field for %s on cluster %s", index, es.clusterName)
 	}
 	index_map, ok := indices[index].(map[string]interface{})
 	if !ok {
-		return errors.Errorf("Index status response doesn't contains indices.%s field on cluster %s", index, es.clusterName)
+		return "", errors.Errorf("Index status response doesn't contains indices.%s field on cluster %s", index, es.clusterName)
 	}
-	index_status, ok := index_map["status"]
+	index_status, ok := index_map["status"].(string)
 	if !ok {
-		return errors.Errorf("Index status response doesn't contains indices.%s.status field on cluster %s", index, es.clusterName)
+		return "", errors.Errorf("Index status response doesn't contains indices.%s.status field on cluster %s", index, es.clusterName)
 	}
 	var indexStatusCode float64
 	switch index_status {
@@ -704,6 +885,23 @@ func (es *EsProbe) setIndexStatus(index string) error {
 	default:
 		indexStatusCode = 2
 	}
-	common.IndexProbeStatus.WithLabelValues(es.clusterName, index).Set(indexStatusCode)
-	return nil
+	es.metrics.IndexProbeStatus.WithLabelValues(es.clusterName, index).Set(indexStatusCode)
+	return index_status, nil
+}
+
+func nodeNames(nodes []common.Node) []string {
+	var names []string
+	for _, node := range nodes {
+		names = append(names, node.Name)
+	}
+	return names
+}
+
+func stringInSlice(a string, list []string) bool {
+	for _, b := range list {
+		if b == a {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,210 @@
+// GNU General Public License version 3
+
+package probe
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/criteo-forks/espoke/common"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+// Check runs the node, durability, latency and, when enabled, restore probes once
+func (es *EsProbe) Check(ctx context.Context, options CheckOptions) []StepResult {
+	var steps checkSteps
+	selected := func(probe string) bool {
+		if len(options.Probes) == 0 {
+			return probe != CheckRestore || es.config.ElasticsearchRestore
+		}
+		return stringInSlice(probe, options.Probes)
+	}
+
+	if options.Prepare && !steps.run("prepare", func(*StepResult) error { return es.Prepare(ctx) }) {
+		return steps
+	}
+	if selected(CheckNodes) {
+		es.checkNodes(ctx, &steps)
+	}
+	if selected(CheckDurability) {
+		es.checkDurability(ctx, &steps)
+	}
+	if selected(CheckLatency) {
+		es.checkLatency(ctx, &steps)
+	}
+	if selected(CheckRestore) && !strings.HasPrefix(es.clusterConfig.Version, "6") {
+		es.checkRestore(ctx, &steps)
+	}
+	return steps
+}
+
+func (es *EsProbe) checkNodes(ctx context.Context, steps *checkSteps) {
+	creds, err := es.credentials.Credentials(es.clusterName)
+	if err != nil {
+		steps.run("credentials", func(*StepResult) error { return err })
+		return
+	}
+	nodes, _ := es.nodes()
+	for _, node := range nodes {
+		node := node
+		steps.run("node "+node.Name, func(result *StepResult) error {
+			result.Detail = fmt.Sprintf("%s:%d", node.Ip, node.Port)
+			return es.probeElasticsearchNode(ctx, &node, creds)
+		})
+	}
+}
+
+func (es *EsProbe) checkDurability(ctx context.Context, steps *checkSteps) {
+	index := es.config.ElasticsearchDurabilityIndex
+	steps.run("durability index status", func(result *StepResult) error { return es.checkIndexStatus(ctx, index, result) })
+	steps.run("durability count", func(result *StepResult) error { return es.checkDurabilityCount(ctx, index, result) })
+	steps.run("durability search", func(*StepResult) error { return es.searchDurabilityDocuments(ctx) })
+}
+
+func (es *EsProbe) checkLatency(ctx context.Context, steps *checkSteps) {
+	index := es.config.ElasticsearchLatencyIndex
+	steps.run("latency index status", func(result *StepResult) error { return es.checkIndexStatus(ctx, index, result) })
+	documentID := fmt.Sprintf("search-document-%s", uuid.New())
+	esDoc := &EsDocument{
+		Name:     documentID,
+		Counter:  1,
+		EventTye: "search",
+		Team:     "nosql",
+		Data:     DATA_ES_DOC,
+	}
+	indexed := steps.run("latency index", func(*StepResult) error {
+		_, err := es.indexDocument(ctx, index, documentID, esDoc)
+		return err
+	})
+	if indexed {
+		steps.run("latency get", func(*StepResult) error { return es.getDocument(ctx, index, documentID) })
+		steps.run("latency delete", func(*StepResult) error { return es.deleteDocument(ctx, index, documentID) })
+	}
+}
+
+func (es *EsProbe) checkRestore(ctx context.Context, steps *checkSteps) {
+	var snapshotName string
+	found := steps.run("restore snapshot", func(result *StepResult) error {
+		name, policyExist, err := es.getLatestSuccessSnapshot(ctx)
+		if err != nil {
+			return err
+		}
+		if !policyExist {
+			// As when serving, the cluster does not use snapshots
+			return stepWarning("snapshot policy " + es.config.ElasticsearchRestoreSnapshotPolicy + " does not exist")
+		}
+		snapshotName, result.Detail = name, name
+		return nil
+	})
+	if !found || snapshotName == "" {
+		return
+	}
+	if steps.run("restore", func(*StepResult) error { return es.restoreDurabilityIndex(ctx, snapshotName) }) {
+		steps.run("restore count", func(result *StepResult) error { return es.checkDurabilityCount(ctx, INDEX_RESTORE, result) })
+	}
+}
+
+// checkIndexStatus fails on red indices and warns on yellow ones, the value is the status code
+// exported by es_index_probe_status
+func (es *EsProbe) checkIndexStatus(ctx context.Context, index string, result *StepResult) error {
+	status, err := es.setIndexStatus(ctx, index)
+	if err != nil {
+		return err
+	}
+	code := 2.0
+	switch status {
+	case "green":
+		code = 0
+	case "yellow":
+		code = 1
+	}
+	result.Value = &code
+	result.Detail = status
+	switch status {
+	case "green":
+		return nil
+	case "yellow":
+		return stepWarning("index " + index + " is yellow")
+	default:
+		return errors.Errorf("index %s is %s", index, status)
+	}
+}
+
+// checkDurabilityCount counts the durability documents of an index and fails when some are missing
+func (es *EsProbe) checkDurabilityCount(ctx context.Context, index string, result *StepResult) error {
+	count, _, err := es.countNumberOfDurabilityDocs(ctx, index)
+	if err != nil {
+		return err
+	}
+	result.Value = &count
+	expected := es.config.ElasticsearchNumberOfDurabilityDocuments
+	if int(count) < expected {
+		return errors.Errorf("%d documents, %d expected", int(count), expected)
+	}
+	result.Detail = fmt.Sprintf("%d documents", int(count))
+	return nil
+}
+
+// discoverNodes lists the nodes of the cluster from their HTTP publish address
+func (es *EsProbe) discoverNodes(ctx context.Context) ([]common.Node, error) {
+	res, err := es.client.Nodes.Info(
+		es.client.Nodes.Info.WithContext(ctx),
+		es.client.Nodes.Info.WithMetric("http"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return nil, errors.Errorf("Error listing nodes of cluster %s: %s", es.clusterName, res.String())
+	}
+
+	var r struct {
+		Nodes map[string]struct {
+			Name string `json:"name"`
+			HTTP struct {
+				PublishAddress string `json:"publish_address"`
+			} `json:"http"`
+		} `json:"nodes"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return nil, errors.Wrapf(err, "Error parsing nodes of cluster %s", es.clusterName)
+	}
+
+	var nodes []common.Node
+	for _, info := range r.Nodes {
+		// The publish address is either ip:port or hostname/ip:port
+		name := info.Name
+		address := info.HTTP.PublishAddress
+		if i := strings.Index(address, "/"); i >= 0 {
+			if i > 0 {
+				name = address[:i]
+			}
+			address = address[i+1:]
+		}
+		host, portString, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid publish address of node %s", info.Name)
+		}
+		port, err := strconv.Atoi(portString)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid publish address of node %s", info.Name)
+		}
+		nodes = append(nodes, common.Node{
+			Name:    name,
+			Ip:      host,
+			Port:    port,
+			Cluster: es.clusterName,
+			Scheme:  es.clusterConfig.Scheme,
+		})
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Name < nodes[j].Name })
+	return nodes, nil
+}
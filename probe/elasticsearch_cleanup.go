@@ -0,0 +1,285 @@
+// GNU General Public License version 3
+
+package probe
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/elastic/go-elasticsearch/v7/esapi"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// latencyDocumentsQuery matches the search-document-* documents indexed by the latency probe,
+// which are left behind when their deletion fails
+var latencyDocumentsQuery = map[string]interface{}{
+	"query": map[string]interface{}{
+		"match": map[string]interface{}{"EventTye": "search"},
+	},
+}
+
+// Cleanup removes the durability, latency and restored indices, or only the documents left in
+// the latency index with DocumentsOnly. Indices without the espoke marker are skipped.
+func (es *EsProbe) Cleanup(ctx context.Context, options CleanupOptions) ([]Artifact, error) {
+	var artifacts []Artifact
+	seen := make(map[string]bool)
+	for _, index := range []string{es.config.ElasticsearchDurabilityIndex, es.config.ElasticsearchLatencyIndex, INDEX_RESTORE} {
+		if seen[index] {
+			continue
+		}
+		seen[index] = true
+
+		artifact, exist, err := es.indexArtifact(ctx, index)
+		if err != nil {
+			return artifacts, err
+		}
+		if !exist {
+			continue
+		}
+
+		if options.DocumentsOnly {
+			if index != es.config.ElasticsearchLatencyIndex {
+				continue
+			}
+			artifact.Type = "documents"
+			count, err := es.countLatencyDocuments(ctx, index)
+			if err != nil {
+				return artifacts, err
+			}
+			artifact.Documents = count
+		}
+
+		switch {
+		case !artifact.Managed:
+			artifact.Action = ArtifactSkipped
+			artifact.Detail = fmt.Sprintf("no _meta.managed_by %s marker, not created by espoke", MANAGED_BY)
+		case artifact.Documents == 0 && options.DocumentsOnly:
+			artifact.Action = ArtifactKept
+		case options.DryRun:
+			artifact.Action = ArtifactWouldDelete
+		case options.DocumentsOnly:
+			artifact.Action = ArtifactDeleted
+			deleted, err := es.deleteLatencyDocuments(ctx, index)
+			if err != nil {
+				artifact.Action, artifact.Detail = ArtifactFailed, err.Error()
+			} else {
+				artifact.Detail = fmt.Sprintf("%d documents deleted", deleted)
+			}
+		default:
+			artifact.Action = ArtifactDeleted
+			if err := es.deleteIndex(ctx, index); err != nil {
+				artifact.Action, artifact.Detail = ArtifactFailed, err.Error()
+			}
+		}
+		if artifact.Action == ArtifactDeleted {
+			log.Infof("Deleted %s %s on %s", artifact.Type, index, es.clusterName)
+		}
+		artifacts = append(artifacts, artifact)
+	}
+	return artifacts, nil
+}
+
+// indexArtifact describes an index, it returns false when the index does not exist
+func (es *EsProbe) indexArtifact(ctx context.Context, index string) (Artifact, bool, error) {
+	artifact := Artifact{Type: "index", Index: index}
+	exist, managed, err := es.indexMarker(ctx, index)
+	if err != nil || !exist {
+		return artifact, false, err
+	}
+	artifact.Managed = managed
+
+	count, _, err := es.countNumberOfDurabilityDocs(ctx, index)
+	if err != nil {
+		return artifact, false, err
+	}
+	artifact.Documents = int(count)
+	return artifact, true, nil
+}
+
+// indexMarker tells whether an index exists and carries the espoke marker. Aliases never carry
+// it, deleting them would delete the indices behind them.
+func (es *EsProbe) indexMarker(ctx context.Context, index string) (bool, bool, error) {
+	mappings, exist, err := es.currentIndexMapping(ctx, index)
+	if err != nil || !exist {
+		return false, false, err
+	}
+	return true, managedByEspoke(mappings), nil
+}
+
+// adoptIndex puts the espoke marker on an index created by an earlier version of espoke, which is
+// recognized by the fields of the probe documents in its mapping, when adopting indices is enabled.
+// It returns whether the index exists and carries the marker, as indexMarker.
+func (es *EsProbe) adoptIndex(ctx context.Context, index string) (bool, bool, error) {
+	mappings, exist, err := es.currentIndexMapping(ctx, index)
+	if err != nil || !exist {
+		return false, false, err
+	}
+	if managedByEspoke(mappings) {
+		return true, true, nil
+	}
+	if !es.config.ElasticsearchAdoptIndices {
+		return true, false, nil
+	}
+	documentType, ok := probeDocumentsType(mappings)
+	if !ok {
+		return true, false, nil
+	}
+
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(map[string]interface{}{"_meta": map[string]interface{}{"managed_by": MANAGED_BY}}); err != nil {
+		return true, false, errors.Wrapf(err, "Failed to encode the marker of index %s", index)
+	}
+	options := []func(*esapi.IndicesPutMappingRequest){
+		es.client.Indices.PutMapping.WithContext(ctx),
+		es.client.Indices.PutMapping.WithIndex(index),
+	}
+	if documentType != "" {
+		options = append(options, es.client.Indices.PutMapping.WithDocumentType(documentType))
+	}
+	res, err := es.client.Indices.PutMapping(&buf, options...)
+	if err != nil {
+		return true, false, errors.Wrapf(err, "Failed to put the marker on index %s", index)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return true, false, errors.Errorf("Error putting the marker on index %s on cluster %s: %s", index, es.clusterName, res.String())
+	}
+	log.Infof("Marked index %s on %s, created by an earlier version of espoke, as managed by espoke", index, es.clusterName)
+	return true, true, nil
+}
+
+// currentIndexMapping returns the mappings of an index and whether it exists. The mappings of an
+// alias are nil.
+func (es *EsProbe) currentIndexMapping(ctx context.Context, index string) (map[string]json.RawMessage, bool, error) {
+	res, err := es.client.Indices.GetMapping(
+		es.client.Indices.GetMapping.WithContext(ctx),
+		es.client.Indices.GetMapping.WithIndex(index),
+	)
+	if err != nil {
+		return nil, false, errors.Wrapf(err, "Failed to get mapping of index %s", index)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == 404 {
+		return nil, false, nil
+	} else if res.IsError() {
+		return nil, false, errors.Errorf("Error getting mapping of index %s on cluster %s: %s", index, es.clusterName, res.String())
+	}
+
+	var r map[string]struct {
+		Mappings map[string]json.RawMessage `json:"mappings"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return nil, false, errors.Wrapf(err, "Error parsing mapping of index %s", index)
+	}
+	return r[index].Mappings, true, nil
+}
+
+// managedByEspoke tells whether mappings carry the espoke marker, either at the root or, on
+// elasticsearch 6, under the document type
+func managedByEspoke(mappings map[string]json.RawMessage) bool {
+	if meta, ok := mappings["_meta"]; ok {
+		return isEspokeMarker(meta)
+	}
+	for _, typeMapping := range mappings {
+		var typed struct {
+			Meta json.RawMessage `json:"_meta"`
+		}
+		if json.Unmarshal(typeMapping, &typed) == nil && isEspokeMarker(typed.Meta) {
+			return true
+		}
+	}
+	return false
+}
+
+// probeDocumentsType tells whether mappings have the EventTye field of the probe documents, along
+// with their document type on elasticsearch 6
+func probeDocumentsType(mappings map[string]json.RawMessage) (string, bool) {
+	type typeMapping struct {
+		Properties map[string]json.RawMessage `json:"properties"`
+	}
+	if raw, ok := mappings["properties"]; ok {
+		var properties map[string]json.RawMessage
+		if json.Unmarshal(raw, &properties) != nil {
+			return "", false
+		}
+		_, ok := properties["EventTye"]
+		return "", ok
+	}
+	for documentType, raw := range mappings {
+		var typed typeMapping
+		if json.Unmarshal(raw, &typed) != nil {
+			continue
+		}
+		if _, ok := typed.Properties["EventTye"]; ok {
+			return documentType, true
+		}
+	}
+	return "", false
+}
+
+func isEspokeMarker(meta json.RawMessage) bool {
+	var marker struct {
+		ManagedBy string `json:"managed_by"`
+	}
+	return json.Unmarshal(meta, &marker) == nil && marker.ManagedBy == MANAGED_BY
+}
+
+func (es *EsProbe) countLatencyDocuments(ctx context.Context, index string) (int, error) {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(latencyDocumentsQuery); err != nil {
+		return 0, errors.Wrap(err, "Error encoding latency documents query")
+	}
+	res, err := es.client.Count(
+		es.client.Count.WithContext(ctx),
+		es.client.Count.WithIndex(index),
+		es.client.Count.WithBody(&buf),
+	)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return 0, errors.Errorf("Error counting latency documents in %s: %s", index, res.String())
+	}
+	var r struct {
+		Count int `json:"count"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return 0, errors.Wrapf(err, "Error parsing the latency documents count in %s", index)
+	}
+	return r.Count, nil
+}
+
+func (es *EsProbe) deleteLatencyDocuments(ctx context.Context, index string) (int, error) {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(latencyDocumentsQuery); err != nil {
+		return 0, errors.Wrap(err, "Error encoding latency documents query")
+	}
+	res, err := es.client.DeleteByQuery(
+		[]string{index},
+		&buf,
+		es.client.DeleteByQuery.WithContext(ctx),
+		es.client.DeleteByQuery.WithConflicts("proceed"),
+	)
+	if err != nil {
+		return 0, errors.Wrapf(err, "Failed to delete latency documents in %s", index)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return 0, errors.Errorf("Error deleting latency documents in %s: %s", index, res.String())
+	}
+	var r struct {
+		Deleted int `json:"deleted"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return 0, errors.Wrapf(err, "Error parsing the latency documents deletion in %s", index)
+	}
+	return r.Deleted, nil
+}
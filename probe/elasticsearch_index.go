@@ -0,0 +1,280 @@
+// GNU General Public License version 3
+
+package probe
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/criteo-forks/espoke/common"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+func indexSettingsPeriod(config *common.Config) time.Duration {
+	return config.ElasticsearchIndexSettingsPeriod
+}
+
+func latencyRecreatePeriod(config *common.Config) time.Duration {
+	return config.ElasticsearchLatencyIndexRecreatePeriod
+}
+
+// indexSettings returns the managed settings the durability and latency indices are created with,
+// as flat settings
+func (es *EsProbe) indexSettings(ctx context.Context) (map[string]string, error) {
+	settings := es.expectedIndexSettings()
+	if _, ok := settings[common.IndexSettingShards]; !ok {
+		dataNodes, err := es.countDataNodes(ctx)
+		if err != nil {
+			return nil, err
+		}
+		settings[common.IndexSettingShards] = strconv.Itoa(dataNodes)
+	}
+	return settings, nil
+}
+
+// expectedIndexSettings returns the managed settings the durability and latency indices are
+// expected to keep, as flat settings. With one shard per data node, the number of shards is the one
+// of data nodes when the index was created, which nodes joining or leaving do not change: it is not
+// expected.
+func (es *EsProbe) expectedIndexSettings() map[string]string {
+	settings := map[string]string{
+		common.IndexSettingRefreshInterval: es.config.ElasticsearchIndexRefreshInterval,
+	}
+	if es.config.ElasticsearchIndexShards > 0 {
+		settings[common.IndexSettingShards] = strconv.Itoa(es.config.ElasticsearchIndexShards)
+	}
+	if es.config.ElasticsearchIndexAutoExpandReplicas != "" {
+		// The number of replicas then follows the number of nodes
+		settings[common.IndexSettingAutoExpandReplicas] = es.config.ElasticsearchIndexAutoExpandReplicas
+	} else {
+		settings[common.IndexSettingAutoExpandReplicas] = "false"
+		settings[common.IndexSettingReplicas] = strconv.Itoa(es.config.ElasticsearchIndexReplicas)
+	}
+	return settings
+}
+
+// indexMappings returns the mappings of the probe indices, with the marker telling the cleanup
+// which indices espoke created
+func (es *EsProbe) indexMappings() map[string]interface{} {
+	mappings := map[string]interface{}{
+		"_meta": map[string]interface{}{"managed_by": MANAGED_BY},
+		"properties": map[string]interface{}{
+			"Name":     map[string]interface{}{"type": "keyword"},
+			"EventTye": map[string]interface{}{"type": "keyword"},
+			"Team":     map[string]interface{}{"type": "keyword"},
+			"Counter":  map[string]interface{}{"type": "integer"},
+			"Data":     map[string]interface{}{"type": "text", "index": false},
+		},
+	}
+	if strings.HasPrefix(es.clusterConfig.Version, "6") {
+		return map[string]interface{}{"_doc": mappings}
+	}
+	return mappings
+}
+
+// countDataNodes returns the number of data nodes of the cluster
+func (es *EsProbe) countDataNodes(ctx context.Context) (int, error) {
+	res, err := es.client.Nodes.Info(
+		es.client.Nodes.Info.WithContext(ctx),
+		es.client.Nodes.Info.WithNodeID("data:true"),
+		es.client.Nodes.Info.WithMetric("_none"),
+	)
+	if err != nil {
+		return 0, errors.Wrapf(err, "Failed to list data nodes of cluster %s", es.clusterName)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return 0, errors.Errorf("Error listing data nodes of cluster %s: %s", es.clusterName, res.String())
+	}
+	var r struct {
+		Nodes struct {
+			Total int `json:"total"`
+		} `json:"_nodes"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return 0, errors.Wrapf(err, "Error parsing data nodes of cluster %s", es.clusterName)
+	}
+	if r.Nodes.Total == 0 {
+		return 0, errors.Errorf("No data node found in cluster %s", es.clusterName)
+	}
+	return r.Nodes.Total, nil
+}
+
+// checkIndexSettings exports which managed settings of the durability and latency indices
+// drifted, and updates them unless drifts are only reported
+func (es *EsProbe) checkIndexSettings(ctx context.Context) error {
+	expected := es.expectedIndexSettings()
+	var failed error
+	for _, index := range []string{es.config.ElasticsearchDurabilityIndex, es.config.ElasticsearchLatencyIndex} {
+		if err := es.reconcileIndexSettings(ctx, index, expected); err != nil {
+			log.Error(err)
+			es.metrics.ClusterErrorsCount.WithLabelValues(es.clusterName).Add(1)
+			failed = err
+		}
+	}
+	return failed
+}
+
+func (es *EsProbe) reconcileIndexSettings(ctx context.Context, index string, expected map[string]string) error {
+	current, err := es.currentIndexSettings(ctx, index)
+	if err != nil {
+		return err
+	}
+
+	drifted := make(map[string]string)
+	for _, setting := range common.ManagedIndexSettings {
+		value, ok := expected[setting]
+		if !ok || current[setting] == value {
+			es.forgetIndexWarning(index + " " + setting)
+			es.metrics.IndexSettingsDriftGauge.WithLabelValues(es.clusterName, index, setting).Set(0)
+			continue
+		}
+		// es_index_settings_drift reports the drift every period, the log only when it starts
+		es.warnIndexOnce(index+" "+setting, fmt.Sprintf("Setting %s of index %s on %s is %q, expected %q", setting, index, es.clusterName, current[setting], value))
+		es.metrics.IndexSettingsDriftGauge.WithLabelValues(es.clusterName, index, setting).Set(1)
+		drifted[setting] = value
+	}
+	// The number of shards of an index cannot change, the latency index gets it when recreated
+	delete(drifted, common.IndexSettingShards)
+	if len(drifted) == 0 || es.config.ElasticsearchIndexDrift != "update" {
+		return nil
+	}
+
+	exist, managed, err := es.adoptIndex(ctx, index)
+	if err != nil {
+		return err
+	}
+	if !exist || !managed {
+		es.warnIndexOnce("settings "+index, unmanagedIndexWarning("updating the settings of", index, es.clusterName))
+		return nil
+	}
+
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(drifted); err != nil {
+		return errors.Wrapf(err, "Failed to encode the settings of index %s", index)
+	}
+	res, err := es.client.Indices.PutSettings(
+		&buf,
+		es.client.Indices.PutSettings.WithContext(ctx),
+		es.client.Indices.PutSettings.WithIndex(index),
+	)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to update the settings of index %s on %s", index, es.clusterName)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return errors.Errorf("Error updating the settings of index %s on %s: %s", index, es.clusterName, res.String())
+	}
+	for setting, value := range drifted {
+		log.Infof("Set %s of index %s on %s to %q", setting, index, es.clusterName, value)
+		es.metrics.IndexSettingsDriftGauge.WithLabelValues(es.clusterName, index, setting).Set(0)
+	}
+	return nil
+}
+
+// currentIndexSettings returns the flat settings of an index, defaults included
+func (es *EsProbe) currentIndexSettings(ctx context.Context, index string) (map[string]string, error) {
+	res, err := es.client.Indices.GetSettings(
+		es.client.Indices.GetSettings.WithContext(ctx),
+		es.client.Indices.GetSettings.WithIndex(index),
+		es.client.Indices.GetSettings.WithFlatSettings(true),
+		es.client.Indices.GetSettings.WithIncludeDefaults(true),
+	)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to get the settings of index %s on %s", index, es.clusterName)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return nil, errors.Errorf("Error getting the settings of index %s on %s: %s", index, es.clusterName, res.String())
+	}
+	var r map[string]struct {
+		Settings map[string]interface{} `json:"settings"`
+		Defaults map[string]interface{} `json:"defaults"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return nil, errors.Wrapf(err, "Error parsing the settings of index %s on %s", index, es.clusterName)
+	}
+	indexSettings, ok := r[index]
+	if !ok {
+		return nil, errors.Errorf("Index %s on %s is an alias, its settings are not managed", index, es.clusterName)
+	}
+
+	settings := make(map[string]string)
+	for _, values := range []map[string]interface{}{indexSettings.Defaults, indexSettings.Settings} {
+		for setting, value := range values {
+			settings[setting] = fmt.Sprint(value)
+		}
+	}
+	return settings, nil
+}
+
+// recreateLatencyIndex deletes the latency index and creates it again, so that the documents
+// deleted by the latency probe do not pile up
+func (es *EsProbe) recreateLatencyIndex(ctx context.Context) error {
+	index := es.config.ElasticsearchLatencyIndex
+	// Documents indexed meanwhile would create the index with the cluster defaults
+	es.latencyIndexMu.Lock()
+	defer es.latencyIndexMu.Unlock()
+
+	exist, managed, err := es.adoptIndex(ctx, index)
+	if err != nil {
+		log.Error(err)
+		es.metrics.ClusterErrorsCount.WithLabelValues(es.clusterName).Add(1)
+		return err
+	}
+	if exist && !managed {
+		es.warnIndexOnce("recreate "+index, unmanagedIndexWarning("recreating", index, es.clusterName))
+		return nil
+	}
+
+	log.Infof("Recreating latency index %s on %s", index, es.clusterName)
+	if err := es.deleteIndex(ctx, index); err != nil {
+		log.Error(err)
+		es.metrics.ClusterErrorsCount.WithLabelValues(es.clusterName).Add(1)
+		return err
+	}
+	if err := es.createMissingIndex(ctx, index); err != nil {
+		log.Error(err)
+		es.metrics.ClusterErrorsCount.WithLabelValues(es.clusterName).Add(1)
+		return err
+	}
+	es.metrics.ClusterLatencyIndexRecreationsCount.WithLabelValues(es.clusterName).Inc()
+	// The index now has the managed settings
+	for _, setting := range common.ManagedIndexSettings {
+		es.metrics.IndexSettingsDriftGauge.WithLabelValues(es.clusterName, index, setting).Set(0)
+	}
+	return nil
+}
+
+// unmanagedIndexWarning explains why espoke leaves an index it did not create alone
+func unmanagedIndexWarning(action, index, cluster string) string {
+	return fmt.Sprintf("Not %s index %s on %s, it was not created by espoke: enable --elasticsearch-adopt-indices if an earlier version of espoke created it, or add the _meta.managed_by %s marker to its mapping to let espoke manage it", action, index, cluster, MANAGED_BY)
+}
+
+// warnIndexOnce logs a warning about the probe indices once per probe rather than every period,
+// until it is forgotten
+func (es *EsProbe) warnIndexOnce(key, warning string) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	if es.indexWarnings[key] {
+		return
+	}
+	es.indexWarnings[key] = true
+	log.Warning(warning)
+}
+
+// forgetIndexWarning logs the warning again the next time it happens
+func (es *EsProbe) forgetIndexWarning(key string) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	delete(es.indexWarnings, key)
+}
@@ -0,0 +1,190 @@
+// GNU General Public License version 3
+
+package probe
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/criteo-forks/espoke/common"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// newTestEsProbe creates an elasticsearch probe of a single node, exporting its metrics on registry
+func newTestEsProbe(t *testing.T, cluster string, node common.Node, registry *prometheus.Registry) *EsProbe {
+	if err := common.RegisterRuntimeMetrics(registry); err != nil {
+		t.Fatal(err)
+	}
+	metrics := common.NewMetrics(registry)
+	config := &common.Config{
+		ConsulPeriod:            2 * time.Minute,
+		ProbePeriod:             30 * time.Second,
+		RestorePeriod:           24 * time.Hour,
+		CleaningPeriod:          10 * time.Minute,
+		LatencyProbeRatePerMin:  120,
+		HTTPDialTimeout:         time.Second,
+		HTTPTLSHandshakeTimeout: time.Second,
+		HTTPIdleConnTimeout:     time.Second,
+	}
+	credentials, err := common.NewCredentialsProvider("", common.Credentials{}, nil, time.Minute, metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clusterConfig := common.Cluster{Name: "svc-" + cluster, Scheme: "http"}
+	endpoint := net.JoinHostPort(node.Ip, strconv.Itoa(node.Port))
+	es, err := newEsProbe(cluster, endpoint, clusterConfig, config, nil, []common.Node{node}, credentials, common.NewTransports(config, metrics), metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return es
+}
+
+// gatherSeries returns the label sets of every series of a metric family
+func gatherSeries(t *testing.T, registry *prometheus.Registry, name string) []map[string]string {
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var series []map[string]string
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			labels := make(map[string]string)
+			for _, pair := range metric.GetLabel() {
+				labels[pair.GetName()] = pair.GetValue()
+			}
+			series = append(series, labels)
+		}
+	}
+	return series
+}
+
+func TestEsProbesOnSeparateRegistries(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	host, portString, err := net.SplitHostPort(server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, _ := strconv.Atoi(portString)
+
+	registries := map[string]*prometheus.Registry{}
+	for _, cluster := range []string{"first", "second"} {
+		// Registering the same metrics twice on the default registry would panic
+		registries[cluster] = prometheus.NewRegistry()
+		node := common.Node{Name: "node-" + cluster, Ip: host, Port: port, Scheme: "http", Cluster: cluster}
+		es := newTestEsProbe(t, cluster, node, registries[cluster])
+		es.probeNodes(context.Background())
+	}
+
+	for cluster, registry := range registries {
+		for _, name := range []string{"espoke_build_info", "go_goroutines", "process_start_time_seconds"} {
+			if len(gatherSeries(t, registry, name)) != 1 {
+				t.Errorf("registry of %s has no %s series", cluster, name)
+			}
+		}
+		for _, name := range []string{"es_node_availability", "es_node_cat_latency"} {
+			series := gatherSeries(t, registry, name)
+			if len(series) != 1 {
+				t.Errorf("registry of %s has %d %s series, expected 1: %v", cluster, len(series), name, series)
+				continue
+			}
+			if series[0]["cluster"] != cluster || series[0]["node_name"] != "node-"+cluster {
+				t.Errorf("registry of %s has the %s series of another probe: %v", cluster, name, series[0])
+			}
+		}
+	}
+}
+
+func TestEsAdoptIndexOptIn(t *testing.T) {
+	marked := 0
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/.espoke.latency/_mapping":
+			// An index created by an earlier version of espoke, without the marker
+			rw.Header().Set("Content-Type", "application/json")
+			rw.Write([]byte(`{".espoke.latency": {"mappings": {"properties": {"EventTye": {"type": "keyword"}}}}}`))
+		case r.Method == "PUT" && r.URL.Path == "/.espoke.latency/_mapping":
+			marked++
+			rw.Header().Set("Content-Type", "application/json")
+			rw.Write([]byte(`{"acknowledged": true}`))
+		default:
+			rw.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	host, portString, err := net.SplitHostPort(server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, _ := strconv.Atoi(portString)
+	node := common.Node{Name: "node", Ip: host, Port: port, Scheme: "http", Cluster: "cluster"}
+	es := newTestEsProbe(t, "cluster", node, prometheus.NewRegistry())
+
+	exist, managed, err := es.adoptIndex(context.Background(), ".espoke.latency")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exist || managed || marked != 0 {
+		t.Errorf("index adopted without --elasticsearch-adopt-indices: exist %t, managed %t, %d markers put", exist, managed, marked)
+	}
+
+	es.config.ElasticsearchAdoptIndices = true
+	exist, managed, err = es.adoptIndex(context.Background(), ".espoke.latency")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exist || !managed || marked != 1 {
+		t.Errorf("index not adopted with --elasticsearch-adopt-indices: exist %t, managed %t, %d markers put", exist, managed, marked)
+	}
+}
+
+func TestEsIndexSettingsShardsPerDataNode(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" || (r.URL.Path != "/.espoke.durability/_settings" && r.URL.Path != "/.espoke.latency/_settings") {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		// Created with one shard per data node, a data node joined since
+		index := r.URL.Path[1 : len(r.URL.Path)-len("/_settings")]
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Write([]byte(`{"` + index + `": {"settings": {"index.number_of_shards": "3", "index.number_of_replicas": "1",
+			"index.auto_expand_replicas": "false", "index.refresh_interval": "1s"}}}`))
+	}))
+	defer server.Close()
+	host, portString, err := net.SplitHostPort(server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, _ := strconv.Atoi(portString)
+	node := common.Node{Name: "node", Ip: host, Port: port, Scheme: "http", Cluster: "cluster"}
+	es := newTestEsProbe(t, "cluster", node, prometheus.NewRegistry())
+	es.config.ElasticsearchDurabilityIndex = ".espoke.durability"
+	es.config.ElasticsearchLatencyIndex = ".espoke.latency"
+	es.config.ElasticsearchIndexReplicas = 1
+	es.config.ElasticsearchIndexRefreshInterval = "1s"
+	es.config.ElasticsearchIndexDrift = "report"
+
+	for shards, drift := range map[int]float64{0: 0, 3: 0, 4: 1} {
+		es.config.ElasticsearchIndexShards = shards
+		if err := es.checkIndexSettings(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		for _, index := range []string{".espoke.durability", ".espoke.latency"} {
+			gauge := es.metrics.IndexSettingsDriftGauge.WithLabelValues("cluster", index, common.IndexSettingShards)
+			if value := testutil.ToFloat64(gauge); value != drift {
+				t.Errorf("shards drift of %s is %v with %d shards configured, expected %v", index, value, shards, drift)
+			}
+		}
+	}
+}
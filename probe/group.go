@@ -0,0 +1,63 @@
+// GNU General Public License version 3
+
+package probe
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// probeGroup runs probing goroutines and waits for them. A panic in one of them would kill the
+// process as nothing can recover it from another goroutine: it is recovered there and raised
+// again by Wait so that the supervisor of the probe sees it.
+type probeGroup struct {
+	wg       sync.WaitGroup
+	mu       sync.Mutex
+	panicked interface{}
+	err      error
+	failures int
+}
+
+// Go runs fn in a new goroutine of the group
+func (g *probeGroup) Go(fn func()) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		defer func() {
+			if r := recover(); r != nil {
+				g.mu.Lock()
+				if g.panicked == nil {
+					g.panicked = fmt.Sprintf("%v\n%s", r, debug.Stack())
+				}
+				g.mu.Unlock()
+			}
+		}()
+		fn()
+	}()
+}
+
+// fail records an error of a goroutine of the group
+func (g *probeGroup) fail(err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.err == nil {
+		g.err = err
+	}
+	g.failures++
+}
+
+// Wait waits for every goroutine of the group and panics again if one of them panicked. It
+// returns the first error recorded by fail.
+func (g *probeGroup) Wait() error {
+	g.wg.Wait()
+	if g.panicked != nil {
+		panic(g.panicked)
+	}
+	if g.failures > 1 {
+		return errors.Errorf("%s (and %d other errors)", g.err, g.failures-1)
+	}
+	return g.err
+}
@@ -0,0 +1,185 @@
+// GNU General Public License version 3
+
+package probe
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/criteo-forks/espoke/common"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Heartbeat records when each probing operation of a probe last ran, so that a watchdog can detect
+// a probe loop stuck on one of them
+type Heartbeat struct {
+	cluster      string
+	metrics      *common.Metrics
+	availability *prometheus.GaugeVec
+
+	mu        sync.Mutex
+	intervals map[string]time.Duration
+	// last is reset when the probe starts so that the watchdog gives its operations time to run
+	last      map[string]time.Time
+	runs      map[string]int
+	started   map[string]time.Time
+	durations map[string]time.Duration
+	running   map[string]bool
+	errors    map[string]error
+	nodes     []common.Node
+}
+
+// OperationStatus is the last run of a probing operation
+type OperationStatus struct {
+	Runs int `json:"runs"`
+	// LastRun is when the last run started, unset until the operation runs
+	LastRun *time.Time `json:"last_run,omitempty"`
+	// LastDuration is the duration of the last completed run
+	LastDuration time.Duration `json:"last_duration_ns"`
+	Running      bool          `json:"running"`
+	// LastSucceeded tells whether the last completed run succeeded, unset until a run completes
+	LastSucceeded *bool `json:"last_succeeded,omitempty"`
+	// LastError is the error of the last completed run when it failed
+	LastError string `json:"last_error,omitempty"`
+}
+
+func newHeartbeat(cluster string, metrics *common.Metrics, availability *prometheus.GaugeVec) *Heartbeat {
+	return &Heartbeat{
+		cluster:      cluster,
+		metrics:      metrics,
+		availability: availability,
+		intervals:    make(map[string]time.Duration),
+		last:         make(map[string]time.Time),
+		runs:         make(map[string]int),
+		started:      make(map[string]time.Time),
+		durations:    make(map[string]time.Duration),
+		running:      make(map[string]bool),
+		errors:       make(map[string]error),
+	}
+}
+
+// expect registers an operation expected to run every interval
+func (h *Heartbeat) expect(operation string, interval time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.intervals[operation] = interval
+	h.last[operation] = time.Now()
+	h.running[operation] = false
+}
+
+// beat records that an operation just ran
+func (h *Heartbeat) beat(operation string) {
+	now := time.Now()
+	h.mu.Lock()
+	h.last[operation] = now
+	h.started[operation] = now
+	h.runs[operation]++
+	h.running[operation] = true
+	h.mu.Unlock()
+	h.metrics.ProbeLastRunGauge.WithLabelValues(h.cluster, operation).Set(float64(now.Unix()))
+}
+
+// finish records that a run of an operation returned after duration, err being its failure
+func (h *Heartbeat) finish(operation string, duration time.Duration, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.durations[operation] = duration
+	h.running[operation] = false
+	h.errors[operation] = err
+}
+
+// setNodes records the nodes whose availability is exported by the probe
+func (h *Heartbeat) setNodes(nodes []common.Node) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.nodes = nodes
+}
+
+// Nodes returns the probed nodes
+func (h *Heartbeat) Nodes() []common.Node {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]common.Node(nil), h.nodes...)
+}
+
+// Operations returns the last run of every probing operation
+func (h *Heartbeat) Operations() map[string]OperationStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	operations := make(map[string]OperationStatus, len(h.intervals))
+	for operation := range h.intervals {
+		status := OperationStatus{
+			Runs:         h.runs[operation],
+			LastDuration: h.durations[operation],
+			Running:      h.running[operation],
+		}
+		if started, ok := h.started[operation]; ok {
+			status.LastRun = &started
+		}
+		if err, ok := h.errors[operation]; ok {
+			succeeded := err == nil
+			status.LastSucceeded = &succeeded
+			if err != nil {
+				status.LastError = err.Error()
+			}
+		}
+		operations[operation] = status
+	}
+	return operations
+}
+
+// Stale returns the operations which did not run for misses intervals, and at least for minimum
+func (h *Heartbeat) Stale(misses int, minimum time.Duration) []string {
+	return h.stale(misses, minimum, false)
+}
+
+// Check is Stale, also exporting whether every operation is stale
+func (h *Heartbeat) Check(misses int, minimum time.Duration) []string {
+	return h.stale(misses, minimum, true)
+}
+
+func (h *Heartbeat) stale(misses int, minimum time.Duration, export bool) []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var stale []string
+	for operation, interval := range h.intervals {
+		window := time.Duration(misses) * interval
+		if window < minimum {
+			window = minimum
+		}
+		isStale := time.Since(h.last[operation]) > window
+		if isStale {
+			stale = append(stale, operation)
+		}
+		if export {
+			value := 0.0
+			if isStale {
+				value = 1
+			}
+			h.metrics.ProbeStaleGauge.WithLabelValues(h.cluster, operation).Set(value)
+		}
+	}
+	sort.Strings(stale)
+	return stale
+}
+
+// MarkUnknown removes the availability of the probed nodes, it is unknown while the probe is stuck
+// and set again once the probe runs
+func (h *Heartbeat) MarkUnknown() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, node := range h.nodes {
+		h.availability.DeleteLabelValues(node.Cluster, node.Name)
+	}
+}
+
+// clean removes the heartbeat metrics of the probe
+func (h *Heartbeat) clean() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for operation := range h.intervals {
+		h.metrics.ProbeLastRunGauge.DeleteLabelValues(h.cluster, operation)
+		h.metrics.ProbeStaleGauge.DeleteLabelValues(h.cluster, operation)
+	}
+}
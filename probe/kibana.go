@@ -3,11 +3,13 @@
 package probe
 
 import (
-	"crypto/tls"
+	"context"
 	"fmt"
 	"github.com/criteo-forks/espoke/common"
 	"github.com/hashicorp/consul/api"
+	"github.com/pkg/errors"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"sync"
 	"time"
@@ -16,146 +18,352 @@ import (
 	"github.com/valyala/fastjson"
 )
 
+var kibanaKind = Kind{
+	Name: "kibana",
+	ConsulTag: func(config *common.Config) string {
+		return config.KibanaConsulTag
+	},
+	Credentials: func(config *common.Config) (string, common.Credentials) {
+		credentials := common.Credentials{
+			Auth:     config.KibanaAuth,
+			Username: config.KibanaUser,
+			Password: config.KibanaPassword,
+			ApiKey:   config.KibanaApiKey,
+			Token:    config.KibanaToken,
+		}
+		// Kibana used to share the elasticsearch credentials, keep doing so when none is given
+		if credentials.IsEmpty() {
+			credentials = elasticsearchDefaultCredentials(config)
+		}
+		return config.KibanaCredentials, credentials
+	},
+	New: func(clusterName string, clusterConfig common.Cluster, deps Dependencies) (Probe, error) {
+		return NewKibanaProbe(clusterName, clusterConfig, deps.Config, deps.ConsulClient, deps.Credentials, deps.Transports, deps.Metrics)
+	},
+}
+
 type KibanaProbe struct {
 	clusterName   string
 	clusterConfig common.Cluster
 	config        *common.Config
+	credentials   common.CredentialsProvider
+	transports    *common.Transports
+	metrics       *common.Metrics
 
 	consulClient *api.Client
 
-	timeout time.Duration
-
-	updateDiscoveryTicker *time.Ticker
-	cleanMetricsTicker    *time.Ticker
-	executeProbingTicker  *time.Ticker
+	heartbeat *Heartbeat
+	scheduler *scheduler
+	// functionalProbingNodeIndex is only used by the functional operation, which never overlaps itself
+	functionalProbingNodeIndex int
 
+	// mu guards the nodes lists and status, updated and read by operations running concurrently
+	mu                      sync.RWMutex
 	kibanaNodesList         []common.Node
 	allEverKnownKibanaNodes []string
+	kibanaNodesStatus       map[string]kibanaStatus
+}
 
-	controlChan chan bool
+// kibanaProbeError carries the reason exported in kibana_cluster_errors_count
+type kibanaProbeError struct {
+	reason string
+	err    error
 }
 
-func probeKibanaNode(node *common.Node, timeout time.Duration, username, password string) error {
-	http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
-	client := &http.Client{
-		Timeout: timeout,
+func (e *kibanaProbeError) Error() string {
+	return e.err.Error()
+}
+
+// kibanaErrorReason returns the reason of a probe error, "request" when unknown
+func kibanaErrorReason(err error) string {
+	var probeErr *kibanaProbeError
+	if errors.As(err, &probeErr) {
+		return probeErr.reason
 	}
+	return common.KibanaErrorRequest
+}
+
+// requestErrorReason tells timeouts from other request errors
+func requestErrorReason(err error) string {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return common.KibanaErrorTimeout
+	}
+	return common.KibanaErrorRequest
+}
+
+func (kibana *KibanaProbe) probeKibanaNode(ctx context.Context, node *common.Node, creds common.Credentials) (*kibanaStatus, error) {
+	client, err := kibana.transports.Client("kibana", kibana.clusterName, node.Name)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, kibana.scheduler.requestTimeout())
+	defer cancel()
 
 	probingURL := fmt.Sprintf("%v://%v:%v/api/status", node.Scheme, node.Ip, node.Port)
 	log.Debug("Start probing ", node.Name)
 
-	req, err := http.NewRequest("GET", probingURL, nil)
+	start := time.Now()
+	req, err := http.NewRequestWithContext(ctx, "GET", probingURL, nil)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if err := creds.Apply(req); err != nil {
+		return nil, &kibanaProbeError{reason: common.KibanaErrorCredentials, err: err}
 	}
-	req.SetBasicAuth(username, password)
 	resp, err := client.Do(req)
 	if err != nil {
 		log.Debug("Probing failed for ", node.Name, ": ", probingURL, " ", err.Error())
-		return err
+		return nil, &kibanaProbeError{reason: requestErrorReason(err), err: err}
 	}
+	defer resp.Body.Close()
 
 	log.Debug("Probe result for ", node.Name, ": ", resp.Status)
 	if resp.StatusCode != 200 {
 		log.Error("Probing failed for ", node.Name, ": ", probingURL, " ", resp.Status)
-		return fmt.Errorf("kibana Probing failed")
+		return nil, &kibanaProbeError{reason: common.KibanaErrorHTTPStatus, err: fmt.Errorf("kibana Probing failed: %s", resp.Status)}
 	}
 
 	body, readErr := ioutil.ReadAll(resp.Body)
 	if readErr != nil {
-		return fmt.Errorf("kibana Probing failed: %s", readErr)
+		return nil, &kibanaProbeError{reason: requestErrorReason(readErr), err: fmt.Errorf("kibana Probing failed: %s", readErr)}
 	}
+	durationMilliSec := float64(time.Since(start).Milliseconds())
+	kibana.metrics.KibanaNodeLatencySummary.WithLabelValues(node.Cluster, node.Name).Observe(durationMilliSec)
+	kibana.metrics.KibanaNodeLatencyHistogram.WithLabelValues(node.Cluster, node.Name).Observe(durationMilliSec)
 
 	var p fastjson.Parser
 	json, jsonErr := p.Parse(string(body))
 	if jsonErr != nil {
-		return fmt.Errorf("kibana Probing failed: %s", jsonErr)
+		return nil, &kibanaProbeError{reason: common.KibanaErrorJSON, err: fmt.Errorf("kibana Probing failed: %s", jsonErr)}
 	}
-	nodeState := string(json.GetStringBytes("status", "overall", "state"))
-	if nodeState != "green" {
-		return fmt.Errorf("kibana Probing failed: node not in a green/healthy state")
+	status := parseKibanaStatus(json)
+	// A degraded node still serves requests, its degradation is only reported by its status level
+	if status.overall > kibanaDegradedStatusLevel {
+		return &status, &kibanaProbeError{reason: common.KibanaErrorState, err: fmt.Errorf("kibana Probing failed: node %s not in an available/green or degraded/yellow state", node.Name)}
 	}
 
-	common.KibanaNodeAvailabilityGauge.WithLabelValues(node.Cluster, node.Name).Set(1)
+	kibana.metrics.KibanaNodeAvailabilityGauge.WithLabelValues(node.Cluster, node.Name).Set(1)
 
-	return nil
+	return &status, nil
 }
 
-func NewKibanaProbe(clusterName string, clusterConfig common.Cluster, config *common.Config, consulClient *api.Client, controlChan chan bool) (KibanaProbe, error) {
+// updateNodesStatus exports the status reported by nodes and forgets the ones of vanished nodes
+func (kibana *KibanaProbe) updateNodesStatus(nodes []common.Node, statuses []*kibanaStatus) {
+	kibana.mu.Lock()
+	defer kibana.mu.Unlock()
+	for i := range nodes {
+		if statuses[i] == nil {
+			continue
+		}
+		previous, ok := kibana.kibanaNodesStatus[nodes[i].Name]
+		if ok {
+			kibana.exportKibanaStatus(&nodes[i], *statuses[i], &previous)
+		} else {
+			kibana.exportKibanaStatus(&nodes[i], *statuses[i], nil)
+		}
+		kibana.kibanaNodesStatus[nodes[i].Name] = *statuses[i]
+	}
+}
+
+// cleanNodesStatus removes the status metrics of nodes not in nodes
+func (kibana *KibanaProbe) cleanNodesStatus(nodes []common.Node) {
+	kibana.mu.Lock()
+	defer kibana.mu.Unlock()
+	names := nodeNames(nodes)
+	for name, status := range kibana.kibanaNodesStatus {
+		if !stringInSlice(name, names) {
+			kibana.cleanKibanaStatusMetrics(kibana.clusterName, name, status)
+			delete(kibana.kibanaNodesStatus, name)
+		}
+	}
+}
+
+func NewKibanaProbe(clusterName string, clusterConfig common.Cluster, config *common.Config, consulClient *api.Client, credentials common.CredentialsProvider, transports *common.Transports, metrics *common.Metrics) (*KibanaProbe, error) {
 	var allEverKnownKibanaNodes []string
 	kibanaNodesList, err := common.DiscoverNodesForService(consulClient, clusterConfig.Name)
 	if err != nil {
-		common.ErrorsCount.Inc()
-		log.Fatal("Impossible to discover kibana nodes during bootstrap, exiting")
+		return nil, errors.Wrapf(err, "Impossible to discover kibana nodes during bootstrap for cluster %s", clusterName)
 	}
 	allEverKnownKibanaNodes = common.UpdateEverKnownNodes(allEverKnownKibanaNodes, kibanaNodesList)
+	heartbeat := newHeartbeat(clusterName, metrics, metrics.KibanaNodeAvailabilityGauge)
+	heartbeat.setNodes(kibanaNodesList)
 
-	return KibanaProbe{
+	kibana := &KibanaProbe{
 		clusterName:   clusterName,
 		clusterConfig: clusterConfig,
 		config:        config,
+		credentials:   credentials,
+		transports:    transports,
+		metrics:       metrics,
 
 		consulClient: consulClient,
 
-		timeout: config.ProbePeriod - 2*time.Second,
-
-		updateDiscoveryTicker: time.NewTicker(config.ConsulPeriod),
-		executeProbingTicker:  time.NewTicker(config.ProbePeriod),
-		cleanMetricsTicker:    time.NewTicker(config.CleaningPeriod),
+		heartbeat: heartbeat,
 
 		kibanaNodesList:         kibanaNodesList,
 		allEverKnownKibanaNodes: allEverKnownKibanaNodes,
+		kibanaNodesStatus:       make(map[string]kibanaStatus),
+	}
+
+	kibana.scheduler = newScheduler(clusterName, heartbeat, config, metrics)
+	kibana.scheduler.add("kibana_discovery", consulPeriod, OverlapQueue, kibana.updateNodes)
+	kibana.scheduler.add("kibana_nodes", probePeriod, OverlapSkip, kibana.probeNodes)
+	kibana.scheduler.add("kibana_cleaning", cleaningPeriod, OverlapQueue, kibana.cleanMetrics)
+	if config.KibanaFunctionalProbe {
+		kibana.scheduler.add("kibana_functional", kibanaFunctionalPeriod, OverlapSkip, kibana.probeFunctional)
+	}
+	return kibana, nil
+}
+
+func kibanaFunctionalPeriod(config *common.Config) time.Duration {
+	return config.KibanaFunctionalProbePeriod
+}
+
+func (kibana *KibanaProbe) Name() string {
+	return kibana.clusterName
+}
+
+func (kibana *KibanaProbe) Cluster() common.Cluster {
+	return kibana.clusterConfig
+}
+
+func (kibana *KibanaProbe) Heartbeat() *Heartbeat {
+	return kibana.heartbeat
+}
 
-		controlChan: controlChan,
-	}, nil
-}
-
-func (kibana *KibanaProbe) StartKibanaProbing() error {
-	for {
-		select {
-		case <-kibana.controlChan:
-			log.Println("Terminating kibana probe on ", kibana.clusterName)
-			kibana.cleanMetricsTicker.Stop()
-			kibana.updateDiscoveryTicker.Stop()
-			kibana.executeProbingTicker.Stop()
-			common.CleanNodeMetrics(kibana.kibanaNodesList, kibana.allEverKnownKibanaNodes)
-			return nil
-
-		case <-kibana.cleanMetricsTicker.C:
-			log.Infof("Cleaning Prometheus metrics for unreferenced nodes on cluster %s", kibana.clusterName)
-			common.CleanNodeMetrics(kibana.kibanaNodesList, kibana.allEverKnownKibanaNodes)
-
-		case <-kibana.updateDiscoveryTicker.C:
-			// Kibana
-			log.Debugf("Starting updating Kibana nodes list on cluster %s", kibana.clusterName)
-			kibanaUpdatedList, err := common.DiscoverNodesForService(kibana.consulClient, kibana.clusterConfig.Name)
+func (kibana *KibanaProbe) Trigger(operation string) error {
+	return kibana.scheduler.trigger(operation)
+}
+
+func (kibana *KibanaProbe) Reschedule(config *common.Config) {
+	kibana.scheduler.reschedule(config)
+}
+
+// nodes returns the current and ever known nodes of the cluster
+func (kibana *KibanaProbe) nodes() ([]common.Node, []string) {
+	kibana.mu.RLock()
+	defer kibana.mu.RUnlock()
+	return kibana.kibanaNodesList, kibana.allEverKnownKibanaNodes
+}
+
+// nodeVersion returns the version a node reported on its last status call, empty when unknown
+func (kibana *KibanaProbe) nodeVersion(name string) string {
+	kibana.mu.RLock()
+	defer kibana.mu.RUnlock()
+	return kibana.kibanaNodesStatus[name].version
+}
+
+// Prepare has nothing to set up on kibana clusters
+func (kibana *KibanaProbe) Prepare(ctx context.Context) error {
+	return nil
+}
+
+func (kibana *KibanaProbe) Start(ctx context.Context) error {
+	kibana.scheduler.run(ctx)
+
+	log.Println("Terminating kibana probe on ", kibana.clusterName)
+	kibana.scheduler.clean()
+	kibana.heartbeat.clean()
+	nodes, allEverKnownNodes := kibana.nodes()
+	kibana.metrics.CleanNodeMetrics("kibana", nodes, allEverKnownNodes)
+	kibana.cleanNodesStatus(nil)
+	kibana.metrics.CleanKibanaClusterMetrics(kibana.clusterName)
+	kibana.cleanKibanaFunctionalMetrics(kibana.clusterName)
+	kibana.transports.Close("kibana", kibana.clusterName)
+	return nil
+}
+
+// updateNodes refreshes the nodes of the cluster from consul
+func (kibana *KibanaProbe) updateNodes(ctx context.Context) error {
+	log.Debugf("Starting updating Kibana nodes list on cluster %s", kibana.clusterName)
+	kibanaUpdatedList, err := common.DiscoverNodesForService(kibana.consulClient, kibana.clusterConfig.Name)
+	if err != nil {
+		log.Error("Unable to update Kibana nodes, using last known state")
+		kibana.metrics.ErrorsCount.Inc()
+		return err
+	}
+
+	log.Infof("Updating kibana nodes list on cluster %s", kibana.clusterName)
+	kibana.mu.Lock()
+	kibana.allEverKnownKibanaNodes = common.UpdateEverKnownNodes(kibana.allEverKnownKibanaNodes, kibanaUpdatedList)
+	kibana.kibanaNodesList = kibanaUpdatedList
+	kibana.mu.Unlock()
+	kibana.heartbeat.setNodes(kibanaUpdatedList)
+	return nil
+}
+
+// cleanMetrics removes the metrics of vanished nodes
+func (kibana *KibanaProbe) cleanMetrics(ctx context.Context) error {
+	log.Infof("Cleaning Prometheus metrics for unreferenced nodes on cluster %s", kibana.clusterName)
+	nodes, allEverKnownNodes := kibana.nodes()
+	kibana.metrics.CleanNodeMetrics("kibana", nodes, allEverKnownNodes)
+	kibana.transports.Retain("kibana", kibana.clusterName, nodeNames(nodes))
+	kibana.cleanNodesStatus(nodes)
+	return nil
+}
+
+// probeNodes checks the status of every node
+func (kibana *KibanaProbe) probeNodes(ctx context.Context) error {
+	log.Debugf("Starting probing Kibana nodes on cluster %s", kibana.clusterName)
+	creds, err := kibana.credentials.Credentials(kibana.clusterName)
+	if err != nil {
+		log.Errorf("Failed on %s: %s", kibana.clusterName, err.Error())
+		kibana.metrics.KibanaClusterErrorsCount.WithLabelValues(kibana.clusterName, common.KibanaErrorCredentials).Inc()
+		return err
+	}
+
+	sem := new(probeGroup)
+	nodes, _ := kibana.nodes()
+	statuses := make([]*kibanaStatus, len(nodes))
+	for i, node := range nodes {
+		i, kibanaNode := i, node
+		sem.Go(func() {
+			status, err := kibana.probeKibanaNode(ctx, &kibanaNode, creds)
+			statuses[i] = status
 			if err != nil {
-				log.Error("Unable to update Kibana nodes, using last known state")
-				common.ErrorsCount.Inc()
-				continue
+				log.Errorf("Failed on %s: %s", kibana.clusterName, err.Error())
+				kibana.metrics.KibanaNodeAvailabilityGauge.WithLabelValues(kibanaNode.Cluster, kibanaNode.Name).Set(0)
+				kibana.metrics.KibanaClusterErrorsCount.WithLabelValues(kibana.clusterName, kibanaErrorReason(err)).Inc()
+				sem.fail(err)
 			}
+		})
 
-			log.Infof("Updating kibana nodes list on cluster %s", kibana.clusterName)
-			kibana.allEverKnownKibanaNodes = common.UpdateEverKnownNodes(kibana.allEverKnownKibanaNodes, kibanaUpdatedList)
-			kibana.kibanaNodesList = kibanaUpdatedList
-
-		case <-kibana.executeProbingTicker.C:
-			log.Debugf("Starting probing Kibana nodes on cluster %s", kibana.clusterName)
-
-			sem := new(sync.WaitGroup)
-			for _, node := range kibana.kibanaNodesList {
-				sem.Add(1)
-				go func(kibanaNode common.Node) {
-					defer sem.Done()
-					if err := probeKibanaNode(&kibanaNode, kibana.timeout, kibana.config.ElasticsearchUser, kibana.config.ElasticsearchPassword); err != nil {
-						log.Errorf("Failed on %s: %s", kibana.clusterName, err.Error())
-						common.KibanaNodeAvailabilityGauge.WithLabelValues(kibanaNode.Cluster, kibanaNode.Name).Set(0)
-						common.ErrorsCount.Inc()
-					}
-				}(node)
+	}
+	err = sem.Wait()
+	kibana.updateNodesStatus(nodes, statuses)
 
-			}
-			sem.Wait()
+	available := 0
+	for _, status := range statuses {
+		if status != nil && status.overall <= kibanaDegradedStatusLevel {
+			available++
 		}
 	}
+	kibana.metrics.KibanaClusterNodesGauge.WithLabelValues(kibana.clusterName).Set(float64(len(nodes)))
+	kibana.metrics.KibanaClusterAvailableNodesGauge.WithLabelValues(kibana.clusterName).Set(float64(available))
+	return err
+}
+
+// probeFunctional runs the functional probe through a different node on every run
+func (kibana *KibanaProbe) probeFunctional(ctx context.Context) error {
+	nodes, _ := kibana.nodes()
+	if len(nodes) == 0 {
+		return nil
+	}
+	kibana.functionalProbingNodeIndex = (kibana.functionalProbingNodeIndex + 1) % len(nodes)
+	node := nodes[kibana.functionalProbingNodeIndex]
+	log.Debugf("Starting functional probing of Kibana cluster %s through %s", kibana.clusterName, node.Name)
+
+	creds, err := kibana.credentials.Credentials(kibana.clusterName)
+	if err != nil {
+		log.Errorf("Failed on %s: %s", kibana.clusterName, err.Error())
+		kibana.metrics.KibanaClusterErrorsCount.WithLabelValues(kibana.clusterName, common.KibanaErrorCredentials).Inc()
+		return err
+	}
+	if err := kibana.probeKibanaFunctional(ctx, &node, creds); err != nil {
+		log.Error(err)
+		kibana.metrics.KibanaClusterErrorsCount.WithLabelValues(kibana.clusterName, common.KibanaErrorFunctional).Inc()
+		return err
+	}
+	return nil
 }
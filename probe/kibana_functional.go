@@ -0,0 +1,291 @@
+// GNU General Public License version 3
+
+package probe
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/criteo-forks/espoke/common"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// kibanaFunctionalObjectPrefix prefixes the ids of the saved objects created by the functional
+// probe, every espoke instance upserting its own ones
+const kibanaFunctionalObjectPrefix = "espoke-functional-probe"
+
+var kibanaFunctionalSteps = []string{"login", "save", "read", "search", "cleanup"}
+
+// kibanaSession sends requests to a single Kibana node, either with a session cookie when
+// logged in or with the credentials on every request
+type kibanaSession struct {
+	client   *http.Client
+	baseURL  string
+	creds    common.Credentials
+	loggedIn bool
+}
+
+func (s *kibanaSession) do(ctx context.Context, method, path string, body interface{}) (int, []byte, error) {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return 0, nil, err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, s.baseURL+path, reader)
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("kbn-xsrf", "espoke")
+	if !s.loggedIn {
+		if err := s.creds.Apply(req); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	content, err := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, content, err
+}
+
+// expect runs a request and fails on any other status code than the expected ones
+func (s *kibanaSession) expect(ctx context.Context, method, path string, body interface{}, expected ...int) ([]byte, error) {
+	status, content, err := s.do(ctx, method, path, body)
+	if err != nil {
+		return nil, err
+	}
+	for _, code := range expected {
+		if status == code {
+			return content, nil
+		}
+	}
+	return nil, errors.Errorf("%s %s returned %d: %s", method, path, status, string(content))
+}
+
+// login opens a session with basic credentials. It is skipped when security is disabled or
+// when credentials are not a username and password.
+func (s *kibanaSession) login(ctx context.Context) error {
+	if s.creds.Auth != common.AuthBasic || s.creds.Username == "" {
+		return nil
+	}
+	body := map[string]interface{}{
+		"providerType": "basic",
+		"providerName": "basic",
+		"currentURL":   "/",
+		"params": map[string]string{
+			"username": s.creds.Username,
+			"password": s.creds.Password,
+		},
+	}
+	status, content, err := s.do(ctx, "POST", "/internal/security/login", body)
+	if err != nil {
+		return err
+	}
+	switch status {
+	case 200, 204:
+		s.loggedIn = true
+		return nil
+	case 404:
+		log.Debugf("Security is disabled on %s, skipping login", s.baseURL)
+		return nil
+	default:
+		return errors.Errorf("Login returned %d: %s", status, string(content))
+	}
+}
+
+// probeKibanaFunctional goes through what a user does with Kibana: log in, save an object,
+// read it back and search Elasticsearch through Kibana, then cleans up what it created
+func (kibana *KibanaProbe) probeKibanaFunctional(ctx context.Context, node *common.Node, creds common.Credentials) error {
+	httpClient, err := kibana.transports.Client("kibana", kibana.clusterName, node.Name)
+	if err != nil {
+		return err
+	}
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return err
+	}
+	session := &kibanaSession{
+		// Share the pooled transport but keep the session cookie to this run
+		client:  &http.Client{Transport: httpClient.Transport, Jar: jar},
+		baseURL: fmt.Sprintf("%v://%v:%v", node.Scheme, node.Ip, node.Port),
+		creds:   creds,
+	}
+	ctx, cancel := context.WithTimeout(ctx, kibana.scheduler.requestTimeout())
+	defer cancel()
+
+	// Objects are upserted under an id of this instance: other espoke instances probing the same
+	// Kibana do not touch them, and the ones a failed run left behind are overwritten by the next run
+	objectID := kibanaFunctionalObjectID()
+	objectPath := fmt.Sprintf("/api/saved_objects/index-pattern/%s", objectID)
+	tagPath := fmt.Sprintf("/api/saved_objects/tag/%s", objectID)
+	// The title changes on every run, so reading it back checks this run's write
+	nonce, err := newKibanaFunctionalNonce()
+	if err != nil {
+		return err
+	}
+	title := fmt.Sprintf("%s-%s-%s", kibana.config.KibanaFunctionalSearchIndex, objectID, nonce)
+	// Tags only exist from Kibana 7.10, the index pattern is saved without one before
+	version := kibana.nodeVersion(node.Name)
+	tagged := kibanaSupportsTags(version)
+	if !tagged {
+		log.Debugf("Kibana %s on %s (%s) does not support tags, saving an untagged object", version, kibana.clusterName, node.Name)
+	}
+
+	steps := map[string]func() error{
+		"login": func() error {
+			return session.login(ctx)
+		},
+		"save": func() error {
+			object := map[string]interface{}{
+				"attributes": map[string]string{
+					"title": title,
+				},
+			}
+			if tagged {
+				tag := map[string]interface{}{
+					"attributes": map[string]string{
+						"name":        objectID,
+						"description": "Created by the espoke functional probe, deleted at the end of its run",
+						"color":       "#6092C0",
+					},
+				}
+				if _, err := session.expect(ctx, "POST", tagPath+"?overwrite=true", tag, 200); err != nil {
+					return err
+				}
+				object["references"] = []map[string]string{
+					{"type": "tag", "id": objectID, "name": "tag-" + objectID},
+				}
+			}
+			_, err := session.expect(ctx, "POST", objectPath+"?overwrite=true", object, 200)
+			return err
+		},
+		"read": func() error {
+			content, err := session.expect(ctx, "GET", objectPath, nil, 200)
+			if err != nil {
+				return err
+			}
+			var object struct {
+				Attributes struct {
+					Title string `json:"title"`
+				} `json:"attributes"`
+			}
+			if err := json.Unmarshal(content, &object); err != nil {
+				return errors.Wrapf(err, "Failed to parse saved object")
+			}
+			if object.Attributes.Title != title {
+				return errors.Errorf("Saved object title is %q instead of %q", object.Attributes.Title, title)
+			}
+			return nil
+		},
+		"search": func() error {
+			query := url.Values{}
+			query.Set("path", fmt.Sprintf("%s/_search", kibana.config.KibanaFunctionalSearchIndex))
+			query.Set("method", "POST")
+			search := map[string]interface{}{
+				"size":  0,
+				"query": map[string]interface{}{"match_all": map[string]interface{}{}},
+			}
+			_, err := session.expect(ctx, "POST", "/api/console/proxy?"+query.Encode(), search, 200)
+			return err
+		},
+		"cleanup": func() error {
+			if _, err := session.expect(ctx, "DELETE", objectPath, nil, 200, 404); err != nil {
+				return err
+			}
+			if !tagged {
+				return nil
+			}
+			_, err := session.expect(ctx, "DELETE", tagPath, nil, 200, 404)
+			return err
+		},
+	}
+
+	var firstErr error
+	for _, step := range kibanaFunctionalSteps {
+		// Cleanup always runs, other steps are pointless once one failed
+		if firstErr != nil && step != "cleanup" {
+			kibana.metrics.KibanaFunctionalStepSuccessGauge.WithLabelValues(kibana.clusterName, step).Set(0)
+			continue
+		}
+		start := time.Now()
+		err := steps[step]()
+		durationMilliSec := float64(time.Since(start).Milliseconds())
+		if err != nil {
+			log.Errorf("Kibana functional probe step %s failed on %s (%s): %s", step, kibana.clusterName, node.Name, err.Error())
+			kibana.metrics.KibanaFunctionalStepSuccessGauge.WithLabelValues(kibana.clusterName, step).Set(0)
+			if firstErr == nil {
+				firstErr = errors.Wrapf(err, "Kibana functional probe step %s failed on %s", step, kibana.clusterName)
+			}
+			continue
+		}
+		kibana.metrics.KibanaFunctionalStepSuccessGauge.WithLabelValues(kibana.clusterName, step).Set(1)
+		kibana.metrics.KibanaFunctionalStepLatencySummary.WithLabelValues(kibana.clusterName, step).Observe(durationMilliSec)
+	}
+
+	if firstErr != nil {
+		kibana.metrics.KibanaFunctionalSuccessGauge.WithLabelValues(kibana.clusterName).Set(0)
+		return firstErr
+	}
+	kibana.metrics.KibanaFunctionalSuccessGauge.WithLabelValues(kibana.clusterName).Set(1)
+	return nil
+}
+
+// kibanaFunctionalObjectID returns the id of the saved objects of the functional probe, derived
+// from the host name so that it is stable across runs and restarts of an espoke instance
+func kibanaFunctionalObjectID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.Warningf("Unable to get the host name, sharing the functional probe objects with other instances: %s", err.Error())
+		hostname = "espoke"
+	}
+	hash := sha256.Sum256([]byte(hostname))
+	return kibanaFunctionalObjectPrefix + "-" + hex.EncodeToString(hash[:8])
+}
+
+// newKibanaFunctionalNonce returns a random value telling the object saved by a run apart
+func newKibanaFunctionalNonce() (string, error) {
+	random := make([]byte, 8)
+	if _, err := rand.Read(random); err != nil {
+		return "", errors.Wrap(err, "Failed to generate a saved object title")
+	}
+	return hex.EncodeToString(random), nil
+}
+
+// kibanaSupportsTags tells whether a Kibana version has saved object tags, added in 7.10. An
+// unknown version is assumed not to.
+func kibanaSupportsTags(version string) bool {
+	var major, minor int
+	if _, err := fmt.Sscanf(version, "%d.%d", &major, &minor); err != nil {
+		return false
+	}
+	return major > 7 || (major == 7 && minor >= 10)
+}
+
+// cleanKibanaFunctionalMetrics removes the functional probe metrics of a cluster
+func (kibana *KibanaProbe) cleanKibanaFunctionalMetrics(cluster string) {
+	kibana.metrics.KibanaFunctionalSuccessGauge.DeleteLabelValues(cluster)
+	for _, step := range kibanaFunctionalSteps {
+		kibana.metrics.KibanaFunctionalStepSuccessGauge.DeleteLabelValues(cluster, step)
+		kibana.metrics.KibanaFunctionalStepLatencySummary.DeleteLabelValues(cluster, step)
+	}
+}
@@ -0,0 +1,126 @@
+// GNU General Public License version 3
+
+package probe
+
+import (
+	"strings"
+
+	"github.com/criteo-forks/espoke/common"
+	"github.com/valyala/fastjson"
+)
+
+// Kibana status levels, legacy states (< 7.16) are mapped to their 8.x equivalent
+var kibanaStatusLevels = map[string]float64{
+	"available":   0,
+	"green":       0,
+	"degraded":    1,
+	"yellow":      1,
+	"unavailable": 2,
+	"red":         2,
+	"critical":    3,
+}
+
+const (
+	// kibanaDegradedStatusLevel is the highest level of a node still serving requests
+	kibanaDegradedStatusLevel = 1
+	kibanaUnknownStatusLevel  = 2
+)
+
+// kibanaStatus is the status reported by a Kibana node on /api/status
+type kibanaStatus struct {
+	version  string
+	overall  float64
+	services map[string]float64
+	plugins  map[string]float64
+}
+
+func kibanaStatusLevel(state string) float64 {
+	level, ok := kibanaStatusLevels[strings.ToLower(state)]
+	if !ok {
+		return kibanaUnknownStatusLevel
+	}
+	return level
+}
+
+// parseKibanaStatus reads both the 8.x format (status.overall.level, status.core, status.plugins)
+// and the legacy one (status.overall.state, status.statuses)
+func parseKibanaStatus(json *fastjson.Value) kibanaStatus {
+	status := kibanaStatus{
+		version:  string(json.GetStringBytes("version", "number")),
+		services: make(map[string]float64),
+		plugins:  make(map[string]float64),
+	}
+
+	if json.Exists("status", "overall", "level") {
+		status.overall = kibanaStatusLevel(string(json.GetStringBytes("status", "overall", "level")))
+		if core := json.GetObject("status", "core"); core != nil {
+			core.Visit(func(key []byte, v *fastjson.Value) {
+				status.services[string(key)] = kibanaStatusLevel(string(v.GetStringBytes("level")))
+			})
+		}
+		if plugins := json.GetObject("status", "plugins"); plugins != nil {
+			plugins.Visit(func(key []byte, v *fastjson.Value) {
+				status.plugins[string(key)] = kibanaStatusLevel(string(v.GetStringBytes("level")))
+			})
+		}
+		return status
+	}
+
+	status.overall = kibanaStatusLevel(string(json.GetStringBytes("status", "overall", "state")))
+	for _, entry := range json.GetArray("status", "statuses") {
+		// Ids look like "plugin:security@7.10.2" or "core:elasticsearch@7.10.2"
+		id := strings.SplitN(string(entry.GetStringBytes("id")), "@", 2)[0]
+		kindAndName := strings.SplitN(id, ":", 2)
+		if len(kindAndName) != 2 {
+			continue
+		}
+		level := kibanaStatusLevel(string(entry.GetStringBytes("state")))
+		if kindAndName[0] == "core" {
+			status.services[kindAndName[1]] = level
+		} else {
+			status.plugins[kindAndName[1]] = level
+		}
+	}
+	return status
+}
+
+// exportKibanaStatus sets the status metrics of a node and removes the ones of services,
+// plugins or version it no longer reports
+func (kibana *KibanaProbe) exportKibanaStatus(node *common.Node, status kibanaStatus, previous *kibanaStatus) {
+	if previous != nil {
+		if previous.version != status.version {
+			kibana.metrics.KibanaNodeInfoGauge.DeleteLabelValues(node.Cluster, node.Name, previous.version)
+		}
+		for service := range previous.services {
+			if _, ok := status.services[service]; !ok {
+				kibana.metrics.KibanaNodeServiceStatusGauge.DeleteLabelValues(node.Cluster, node.Name, service)
+			}
+		}
+		for plugin := range previous.plugins {
+			if _, ok := status.plugins[plugin]; !ok {
+				kibana.metrics.KibanaNodePluginStatusGauge.DeleteLabelValues(node.Cluster, node.Name, plugin)
+			}
+		}
+	}
+
+	kibana.metrics.KibanaNodeInfoGauge.WithLabelValues(node.Cluster, node.Name, status.version).Set(1)
+	kibana.metrics.KibanaNodeStatusGauge.WithLabelValues(node.Cluster, node.Name).Set(status.overall)
+	for service, level := range status.services {
+		kibana.metrics.KibanaNodeServiceStatusGauge.WithLabelValues(node.Cluster, node.Name, service).Set(level)
+	}
+	for plugin, level := range status.plugins {
+		kibana.metrics.KibanaNodePluginStatusGauge.WithLabelValues(node.Cluster, node.Name, plugin).Set(level)
+	}
+}
+
+// cleanKibanaStatusMetrics removes every status metric of a node
+func (kibana *KibanaProbe) cleanKibanaStatusMetrics(cluster, nodeName string, status kibanaStatus) {
+	kibana.metrics.KibanaNodeInfoGauge.DeleteLabelValues(cluster, nodeName, status.version)
+	kibana.metrics.KibanaNodeStatusGauge.DeleteLabelValues(cluster, nodeName)
+	for service := range status.services {
+		kibana.metrics.KibanaNodeServiceStatusGauge.DeleteLabelValues(cluster, nodeName, service)
+	}
+	for plugin := range status.plugins {
+		kibana.metrics.KibanaNodePluginStatusGauge.DeleteLabelValues(cluster, nodeName, plugin)
+	}
+}
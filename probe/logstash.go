@@ -0,0 +1,302 @@
+// GNU General Public License version 3
+
+package probe
+
+import (
+	"context"
+	"fmt"
+	"github.com/criteo-forks/espoke/common"
+	"github.com/hashicorp/consul/api"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/valyala/fastjson"
+)
+
+var logstashKind = Kind{
+	Name: "logstash",
+	ConsulTag: func(config *common.Config) string {
+		return config.LogstashConsulTag
+	},
+	New: func(clusterName string, clusterConfig common.Cluster, deps Dependencies) (Probe, error) {
+		return NewLogstashProbe(clusterName, clusterConfig, deps.Config, deps.ConsulClient, deps.Transports, deps.Metrics)
+	},
+}
+
+type LogstashProbe struct {
+	clusterName   string
+	clusterConfig common.Cluster
+	config        *common.Config
+	transports    *common.Transports
+	metrics       *common.Metrics
+
+	consulClient *api.Client
+
+	heartbeat *Heartbeat
+	scheduler *scheduler
+
+	// mu guards the nodes lists and pipelines, updated and read by operations running concurrently
+	mu                        sync.RWMutex
+	logstashNodesList         []common.Node
+	allEverKnownLogstashNodes []string
+	logstashNodesPipelines    map[string][]string
+}
+
+// logstashPipelineStats is what espoke exports of a pipeline reported by /_node/stats
+type logstashPipelineStats struct {
+	eventsIn       float64
+	eventsOut      float64
+	eventsFiltered float64
+	queueEvents    float64
+	reloadFailures float64
+	workers        float64
+}
+
+func NewLogstashProbe(clusterName string, clusterConfig common.Cluster, config *common.Config, consulClient *api.Client, transports *common.Transports, metrics *common.Metrics) (*LogstashProbe, error) {
+	var allEverKnownLogstashNodes []string
+	logstashNodesList, err := common.DiscoverNodesForService(consulClient, clusterConfig.Name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Impossible to discover logstash nodes during bootstrap for cluster %s", clusterName)
+	}
+	allEverKnownLogstashNodes = common.UpdateEverKnownNodes(allEverKnownLogstashNodes, logstashNodesList)
+	heartbeat := newHeartbeat(clusterName, metrics, metrics.LogstashNodeAvailabilityGauge)
+	heartbeat.setNodes(logstashNodesList)
+
+	logstash := &LogstashProbe{
+		clusterName:   clusterName,
+		clusterConfig: clusterConfig,
+		config:        config,
+		transports:    transports,
+		metrics:       metrics,
+
+		consulClient: consulClient,
+
+		heartbeat: heartbeat,
+
+		logstashNodesList:         logstashNodesList,
+		allEverKnownLogstashNodes: allEverKnownLogstashNodes,
+		logstashNodesPipelines:    make(map[string][]string),
+	}
+
+	logstash.scheduler = newScheduler(clusterName, heartbeat, config, metrics)
+	logstash.scheduler.add("logstash_discovery", consulPeriod, OverlapQueue, logstash.updateNodes)
+	logstash.scheduler.add("logstash_nodes", probePeriod, OverlapSkip, logstash.probeNodes)
+	logstash.scheduler.add("logstash_cleaning", cleaningPeriod, OverlapQueue, logstash.cleanMetrics)
+	return logstash, nil
+}
+
+func (logstash *LogstashProbe) Name() string {
+	return logstash.clusterName
+}
+
+func (logstash *LogstashProbe) Cluster() common.Cluster {
+	return logstash.clusterConfig
+}
+
+func (logstash *LogstashProbe) Heartbeat() *Heartbeat {
+	return logstash.heartbeat
+}
+
+func (logstash *LogstashProbe) Trigger(operation string) error {
+	return logstash.scheduler.trigger(operation)
+}
+
+func (logstash *LogstashProbe) Reschedule(config *common.Config) {
+	logstash.scheduler.reschedule(config)
+}
+
+// nodes returns the current and ever known nodes of the cluster
+func (logstash *LogstashProbe) nodes() ([]common.Node, []string) {
+	logstash.mu.RLock()
+	defer logstash.mu.RUnlock()
+	return logstash.logstashNodesList, logstash.allEverKnownLogstashNodes
+}
+
+// Prepare has nothing to set up on logstash clusters
+func (logstash *LogstashProbe) Prepare(ctx context.Context) error {
+	return nil
+}
+
+func (logstash *LogstashProbe) Start(ctx context.Context) error {
+	logstash.scheduler.run(ctx)
+
+	log.Infof("Terminating logstash probe on %s", logstash.clusterName)
+	logstash.scheduler.clean()
+	logstash.heartbeat.clean()
+	nodes, allEverKnownNodes := logstash.nodes()
+	logstash.metrics.CleanNodeMetrics("logstash", nodes, allEverKnownNodes)
+	logstash.cleanNodesPipelines(nil)
+	logstash.metrics.LogstashClusterErrorsCount.DeleteLabelValues(logstash.clusterName)
+	logstash.transports.Close("logstash", logstash.clusterName)
+	return nil
+}
+
+// updateNodes refreshes the nodes of the cluster from consul
+func (logstash *LogstashProbe) updateNodes(ctx context.Context) error {
+	log.Debugf("Starting updating Logstash nodes list on cluster %s", logstash.clusterName)
+	updatedList, err := common.DiscoverNodesForService(logstash.consulClient, logstash.clusterConfig.Name)
+	if err != nil {
+		log.Error("Unable to update Logstash nodes, using last known state:", err)
+		logstash.metrics.ErrorsCount.Inc()
+		return err
+	}
+
+	log.Infof("Updating logstash nodes list on cluster %s", logstash.clusterName)
+	logstash.mu.Lock()
+	logstash.allEverKnownLogstashNodes = common.UpdateEverKnownNodes(logstash.allEverKnownLogstashNodes, updatedList)
+	logstash.logstashNodesList = updatedList
+	logstash.mu.Unlock()
+	logstash.heartbeat.setNodes(updatedList)
+	return nil
+}
+
+// cleanMetrics removes the metrics of vanished nodes
+func (logstash *LogstashProbe) cleanMetrics(ctx context.Context) error {
+	log.Infof("Cleaning Prometheus metrics for unreferenced nodes on cluster %s", logstash.clusterName)
+	nodes, allEverKnownNodes := logstash.nodes()
+	logstash.metrics.CleanNodeMetrics("logstash", nodes, allEverKnownNodes)
+	logstash.transports.Retain("logstash", logstash.clusterName, nodeNames(nodes))
+	logstash.cleanNodesPipelines(nodes)
+	return nil
+}
+
+// probeNodes checks the availability and pipelines of every node
+func (logstash *LogstashProbe) probeNodes(ctx context.Context) error {
+	log.Debugf("Starting probing Logstash nodes on cluster %s", logstash.clusterName)
+
+	sem := new(probeGroup)
+	nodes, _ := logstash.nodes()
+	pipelines := make([]map[string]logstashPipelineStats, len(nodes))
+	for i, node := range nodes {
+		i, logstashNode := i, node
+		sem.Go(func() {
+			stats, err := logstash.probeLogstashNode(ctx, &logstashNode)
+			if err != nil {
+				log.Errorf("Failed on %s: %s", logstash.clusterName, err.Error())
+				logstash.metrics.LogstashNodeAvailabilityGauge.WithLabelValues(logstashNode.Cluster, logstashNode.Name).Set(0)
+				logstash.metrics.LogstashClusterErrorsCount.WithLabelValues(logstash.clusterName).Inc()
+				sem.fail(err)
+				return
+			}
+			pipelines[i] = stats
+		})
+	}
+	err := sem.Wait()
+	logstash.updateNodesPipelines(nodes, pipelines)
+	return err
+}
+
+// getNodeAPI calls the monitoring API of a node and parses its response
+func (logstash *LogstashProbe) getNodeAPI(ctx context.Context, client *http.Client, node *common.Node, path string) (*fastjson.Value, error) {
+	probingURL := fmt.Sprintf("%v://%v:%v%v", node.Scheme, node.Ip, node.Port, path)
+	req, err := http.NewRequestWithContext(ctx, "GET", probingURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Debug("Probing failed for ", node.Name, ": ", probingURL, " ", err.Error())
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	log.Debug("Probe result for ", node.Name, ": ", resp.Status)
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("logstash Probing failed for %s: %s %s", node.Name, probingURL, resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("logstash Probing failed for %s: %s", node.Name, err)
+	}
+	json, err := fastjson.ParseBytes(body)
+	if err != nil {
+		return nil, fmt.Errorf("logstash Probing failed for %s: %s", node.Name, err)
+	}
+	return json, nil
+}
+
+func (logstash *LogstashProbe) probeLogstashNode(ctx context.Context, node *common.Node) (map[string]logstashPipelineStats, error) {
+	client, err := logstash.transports.Client("logstash", logstash.clusterName, node.Name)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, logstash.scheduler.requestTimeout())
+	defer cancel()
+	log.Debug("Start probing ", node.Name)
+
+	stats, err := logstash.getNodeAPI(ctx, client, node, "/_node/stats")
+	if err != nil {
+		return nil, err
+	}
+	pipelinesInfo, err := logstash.getNodeAPI(ctx, client, node, "/_node/pipelines")
+	if err != nil {
+		return nil, err
+	}
+
+	pipelines := make(map[string]logstashPipelineStats)
+	if statsPipelines := stats.GetObject("pipelines"); statsPipelines != nil {
+		statsPipelines.Visit(func(key []byte, v *fastjson.Value) {
+			queueEvents := v.GetFloat64("queue", "events_count")
+			if !v.Exists("queue", "events_count") {
+				// Before 7.x the queue depth was reported as queue.events
+				queueEvents = v.GetFloat64("queue", "events")
+			}
+			pipelines[string(key)] = logstashPipelineStats{
+				eventsIn:       v.GetFloat64("events", "in"),
+				eventsOut:      v.GetFloat64("events", "out"),
+				eventsFiltered: v.GetFloat64("events", "filtered"),
+				queueEvents:    queueEvents,
+				reloadFailures: v.GetFloat64("reloads", "failures"),
+				workers:        pipelinesInfo.GetFloat64("pipelines", string(key), "workers"),
+			}
+		})
+	}
+
+	logstash.metrics.LogstashNodeAvailabilityGauge.WithLabelValues(node.Cluster, node.Name).Set(1)
+	return pipelines, nil
+}
+
+// updateNodesPipelines exports the pipelines stats of nodes and removes the ones of vanished pipelines
+func (logstash *LogstashProbe) updateNodesPipelines(nodes []common.Node, pipelines []map[string]logstashPipelineStats) {
+	logstash.mu.Lock()
+	defer logstash.mu.Unlock()
+	for i, node := range nodes {
+		if pipelines[i] == nil {
+			continue
+		}
+		var names []string
+		for pipeline, stats := range pipelines[i] {
+			names = append(names, pipeline)
+			logstash.metrics.LogstashPipelineEventsGauge.WithLabelValues(node.Cluster, node.Name, pipeline, "in").Set(stats.eventsIn)
+			logstash.metrics.LogstashPipelineEventsGauge.WithLabelValues(node.Cluster, node.Name, pipeline, "out").Set(stats.eventsOut)
+			logstash.metrics.LogstashPipelineEventsGauge.WithLabelValues(node.Cluster, node.Name, pipeline, "filtered").Set(stats.eventsFiltered)
+			logstash.metrics.LogstashPipelineQueueEventsGauge.WithLabelValues(node.Cluster, node.Name, pipeline).Set(stats.queueEvents)
+			logstash.metrics.LogstashPipelineReloadFailuresGauge.WithLabelValues(node.Cluster, node.Name, pipeline).Set(stats.reloadFailures)
+			logstash.metrics.LogstashPipelineWorkersGauge.WithLabelValues(node.Cluster, node.Name, pipeline).Set(stats.workers)
+		}
+		for _, pipeline := range logstash.logstashNodesPipelines[node.Name] {
+			if !stringInSlice(pipeline, names) {
+				logstash.metrics.CleanLogstashPipelineMetrics(node.Cluster, node.Name, pipeline)
+			}
+		}
+		logstash.logstashNodesPipelines[node.Name] = names
+	}
+}
+
+// cleanNodesPipelines removes the pipelines metrics of nodes not in nodes
+func (logstash *LogstashProbe) cleanNodesPipelines(nodes []common.Node) {
+	logstash.mu.Lock()
+	defer logstash.mu.Unlock()
+	names := nodeNames(nodes)
+	for name, pipelines := range logstash.logstashNodesPipelines {
+		if !stringInSlice(name, names) {
+			for _, pipeline := range pipelines {
+				logstash.metrics.CleanLogstashPipelineMetrics(logstash.clusterName, name, pipeline)
+			}
+			delete(logstash.logstashNodesPipelines, name)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+// GNU General Public License version 3
+
+package probe
+
+import (
+	"context"
+
+	"github.com/criteo-forks/espoke/common"
+	"github.com/hashicorp/consul/api"
+)
+
+// Probe probes a single cluster discovered in consul
+type Probe interface {
+	// Name returns the name of the probed cluster
+	Name() string
+	// Cluster returns the cluster as discovered in consul
+	Cluster() common.Cluster
+	// Heartbeat returns when the probing operations last ran
+	Heartbeat() *Heartbeat
+	// Prepare is called once before probing starts
+	Prepare(ctx context.Context) error
+	// Start probes the cluster until ctx is cancelled, then removes the cluster metrics before
+	// returning
+	Start(ctx context.Context) error
+	// Trigger requests an immediate run of a probing operation
+	Trigger(operation string) error
+	// Reschedule applies the scheduling settings of config (intervals, jitter and overlap
+	// policies) to the running probing operations
+	Reschedule(config *common.Config)
+}
+
+// Dependencies are the shared objects probes are created with
+type Dependencies struct {
+	Config       *common.Config
+	ConsulClient *api.Client
+	Transports   *common.Transports
+	Credentials  common.CredentialsProvider
+	Metrics      *common.Metrics
+}
+
+// Factory creates the probe of a cluster discovered in consul
+type Factory func(clusterName string, clusterConfig common.Cluster, deps Dependencies) (Probe, error)
+
+// Kind is a type of service espoke knows how to probe
+type Kind struct {
+	Name string
+	// ConsulTag returns the tag services of this kind are registered with in consul
+	ConsulTag func(config *common.Config) string
+	// Credentials returns the credentials source spec and the default credentials of this
+	// kind, nil when the service does not need any
+	Credentials func(config *common.Config) (string, common.Credentials)
+	New         Factory
+}
+
+var kinds []Kind
+
+// RegisterKind adds a kind of service to the ones watched in consul
+func RegisterKind(kind Kind) {
+	kinds = append(kinds, kind)
+}
+
+// Kinds returns the registered kinds of service, in registration order
+func Kinds() []Kind {
+	return kinds
+}
+
+func init() {
+	RegisterKind(elasticsearchKind)
+	RegisterKind(kibanaKind)
+	RegisterKind(logstashKind)
+}
@@ -0,0 +1,323 @@
+// GNU General Public License version 3
+
+package probe
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/criteo-forks/espoke/common"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// What to do when an operation is due while its previous run is not over
+const (
+	// OverlapSkip drops the new run
+	OverlapSkip = "skip"
+	// OverlapQueue runs it once the previous run is over, at most one run is queued
+	OverlapQueue = "queue"
+	// OverlapCancel cancels the previous run and starts a new one once it returned
+	OverlapCancel = "cancel"
+)
+
+// Periods of the configuration operations are scheduled with
+func consulPeriod(config *common.Config) time.Duration   { return config.ConsulPeriod }
+func probePeriod(config *common.Config) time.Duration    { return config.ProbePeriod }
+func cleaningPeriod(config *common.Config) time.Duration { return config.CleaningPeriod }
+
+func requestTimeout(config *common.Config) time.Duration {
+	return config.ProbePeriod - 2*time.Second
+}
+
+// operation is a probing operation run periodically by a scheduler
+type operation struct {
+	name string
+	// period returns the interval of the operation from the configuration
+	period func(config *common.Config) time.Duration
+	// defaultPolicy applies unless the configuration sets another one
+	defaultPolicy string
+	// run returns the error which made the run fail, if any
+	run func(ctx context.Context) error
+	// trigger requests an immediate run, reset a new schedule after the interval changed
+	trigger chan struct{}
+	reset   chan struct{}
+
+	// interval and policy are guarded by the scheduler mu as they change on reschedule
+	interval time.Duration
+	policy   string
+}
+
+// scheduler runs every operation of a probe on its own schedule, so that a slow operation does not
+// delay the others
+type scheduler struct {
+	cluster    string
+	heartbeat  *Heartbeat
+	config     *common.Config
+	metrics    *common.Metrics
+	operations []*operation
+
+	// mu guards jitter, timeout and the interval and policy of operations
+	mu     sync.Mutex
+	jitter float64
+	// timeout bounds requests to nodes, shorter than the probe period so that runs do not overlap
+	timeout time.Duration
+
+	wg sync.WaitGroup
+}
+
+func newScheduler(cluster string, heartbeat *Heartbeat, config *common.Config, metrics *common.Metrics) *scheduler {
+	return &scheduler{
+		cluster:   cluster,
+		heartbeat: heartbeat,
+		config:    config,
+		metrics:   metrics,
+		jitter:    config.ProbeJitter,
+		timeout:   requestTimeout(config),
+	}
+}
+
+// add schedules an operation every period of the configuration, its overlap policy is taken from
+// the configuration when set there
+func (s *scheduler) add(name string, period func(config *common.Config) time.Duration, policy string, run func(ctx context.Context) error) {
+	op := &operation{
+		name:          name,
+		period:        period,
+		defaultPolicy: policy,
+		run:           run,
+		trigger:       make(chan struct{}, 1),
+		reset:         make(chan struct{}, 1),
+	}
+	op.interval, op.policy = op.settings(s.config)
+	s.operations = append(s.operations, op)
+}
+
+// settings returns the interval and overlap policy of the operation in config
+func (op *operation) settings(config *common.Config) (time.Duration, string) {
+	policy := op.defaultPolicy
+	if configured, ok := config.OverlapPolicies[op.name]; ok {
+		policy = configured
+	}
+	return op.period(config), policy
+}
+
+// reschedule applies the jitter, intervals and overlap policies of config to the operations. The
+// next run of an operation whose interval changed is scheduled a new interval from now.
+func (s *scheduler) reschedule(config *common.Config) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jitter = config.ProbeJitter
+	s.timeout = requestTimeout(config)
+	for _, op := range s.operations {
+		interval, policy := op.settings(config)
+		if policy != op.policy {
+			log.Infof("Overlap policy of %s on %s is now %s", op.name, s.cluster, policy)
+			op.policy = policy
+		}
+		if interval == op.interval {
+			continue
+		}
+		log.Infof("Interval of %s on %s is now %s", op.name, s.cluster, interval)
+		op.interval = interval
+		s.heartbeat.expect(op.name, interval)
+		select {
+		case op.reset <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// requestTimeout returns the timeout of requests to nodes
+func (s *scheduler) requestTimeout() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.timeout
+}
+
+// policy returns the current overlap policy of an operation
+func (s *scheduler) policy(op *operation) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return op.policy
+}
+
+// trigger requests an immediate run of an operation, its overlap policy applies when it is running
+func (s *scheduler) trigger(name string) error {
+	var names []string
+	for _, op := range s.operations {
+		if op.name == name {
+			select {
+			case op.trigger <- struct{}{}:
+			default:
+				// A run is already requested
+			}
+			return nil
+		}
+		names = append(names, op.name)
+	}
+	return errors.Errorf("unknown operation %s on %s, expected one of %s", name, s.cluster, strings.Join(names, ", "))
+}
+
+// run runs every operation until ctx is cancelled and waits for their runs to return. A panic in
+// an operation stops the others and is raised again.
+func (s *scheduler) run(ctx context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// Created on every run, so that the panics of operations stopped with a previous run are not
+	// raised by this one
+	panics := make(chan interface{}, 1)
+
+	s.mu.Lock()
+	for _, op := range s.operations {
+		s.heartbeat.expect(op.name, op.interval)
+	}
+	s.mu.Unlock()
+	for _, op := range s.operations {
+		s.wg.Add(1)
+		go s.schedule(ctx, op, panics)
+	}
+
+	var panicked interface{}
+	select {
+	case <-ctx.Done():
+	case panicked = <-panics:
+		cancel()
+	}
+	s.wg.Wait()
+	if panicked != nil {
+		panic(panicked)
+	}
+}
+
+// next returns the interval of an operation with a random jitter
+func (s *scheduler) next(op *operation) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.jitter <= 0 {
+		return op.interval
+	}
+	jitter := (rand.Float64()*2 - 1) * s.jitter * float64(op.interval)
+	return op.interval + time.Duration(jitter)
+}
+
+func (s *scheduler) schedule(ctx context.Context, op *operation, panics chan<- interface{}) {
+	defer s.wg.Done()
+
+	var (
+		running   bool
+		queued    bool
+		cancelRun context.CancelFunc
+		finished  = make(chan struct{}, 1)
+	)
+	start := func() {
+		runCtx, cancel := context.WithCancel(ctx)
+		cancelRun = cancel
+		running = true
+		s.heartbeat.beat(op.name)
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer func() { finished <- struct{}{} }()
+			defer forwardPanic(panics)
+			defer cancel()
+			started := time.Now()
+			// err is left set when the operation panics
+			err := errors.New("the operation panicked")
+			defer func() { s.heartbeat.finish(op.name, time.Since(started), err) }()
+			err = op.run(runCtx)
+		}()
+	}
+	skip := func() {
+		log.Debugf("Skipping %s on %s, its previous run is not over", op.name, s.cluster)
+		s.metrics.ProbeSkippedRunsCount.WithLabelValues(s.cluster, op.name, s.policy(op)).Inc()
+	}
+
+	// due starts a run or applies the overlap policy, it returns false when ctx is cancelled
+	due := func() bool {
+		if !running {
+			start()
+			return true
+		}
+		switch s.policy(op) {
+		case OverlapQueue:
+			if queued {
+				skip()
+			}
+			queued = true
+		case OverlapCancel:
+			skip()
+			cancelRun()
+			// Wait for the previous run to return before starting the new one
+			select {
+			case <-ctx.Done():
+				return false
+			case <-finished:
+			}
+			start()
+		default:
+			skip()
+		}
+		return true
+	}
+
+	timer := time.NewTimer(s.next(op))
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-finished:
+			running = false
+			if queued {
+				queued = false
+				start()
+			}
+
+		case <-timer.C:
+			timer.Reset(s.next(op))
+			if !due() {
+				return
+			}
+
+		case <-op.reset:
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(s.next(op))
+
+		case <-op.trigger:
+			log.Infof("Running %s on %s on request", op.name, s.cluster)
+			if !due() {
+				return
+			}
+		}
+	}
+}
+
+// forwardPanic forwards a panic of an operation to run, only the first one of a run is raised
+func forwardPanic(panics chan<- interface{}) {
+	if r := recover(); r != nil {
+		select {
+		case panics <- fmt.Sprintf("%v\n%s", r, debug.Stack()):
+		default:
+		}
+	}
+}
+
+// clean removes the scheduler metrics of the probe
+func (s *scheduler) clean() {
+	for _, op := range s.operations {
+		for _, policy := range []string{OverlapSkip, OverlapQueue, OverlapCancel} {
+			s.metrics.ProbeSkippedRunsCount.DeleteLabelValues(s.cluster, op.name, policy)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+// GNU General Public License version 3
+
+package probe
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/criteo-forks/espoke/common"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// overlapCounter records how many runs of an operation are in progress at once
+type overlapCounter struct {
+	running int32
+	max     int32
+	runs    int32
+}
+
+func (c *overlapCounter) run(ctx context.Context) error {
+	running := atomic.AddInt32(&c.running, 1)
+	defer atomic.AddInt32(&c.running, -1)
+	atomic.AddInt32(&c.runs, 1)
+	for {
+		max := atomic.LoadInt32(&c.max)
+		if running <= max || atomic.CompareAndSwapInt32(&c.max, max, running) {
+			break
+		}
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Millisecond):
+	}
+	return nil
+}
+
+func TestSchedulerConcurrentHeartbeatAndTrigger(t *testing.T) {
+	config := &common.Config{ProbePeriod: 20 * time.Second, ProbeJitter: 0.1}
+	fast := func(config *common.Config) time.Duration { return 10 * time.Millisecond }
+	slow := func(config *common.Config) time.Duration { return time.Hour }
+
+	metrics := common.NewMetrics(prometheus.NewRegistry())
+	heartbeat := newHeartbeat("cluster", metrics, metrics.ElasticNodeAvailabilityGauge)
+	s := newScheduler("cluster", heartbeat, config, metrics)
+	counters := map[string]*overlapCounter{}
+	for name, policy := range map[string]string{"skip": OverlapSkip, "queue": OverlapQueue, "cancel": OverlapCancel} {
+		counters[name] = &overlapCounter{}
+		s.add(name, fast, policy, counters[name].run)
+	}
+	counters["triggered"] = &overlapCounter{}
+	s.add("triggered", slow, OverlapSkip, counters["triggered"].run)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.run(ctx)
+	}()
+
+	var wg sync.WaitGroup
+	deadline := time.Now().Add(200 * time.Millisecond)
+	run := func(f func(i int)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; time.Now().Before(deadline); i++ {
+				f(i)
+				time.Sleep(time.Millisecond)
+			}
+		}()
+	}
+	run(func(i int) {
+		for name := range counters {
+			if err := s.trigger(name); err != nil {
+				t.Error(err)
+			}
+		}
+	})
+	run(func(i int) {
+		heartbeat.Operations()
+		heartbeat.Stale(3, time.Minute)
+		heartbeat.Check(3, time.Minute)
+		heartbeat.setNodes([]common.Node{{Name: "node", Cluster: "cluster"}})
+		heartbeat.MarkUnknown()
+		heartbeat.Nodes()
+	})
+	run(func(i int) {
+		rescheduled := *config
+		rescheduled.ProbeJitter = float64(i%5) / 10
+		rescheduled.OverlapPolicies = map[string]string{"triggered": []string{OverlapSkip, OverlapQueue, OverlapCancel}[i%3]}
+		s.reschedule(&rescheduled)
+		s.requestTimeout()
+	})
+	wg.Wait()
+	if err := s.trigger("unknown"); err == nil {
+		t.Error("triggering an unknown operation succeeded")
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the scheduler did not return once cancelled")
+	}
+
+	operations := heartbeat.Operations()
+	for name, counter := range counters {
+		runs, max := atomic.LoadInt32(&counter.runs), atomic.LoadInt32(&counter.max)
+		if runs == 0 {
+			t.Errorf("%s never ran", name)
+		}
+		if max > 1 {
+			t.Errorf("%d runs of %s overlapped", max, name)
+		}
+		if operations[name].Runs != int(runs) {
+			t.Errorf("heartbeat recorded %d runs of %s, expected %d", operations[name].Runs, name, runs)
+		}
+		if operations[name].Running {
+			t.Errorf("%s is still running once the scheduler returned", name)
+		}
+	}
+}
+
+func TestSchedulerRestartAfterPanics(t *testing.T) {
+	config := &common.Config{ProbePeriod: 20 * time.Second}
+	fast := func(config *common.Config) time.Duration { return time.Millisecond }
+
+	metrics := common.NewMetrics(prometheus.NewRegistry())
+	heartbeat := newHeartbeat("cluster", metrics, metrics.ElasticNodeAvailabilityGauge)
+	s := newScheduler("cluster", heartbeat, config, metrics)
+
+	// Both operations panic together on the first run of the scheduler only
+	var panicking int32 = 1
+	var started sync.WaitGroup
+	started.Add(2)
+	var runs int32
+	for _, name := range []string{"first", "second"} {
+		var once sync.Once
+		s.add(name, fast, OverlapSkip, func(ctx context.Context) error {
+			if atomic.LoadInt32(&panicking) == 0 {
+				atomic.AddInt32(&runs, 1)
+				return nil
+			}
+			once.Do(started.Done)
+			started.Wait()
+			panic("operation failed")
+		})
+	}
+
+	run := func() (panicked interface{}) {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		defer func() { panicked = recover() }()
+		s.run(ctx)
+		return nil
+	}
+	if run() == nil {
+		t.Fatal("the panic of an operation was not raised")
+	}
+	for name, operation := range heartbeat.Operations() {
+		if operation.LastSucceeded == nil || *operation.LastSucceeded || operation.LastError == "" {
+			t.Errorf("the panic of %s is not recorded as a failed run: %+v", name, operation)
+		}
+	}
+	atomic.StoreInt32(&panicking, 0)
+	if panicked := run(); panicked != nil {
+		t.Fatalf("a restarted scheduler raised a panic of its previous run: %v", panicked)
+	}
+	if atomic.LoadInt32(&runs) == 0 {
+		t.Error("no operation ran once the scheduler restarted")
+	}
+}
+
+func TestSchedulerRecordsRunResults(t *testing.T) {
+	config := &common.Config{ProbePeriod: 20 * time.Second}
+	slow := func(config *common.Config) time.Duration { return time.Hour }
+
+	metrics := common.NewMetrics(prometheus.NewRegistry())
+	heartbeat := newHeartbeat("cluster", metrics, metrics.ElasticNodeAvailabilityGauge)
+	s := newScheduler("cluster", heartbeat, config, metrics)
+	var failing int32 = 1
+	done := make(chan struct{}, 1)
+	s.add("flaky", slow, OverlapQueue, func(ctx context.Context) error {
+		defer func() { done <- struct{}{} }()
+		if atomic.LoadInt32(&failing) == 1 {
+			return errors.New("node unreachable")
+		}
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		s.run(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-stopped
+	}()
+
+	// finish is recorded right after the operation returned
+	result := func() OperationStatus {
+		<-done
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			operation := heartbeat.Operations()["flaky"]
+			if !operation.Running || time.Now().After(deadline) {
+				return operation
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	if operation := heartbeat.Operations()["flaky"]; operation.LastSucceeded != nil {
+		t.Errorf("an operation which never ran has a result: %+v", operation)
+	}
+	if err := s.trigger("flaky"); err != nil {
+		t.Fatal(err)
+	}
+	if operation := result(); operation.LastSucceeded == nil || *operation.LastSucceeded || operation.LastError != "node unreachable" {
+		t.Errorf("the failed run is not recorded: %+v", operation)
+	}
+	atomic.StoreInt32(&failing, 0)
+	if err := s.trigger("flaky"); err != nil {
+		t.Fatal(err)
+	}
+	if operation := result(); operation.LastSucceeded == nil || !*operation.LastSucceeded || operation.LastError != "" {
+		t.Errorf("the successful run is not recorded: %+v", operation)
+	}
+}
@@ -0,0 +1,121 @@
+// GNU General Public License version 3
+
+package watcher
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// AdminPathPrefix is the path the admin API is served under
+const AdminPathPrefix = "/api/"
+
+// apiError is an error answered by the admin API with a given status, other errors are
+// internal server errors
+type apiError struct {
+	status int
+	msg    string
+}
+
+func newAPIError(status int, format string, args ...interface{}) error {
+	return &apiError{status: status, msg: fmt.Sprintf(format, args...)}
+}
+
+func (e *apiError) Error() string {
+	return e.msg
+}
+
+// AdminHandler serves the admin API:
+//
+//	GET  /api/clusters                                      watched clusters
+//	GET  /api/clusters/{service}/{cluster}                  a single cluster
+//	POST /api/clusters/{service}/{cluster}/run?probe={op}   runs a probing operation now
+//	POST /api/clusters/{service}/{cluster}/pause            pauses probing the cluster
+//	POST /api/clusters/{service}/{cluster}/resume           resumes probing the cluster
+func (w *Watcher) AdminHandler() http.Handler {
+	return http.HandlerFunc(w.serveAdmin)
+}
+
+func (w *Watcher) serveAdmin(rw http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, AdminPathPrefix), "/"), "/")
+	if parts[0] != "clusters" {
+		writeAdminError(rw, newAPIError(http.StatusNotFound, "unknown path %s", r.URL.Path))
+		return
+	}
+
+	switch {
+	case len(parts) == 1:
+		if !allowMethod(rw, r, http.MethodGet) {
+			return
+		}
+		writeJSON(rw, http.StatusOK, w.Snapshot())
+
+	case len(parts) == 3:
+		if !allowMethod(rw, r, http.MethodGet) {
+			return
+		}
+		for _, snapshot := range w.Snapshot() {
+			if snapshot.Service == parts[1] && snapshot.Cluster == parts[2] {
+				writeJSON(rw, http.StatusOK, snapshot)
+				return
+			}
+		}
+		writeAdminError(rw, newAPIError(http.StatusNotFound, "unknown cluster %s %s", parts[1], parts[2]))
+
+	case len(parts) == 4:
+		if !allowMethod(rw, r, http.MethodPost) {
+			return
+		}
+		service, cluster := parts[1], parts[2]
+		var err error
+		switch parts[3] {
+		case "run":
+			err = w.Trigger(service, cluster, r.URL.Query().Get("probe"))
+		case "pause":
+			err = w.Pause(service, cluster)
+		case "resume":
+			err = w.Resume(service, cluster)
+		default:
+			err = newAPIError(http.StatusNotFound, "unknown action %s", parts[3])
+		}
+		if err != nil {
+			writeAdminError(rw, err)
+			return
+		}
+		writeJSON(rw, http.StatusAccepted, map[string]string{"status": "ok"})
+
+	default:
+		writeAdminError(rw, newAPIError(http.StatusNotFound, "unknown path %s", r.URL.Path))
+	}
+}
+
+func allowMethod(rw http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	rw.Header().Set("Allow", method)
+	writeAdminError(rw, newAPIError(http.StatusMethodNotAllowed, "method %s not allowed", r.Method))
+	return false
+}
+
+func writeAdminError(rw http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if e, ok := err.(*apiError); ok {
+		status = e.status
+	} else {
+		log.Error(err)
+	}
+	writeJSON(rw, status, map[string]string{"error": err.Error()})
+}
+
+func writeJSON(rw http.ResponseWriter, status int, body interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	if err := json.NewEncoder(rw).Encode(body); err != nil {
+		log.Error("Failed to write admin API response: ", err)
+	}
+}
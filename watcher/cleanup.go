@@ -0,0 +1,98 @@
+// GNU General Public License version 3
+
+package watcher
+
+import (
+	"context"
+	"time"
+
+	"github.com/criteo-forks/espoke/common"
+	"github.com/criteo-forks/espoke/probe"
+	log "github.com/sirupsen/logrus"
+)
+
+// removedCleanupTimeout is the time given to clean a cluster removed from consul once its probe
+// terminated
+const removedCleanupTimeout = time.Minute
+
+// pendingCleanup is the stopped probe of a cluster removed from consul, which is cleaned once the
+// cluster stayed out of consul for its grace period
+type pendingCleanup struct {
+	running *runningProbe
+	since   time.Time
+}
+
+// scheduleCleanup records that the cluster of a stopped probe left consul, it is cleaned by a later
+// discovery which confirms it
+func (w *Watcher) scheduleCleanup(kind, cluster string, running *runningProbe) {
+	log.Infof("Cleaning %s %s if it is still out of consul in %s", kind, cluster, running.config.ElasticsearchCleanupGracePeriod)
+	w.cleanups[kind][cluster] = &pendingCleanup{running: running, since: time.Now()}
+}
+
+// runPendingCleanups cleans the clusters out of the consul services for their grace period and
+// forgets the ones which are back
+func (w *Watcher) runPendingCleanups(kind string, services map[string]common.Cluster) {
+	for cluster, pending := range w.cleanups[kind] {
+		if _, ok := services[cluster]; ok {
+			log.Infof("%s %s is back in consul, not cleaning it", kind, cluster)
+			delete(w.cleanups[kind], cluster)
+			continue
+		}
+		if time.Since(pending.since) < pending.running.config.ElasticsearchCleanupGracePeriod {
+			continue
+		}
+		delete(w.cleanups[kind], cluster)
+		go cleanupRemoved(kind, cluster, pending.running)
+	}
+}
+
+// cleanupOnStop tells whether what a probe wrote to its cluster is removed when it stops because
+// the cluster was removed from consul, or because espoke stops
+func cleanupOnStop(running *runningProbe, shutdown bool) bool {
+	if _, ok := running.probe.(probe.Cleaner); !ok || running.config == nil {
+		return false
+	}
+	switch running.config.ElasticsearchCleanupOnStop {
+	case "always":
+		return true
+	case "removed":
+		return !shutdown
+	}
+	return false
+}
+
+// cleanupRemoved waits for the probe of a cluster removed from consul to terminate, then cleans
+// the cluster
+func cleanupRemoved(kind, cluster string, running *runningProbe) {
+	timeout := time.NewTimer(removedCleanupTimeout)
+	defer timeout.Stop()
+	select {
+	case <-running.done:
+	case <-timeout.C:
+		log.Warningf("Timeout waiting for %s probe on %s to terminate, not cleaning the cluster", kind, cluster)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), removedCleanupTimeout)
+	defer cancel()
+	cleanup(ctx, kind, cluster, running)
+}
+
+// cleanup removes the indices the probe created on the cluster, its probe must be terminated so
+// that it does not write to them again
+func cleanup(ctx context.Context, kind, cluster string, running *runningProbe) {
+	log.Infof("Cleaning %s %s", kind, cluster)
+	artifacts, err := running.probe.(probe.Cleaner).Cleanup(ctx, probe.CleanupOptions{})
+	if err != nil {
+		log.Errorf("Failed to clean %s %s: %s", kind, cluster, err)
+		return
+	}
+	for _, artifact := range artifacts {
+		switch artifact.Action {
+		case probe.ArtifactSkipped:
+			log.Warningf("Not removing %s %s on %s %s: %s", artifact.Type, artifact.Index, kind, cluster, artifact.Detail)
+		case probe.ArtifactFailed:
+			log.Errorf("Failed to remove %s %s on %s %s: %s", artifact.Type, artifact.Index, kind, cluster, artifact.Detail)
+		}
+	}
+}
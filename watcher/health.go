@@ -0,0 +1,132 @@
+// GNU General Public License version 3
+
+package watcher
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/criteo-forks/espoke/probe"
+)
+
+const (
+	// The WatchPools loop wakes up at least every watchdogInterval, but starting probes of many
+	// clusters can keep it busy longer
+	healthLoopTimeout = 5 * time.Minute
+	// A probe still stuck this long after the watchdog flagged it was not fixed by restarts
+	healthProbeStuckTimeout = 10 * time.Minute
+)
+
+// health records the progress of the watcher used to answer liveness and readiness checks
+type health struct {
+	mu sync.Mutex
+	// loop is when the WatchPools loop last made progress
+	loop time.Time
+	// started is set once probes of the first discovery were started
+	started bool
+	// discovered are the kinds whose services were listed once from consul
+	discovered map[string]bool
+	// discoveryErrors are the errors of the last discovery by kind
+	discoveryErrors map[string]string
+}
+
+func newHealth() *health {
+	return &health{
+		loop:            time.Now(),
+		discovered:      make(map[string]bool),
+		discoveryErrors: make(map[string]string),
+	}
+}
+
+func (h *health) beat() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.loop = time.Now()
+}
+
+func (h *health) setStarted() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.started = true
+}
+
+func (h *health) setDiscovery(kind string, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err != nil {
+		h.discoveryErrors[kind] = err.Error()
+		return
+	}
+	h.discovered[kind] = true
+	delete(h.discoveryErrors, kind)
+}
+
+// Live returns why espoke is not making progress, nil when it is
+func (w *Watcher) Live() []string {
+	var problems []string
+	w.health.mu.Lock()
+	if since := time.Since(w.health.loop); since > healthLoopTimeout {
+		problems = append(problems, fmt.Sprintf("watcher loop made no progress for %s", since.Round(time.Second)))
+	}
+	w.health.mu.Unlock()
+
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	for kind, running := range w.probes {
+		for cluster, p := range running {
+			p.mu.Lock()
+			if p.stale && time.Since(p.staleSince) > healthProbeStuckTimeout {
+				problems = append(problems, fmt.Sprintf("%s probe on %s stuck since %s", kind, cluster, p.staleSince.Format(time.RFC3339)))
+			}
+			p.mu.Unlock()
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
+
+// Ready returns why espoke is not probing clusters yet, nil once it is
+func (w *Watcher) Ready() []string {
+	w.health.mu.Lock()
+	defer w.health.mu.Unlock()
+	var problems []string
+	for _, kind := range probe.Kinds() {
+		if err, ok := w.health.discoveryErrors[kind.Name]; ok {
+			problems = append(problems, fmt.Sprintf("%s discovery failed: %s", kind.Name, err))
+		} else if !w.health.discovered[kind.Name] {
+			problems = append(problems, fmt.Sprintf("%s discovery did not run yet", kind.Name))
+		}
+	}
+	if !w.health.started {
+		problems = append(problems, "probes are not started yet")
+	}
+	return problems
+}
+
+// HealthHandler answers liveness checks
+func (w *Watcher) HealthHandler() http.Handler {
+	return healthHandler(w.Live)
+}
+
+// ReadyHandler answers readiness checks
+func (w *Watcher) ReadyHandler() http.Handler {
+	return healthHandler(w.Ready)
+}
+
+// healthHandler answers ok, or 503 along with the problems, one per line
+func healthHandler(check func() []string) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		problems := check()
+		if len(problems) > 0 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(rw, strings.Join(problems, "\n"))
+			return
+		}
+		fmt.Fprintln(rw, "ok")
+	})
+}
@@ -0,0 +1,188 @@
+// GNU General Public License version 3
+
+package watcher
+
+import (
+	"context"
+	"time"
+
+	"github.com/criteo-forks/espoke/common"
+	"github.com/criteo-forks/espoke/probe"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	pendingRetryInterval = 5 * time.Second
+	pendingMinBackoff    = 10 * time.Second
+	pendingMaxBackoff    = 10 * time.Minute
+	// Errors are exported as a label, keep it readable
+	pendingErrorMaxLength = 200
+)
+
+// pendingProbe is a cluster discovered in consul whose probe could not be created or prepared yet
+type pendingProbe struct {
+	clusterConfig common.Cluster
+	// probe is kept once created, along with its configuration, so that only its preparation is
+	// retried
+	probe     probe.Probe
+	config    *common.Config
+	lastError string
+	backoff   time.Duration
+	nextRetry time.Time
+	// cancel stops the preparation of the probe, it is only set while the probe is being prepared
+	cancel context.CancelFunc
+}
+
+// startProbe creates the probe of a cluster and prepares it on its own goroutine, as preparing
+// can take long, eg. filling the durability index: the WatchPools loop keeps going meanwhile and
+// the cluster stays pending. On failure the cluster is retried later with an exponential backoff.
+func (w *Watcher) startProbe(ctx context.Context, kind probe.Kind, cluster string, pending *pendingProbe) {
+	if pending.probe == nil {
+		config := w.config.ForCluster(kind.Name, cluster)
+		credentials, err := w.clusterCredentials(kind, config)
+		if err != nil {
+			w.setPending(ctx, kind, cluster, pending, "Error while creating probe credentials", err)
+			return
+		}
+		deps := probe.Dependencies{
+			Config:       config,
+			ConsulClient: w.consulClient,
+			Transports:   w.transports,
+			Credentials:  credentials,
+			Metrics:      w.metrics,
+		}
+		pending.probe, err = kind.New(cluster, pending.clusterConfig, deps)
+		if err != nil {
+			w.setPending(ctx, kind, cluster, pending, "Error while creating probe", err)
+			return
+		}
+		pending.config = config
+	}
+
+	prepareCtx, cancel := context.WithCancel(ctx)
+	w.mu.Lock()
+	pending.cancel = cancel
+	w.pending[kind.Name][cluster] = pending
+	w.mu.Unlock()
+	p := pending.probe
+	go func() {
+		err := p.Prepare(prepareCtx)
+		select {
+		case w.commands <- func(ctx context.Context) { w.prepared(ctx, kind, cluster, pending, p, err) }:
+		case <-w.stopped:
+		}
+	}()
+}
+
+// prepared starts the probe p of a pending cluster once prepared, err being the preparation
+// failure. It runs on the WatchPools goroutine.
+func (w *Watcher) prepared(ctx context.Context, kind probe.Kind, cluster string, pending *pendingProbe, p probe.Probe, err error) {
+	if w.pending[kind.Name][cluster] != pending || pending.probe != p {
+		// The cluster was removed or paused, or its probe recreated with a new configuration
+		// meanwhile
+		return
+	}
+	w.mu.Lock()
+	pending.cancel()
+	pending.cancel = nil
+	w.mu.Unlock()
+	if err != nil {
+		w.setPending(ctx, kind, cluster, pending, "Error while preparing probe", err)
+		return
+	}
+
+	probeCtx, cancel := context.WithCancel(ctx)
+	running := &runningProbe{probe: pending.probe, config: pending.config, cancel: cancel, done: make(chan struct{}), state: common.ProbeStateRunning}
+	w.mu.Lock()
+	delete(w.pending[kind.Name], cluster)
+	w.probes[kind.Name][cluster] = running
+	w.mu.Unlock()
+
+	if pending.lastError != "" {
+		w.metrics.ClusterProbeLastPrepareErrorGauge.DeleteLabelValues(kind.Name, cluster, pending.lastError)
+	}
+	w.metrics.ClusterProbeReadyGauge.WithLabelValues(kind.Name, cluster).Set(1)
+	go w.supervise(probeCtx, kind.Name, cluster, running)
+}
+
+// clusterCredentials returns the credentials provider of a cluster, a dedicated one when its
+// settings override the credentials
+func (w *Watcher) clusterCredentials(kind probe.Kind, config *common.Config) (common.CredentialsProvider, error) {
+	if kind.Credentials == nil {
+		return w.credentials[kind.Name], nil
+	}
+	spec, fallback := kind.Credentials(config)
+	globalSpec, globalFallback := kind.Credentials(w.config)
+	if spec == globalSpec && fallback == globalFallback {
+		return w.credentials[kind.Name], nil
+	}
+	return common.NewCredentialsProvider(spec, fallback, w.consulClient, config.CredentialsRefreshPeriod, w.metrics)
+}
+
+func (w *Watcher) setPending(ctx context.Context, kind probe.Kind, cluster string, pending *pendingProbe, msg string, err error) {
+	if ctx.Err() != nil {
+		// Failed because espoke is stopping
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if pending.backoff == 0 {
+		pending.backoff = pendingMinBackoff
+	} else {
+		pending.backoff *= 2
+		if pending.backoff > pendingMaxBackoff {
+			pending.backoff = pendingMaxBackoff
+		}
+	}
+	pending.nextRetry = time.Now().Add(pending.backoff)
+	log.Errorf("%s for %s %s, retrying in %s: %s", msg, kind.Name, cluster, pending.backoff, err.Error())
+	w.metrics.ErrorsCount.Inc()
+
+	lastError := err.Error()
+	if len(lastError) > pendingErrorMaxLength {
+		lastError = lastError[:pendingErrorMaxLength]
+	}
+	if pending.lastError != "" && pending.lastError != lastError {
+		w.metrics.ClusterProbeLastPrepareErrorGauge.DeleteLabelValues(kind.Name, cluster, pending.lastError)
+	}
+	pending.lastError = lastError
+	w.metrics.ClusterProbeLastPrepareErrorGauge.WithLabelValues(kind.Name, cluster, lastError).Set(float64(time.Now().Unix()))
+	w.metrics.ClusterProbePrepareErrorsCount.WithLabelValues(kind.Name, cluster).Inc()
+	w.metrics.ClusterProbeReadyGauge.WithLabelValues(kind.Name, cluster).Set(0)
+
+	w.pending[kind.Name][cluster] = pending
+}
+
+// stopPreparing cancels the preparation of a pending probe, if any. The caller holds w.mu.
+func (p *pendingProbe) stopPreparing() {
+	if p.cancel != nil {
+		p.cancel()
+		p.cancel = nil
+	}
+}
+
+// retryPendingProbes tries again to start the pending probes whose backoff expired
+func (w *Watcher) retryPendingProbes(ctx context.Context) {
+	now := time.Now()
+	for _, kind := range probe.Kinds() {
+		for cluster, pending := range w.pending[kind.Name] {
+			if ctx.Err() != nil {
+				return
+			}
+			if pending.cancel != nil || now.Before(pending.nextRetry) {
+				continue
+			}
+			log.Infof("Retrying to start %s probe for: %s", kind.Name, cluster)
+			w.startProbe(ctx, kind, cluster, pending)
+		}
+	}
+}
+
+// cleanClusterProbeMetrics removes the readiness metrics of a cluster no longer in consul
+func (w *Watcher) cleanClusterProbeMetrics(service, cluster string, pending *pendingProbe) {
+	if pending != nil && pending.lastError != "" {
+		w.metrics.ClusterProbeLastPrepareErrorGauge.DeleteLabelValues(service, cluster, pending.lastError)
+	}
+	w.metrics.ClusterProbeReadyGauge.DeleteLabelValues(service, cluster)
+	w.metrics.ClusterProbePrepareErrorsCount.DeleteLabelValues(service, cluster)
+}
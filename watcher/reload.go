@@ -0,0 +1,232 @@
+// GNU General Public License version 3
+
+package watcher
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/criteo-forks/espoke/common"
+	"github.com/criteo-forks/espoke/probe"
+	log "github.com/sirupsen/logrus"
+)
+
+// probeSettings is what a probe was created with, a probe is restarted when it changes
+type probeSettings struct {
+	config          common.Config
+	credentialsSpec string
+	credentials     common.Credentials
+}
+
+// probeSettings returns the settings of a cluster configuration its probe depends on. The
+// scheduling settings, applied by rescheduling the probe, and the ones only used by the watcher
+// or by other kinds of probes are left out.
+func (w *Watcher) probeSettings(kind probe.Kind, cluster string, config *common.Config) probeSettings {
+	c := *config
+	c.ConsulPeriod, c.ProbePeriod, c.RestorePeriod, c.CleaningPeriod, c.KibanaFunctionalProbePeriod = 0, 0, 0, 0, 0
+	c.LatencyProbeRatePerMin, c.ProbeJitter, c.OverlapPolicies, c.ElasticsearchIndexSettingsPeriod = 0, 0, nil, 0
+
+	c.ConsulApi, c.StateFile, c.ShutdownTimeout, c.ElasticsearchCleanupOnStop = "", "", 0, ""
+	c.ElasticsearchCleanupGracePeriod = 0
+	c.ElasticsearchConsulTag, c.KibanaConsulTag, c.LogstashConsulTag = "", "", ""
+	c.Probes, c.Clusters = nil, nil
+
+	// Only whether the certificates of this cluster are verified matters
+	c.TLSInsecureSkipVerify = c.TLSInsecureSkipVerify || w.stringInSlice(cluster, c.TLSInsecureClusters)
+	c.TLSInsecureClusters = nil
+
+	// Credentials are compared as the kind resolves them, kibana falls back to elasticsearch ones
+	settings := probeSettings{}
+	if kind.Credentials != nil {
+		settings.credentialsSpec, settings.credentials = kind.Credentials(config)
+	}
+	c.ElasticsearchUser, c.ElasticsearchPassword, c.ElasticsearchAuth = "", "", ""
+	c.ElasticsearchApiKey, c.ElasticsearchToken, c.ElasticsearchCredentials = "", "", ""
+	c.KibanaUser, c.KibanaPassword, c.KibanaAuth = "", "", ""
+	c.KibanaApiKey, c.KibanaToken, c.KibanaCredentials = "", "", ""
+
+	// Settings named after another kind, eg. ElasticsearchDurabilityIndex for kibana, do not matter
+	value := reflect.ValueOf(&c).Elem()
+	for _, other := range probe.Kinds() {
+		if other.Name == kind.Name {
+			continue
+		}
+		prefix := strings.Title(other.Name)
+		for i := 0; i < value.NumField(); i++ {
+			if strings.HasPrefix(value.Type().Field(i).Name, prefix) {
+				value.Field(i).Set(reflect.Zero(value.Field(i).Type()))
+			}
+		}
+	}
+
+	settings.config = c
+	return settings
+}
+
+// sameSchedule reports whether the scheduling settings of two cluster configurations are the same
+func sameSchedule(a, b *common.Config) bool {
+	return a.ConsulPeriod == b.ConsulPeriod &&
+		a.ProbePeriod == b.ProbePeriod &&
+		a.RestorePeriod == b.RestorePeriod &&
+		a.CleaningPeriod == b.CleaningPeriod &&
+		a.KibanaFunctionalProbePeriod == b.KibanaFunctionalProbePeriod &&
+		a.LatencyProbeRatePerMin == b.LatencyProbeRatePerMin &&
+		a.ElasticsearchIndexSettingsPeriod == b.ElasticsearchIndexSettingsPeriod &&
+		a.ProbeJitter == b.ProbeJitter &&
+		reflect.DeepEqual(a.OverlapPolicies, b.OverlapPolicies)
+}
+
+// sameTransports reports whether two configurations create the same transports
+func sameTransports(a, b *common.Config) bool {
+	return a.TLSCACert == b.TLSCACert &&
+		a.TLSClientCert == b.TLSClientCert &&
+		a.TLSClientKey == b.TLSClientKey &&
+		a.TLSServerName == b.TLSServerName &&
+		a.TLSInsecureSkipVerify == b.TLSInsecureSkipVerify &&
+		reflect.DeepEqual(a.TLSInsecureClusters, b.TLSInsecureClusters) &&
+		reflect.DeepEqual(tlsOverrides(a), tlsOverrides(b)) &&
+		a.HTTPDialTimeout == b.HTTPDialTimeout &&
+		a.HTTPTLSHandshakeTimeout == b.HTTPTLSHandshakeTimeout &&
+		a.HTTPResponseHeaderTimeout == b.HTTPResponseHeaderTimeout &&
+		a.HTTPIdleConnTimeout == b.HTTPIdleConnTimeout
+}
+
+// tlsOverrides returns the TLS settings of the probe type and cluster sections of a configuration
+func tlsOverrides(c *common.Config) map[string][]interface{} {
+	overrides := make(map[string][]interface{})
+	tls := func(s common.Settings) []interface{} {
+		return []interface{}{s.TLSCACert, s.TLSClientCert, s.TLSClientKey, s.TLSServerName, s.TLSInsecureSkipVerify}
+	}
+	for kind, settings := range c.Probes {
+		overrides["probe "+kind] = tls(settings)
+	}
+	for i, cluster := range c.Clusters {
+		overrides[fmt.Sprintf("cluster %d %s %s", i, cluster.Probe, cluster.Match)] = tls(cluster.Settings)
+	}
+	return overrides
+}
+
+// Reload applies a new configuration. Probes whose cluster configuration only changed in its
+// scheduling settings are rescheduled, the ones whose configuration otherwise changed are
+// restarted and the others are left untouched. Clusters entering or leaving the watched consul
+// tags are then started or stopped as on discovery.
+func (w *Watcher) Reload(config *common.Config) error {
+	return w.exec(func(ctx context.Context) error {
+		return w.reload(ctx, config)
+	})
+}
+
+func (w *Watcher) reload(ctx context.Context, config *common.Config) error {
+	if config.ConsulApi != w.config.ConsulApi {
+		log.Warningf("Changing the consul API requires a restart, keeping %s", w.config.ConsulApi)
+		config.ConsulApi = w.config.ConsulApi
+	}
+	if config.StateFile != w.config.StateFile {
+		log.Warningf("Changing the state file requires a restart, keeping %s", w.config.StateFile)
+		config.StateFile = w.config.StateFile
+	}
+
+	credentials := make(map[string]common.CredentialsProvider)
+	for _, kind := range probe.Kinds() {
+		credentials[kind.Name] = w.credentials[kind.Name]
+		if kind.Credentials == nil {
+			continue
+		}
+		spec, fallback := kind.Credentials(config)
+		oldSpec, oldFallback := kind.Credentials(w.config)
+		if spec == oldSpec && fallback == oldFallback && config.CredentialsRefreshPeriod == w.config.CredentialsRefreshPeriod {
+			continue
+		}
+		provider, err := common.NewCredentialsProvider(spec, fallback, w.consulClient, config.CredentialsRefreshPeriod, w.metrics)
+		if err != nil {
+			return err
+		}
+		credentials[kind.Name] = provider
+	}
+
+	// Nothing can fail past this point, the new configuration is applied as a whole
+	old := w.config
+	w.config = config
+	w.credentials = credentials
+	if !sameTransports(old, config) {
+		// Running probes keep their transports unless they are restarted
+		w.transports = common.NewTransports(config, w.metrics)
+	}
+
+	type restart struct {
+		kind    probe.Kind
+		cluster string
+		running *runningProbe
+	}
+	var restarts []restart
+	rescheduled := 0
+	for _, kind := range probe.Kinds() {
+		for cluster, running := range w.probes[kind.Name] {
+			clusterConfig := config.ForCluster(kind.Name, cluster)
+			if !reflect.DeepEqual(w.probeSettings(kind, cluster, running.config), w.probeSettings(kind, cluster, clusterConfig)) {
+				restarts = append(restarts, restart{kind: kind, cluster: cluster, running: running})
+				continue
+			}
+			if !sameSchedule(running.config, clusterConfig) {
+				log.Infof("Rescheduling %s probe for: %s", kind.Name, cluster)
+				running.probe.Reschedule(clusterConfig)
+				rescheduled++
+			}
+			// Settings only used by the watcher, eg. the cleanup on stop, are read from there
+			running.config = clusterConfig
+		}
+
+		for cluster, pending := range w.pending[kind.Name] {
+			if pending.probe == nil {
+				continue
+			}
+			clusterConfig := config.ForCluster(kind.Name, cluster)
+			if !reflect.DeepEqual(w.probeSettings(kind, cluster, pending.config), w.probeSettings(kind, cluster, clusterConfig)) {
+				// Created again with the new configuration on the next retry
+				w.mu.Lock()
+				pending.stopPreparing()
+				pending.probe, pending.config = nil, nil
+				w.mu.Unlock()
+				continue
+			}
+			pending.probe.Reschedule(clusterConfig)
+			pending.config = clusterConfig
+		}
+	}
+
+	if len(restarts) > 0 {
+		for _, r := range restarts {
+			log.Infof("Configuration of %s %s changed, restarting its probe", r.kind.Name, r.cluster)
+			w.mu.Lock()
+			delete(w.probes[r.kind.Name], r.cluster)
+			w.mu.Unlock()
+			r.running.cancel()
+		}
+		// The new probes must not start before the old ones removed their metrics
+		deadline := time.NewTimer(w.config.ShutdownTimeout)
+		defer deadline.Stop()
+	wait:
+		for _, r := range restarts {
+			select {
+			case <-r.running.done:
+			case <-deadline.C:
+				log.Warningf("Timeout waiting for probes to terminate, %s probe on %s still running", r.kind.Name, r.cluster)
+				break wait
+			}
+		}
+		for _, r := range restarts {
+			if ctx.Err() != nil {
+				return nil
+			}
+			w.startProbe(ctx, r.kind, r.cluster, &pendingProbe{clusterConfig: r.running.probe.Cluster()})
+		}
+	}
+
+	// The consul tags may have changed
+	w.updateProbes(ctx)
+	log.Infof("Configuration reloaded, %d probes restarted and %d rescheduled", len(restarts), rescheduled)
+	return nil
+}
@@ -0,0 +1,104 @@
+// GNU General Public License version 3
+
+package watcher
+
+import (
+	"sort"
+	"time"
+
+	"github.com/criteo-forks/espoke/probe"
+)
+
+const (
+	// ClusterStatePending is the state of a cluster whose probe could not be created or prepared yet
+	ClusterStatePending = "pending"
+	// ClusterStatePreparing is the state of a cluster whose probe is being prepared
+	ClusterStatePreparing = "preparing"
+	// ClusterStatePaused is the state of a cluster whose probing is paused
+	ClusterStatePaused = "paused"
+)
+
+// ClusterSnapshot is a copy of the state of a cluster watched in consul
+type ClusterSnapshot struct {
+	Service  string `json:"service"`
+	Cluster  string `json:"cluster"`
+	Endpoint string `json:"endpoint,omitempty"`
+	Version  string `json:"version,omitempty"`
+	// State is either pending, preparing, paused or the state of the probe supervisor (running,
+	// restarting, failed)
+	State    string `json:"state"`
+	Stale    bool   `json:"stale"`
+	Restarts int    `json:"restarts"`
+	// LastError and NextRetry are set on pending clusters
+	LastError  string                           `json:"last_error,omitempty"`
+	NextRetry  *time.Time                       `json:"next_retry,omitempty"`
+	Nodes      []string                         `json:"nodes,omitempty"`
+	Operations map[string]probe.OperationStatus `json:"operations,omitempty"`
+}
+
+// Snapshot returns the state of every watched cluster sorted by service and cluster. It is safe
+// to call from any goroutine.
+func (w *Watcher) Snapshot() []ClusterSnapshot {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	var snapshots []ClusterSnapshot
+	for service, running := range w.probes {
+		for cluster, p := range running {
+			heartbeat := p.probe.Heartbeat()
+			var nodes []string
+			for _, node := range heartbeat.Nodes() {
+				nodes = append(nodes, node.Name)
+			}
+			clusterConfig := p.probe.Cluster()
+			p.mu.Lock()
+			snapshots = append(snapshots, ClusterSnapshot{
+				Service:    service,
+				Cluster:    cluster,
+				Endpoint:   clusterConfig.Endpoint,
+				Version:    clusterConfig.Version,
+				State:      p.state,
+				Stale:      p.stale,
+				Restarts:   p.restarts,
+				Nodes:      nodes,
+				Operations: heartbeat.Operations(),
+			})
+			p.mu.Unlock()
+		}
+	}
+	for service, pending := range w.pending {
+		for cluster, p := range pending {
+			snapshot := ClusterSnapshot{
+				Service:   service,
+				Cluster:   cluster,
+				Version:   p.clusterConfig.Version,
+				State:     ClusterStatePending,
+				LastError: p.lastError,
+			}
+			if p.cancel != nil {
+				snapshot.State = ClusterStatePreparing
+			} else {
+				nextRetry := p.nextRetry
+				snapshot.NextRetry = &nextRetry
+			}
+			snapshots = append(snapshots, snapshot)
+		}
+	}
+	for service, paused := range w.paused {
+		for cluster := range paused {
+			snapshots = append(snapshots, ClusterSnapshot{
+				Service: service,
+				Cluster: cluster,
+				State:   ClusterStatePaused,
+			})
+		}
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		if snapshots[i].Service != snapshots[j].Service {
+			return snapshots[i].Service < snapshots[j].Service
+		}
+		return snapshots[i].Cluster < snapshots[j].Cluster
+	})
+	return snapshots
+}
@@ -0,0 +1,174 @@
+// GNU General Public License version 3
+
+package watcher
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/criteo-forks/espoke/probe"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// state is what espoke persists across restarts
+type state struct {
+	// Paused are the clusters whose probing is paused by kind name
+	Paused map[string][]string `json:"paused"`
+}
+
+// loadState reads the paused clusters, a missing file means none is paused
+func loadState(path string) (map[string]map[string]bool, error) {
+	paused := make(map[string]map[string]bool)
+	if path == "" {
+		return paused, nil
+	}
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return paused, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to read state file %s", path)
+	}
+
+	var s state
+	if err := json.Unmarshal(content, &s); err != nil {
+		return nil, errors.Wrapf(err, "Failed to parse state file %s", path)
+	}
+	for kind, clusters := range s.Paused {
+		paused[kind] = make(map[string]bool)
+		for _, cluster := range clusters {
+			paused[kind][cluster] = true
+		}
+	}
+	return paused, nil
+}
+
+// saveState writes the paused clusters, the file is replaced at once so that it is never left half written
+func (w *Watcher) saveState() error {
+	if w.config.StateFile == "" {
+		return nil
+	}
+	s := state{Paused: make(map[string][]string)}
+	for kind, paused := range w.paused {
+		for cluster := range paused {
+			s.Paused[kind] = append(s.Paused[kind], cluster)
+		}
+		sort.Strings(s.Paused[kind])
+	}
+	content, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "Failed to serialize state")
+	}
+
+	if err := os.MkdirAll(filepath.Dir(w.config.StateFile), 0755); err != nil {
+		return errors.Wrapf(err, "Failed to create state file directory")
+	}
+	tmp := w.config.StateFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, 0644); err != nil {
+		return errors.Wrapf(err, "Failed to write state file %s", tmp)
+	}
+	if err := os.Rename(tmp, w.config.StateFile); err != nil {
+		return errors.Wrapf(err, "Failed to replace state file %s", w.config.StateFile)
+	}
+	return nil
+}
+
+// Pause stops probing a cluster until it is resumed, even across restarts. The cluster does not
+// need to be in consul yet.
+func (w *Watcher) Pause(service, cluster string) error {
+	return w.exec(func(ctx context.Context) error {
+		paused, ok := w.paused[service]
+		if !ok {
+			return newAPIError(http.StatusNotFound, "unknown service %s", service)
+		}
+		if paused[cluster] {
+			return nil
+		}
+		w.mu.Lock()
+		paused[cluster] = true
+		w.mu.Unlock()
+		if err := w.saveState(); err != nil {
+			w.mu.Lock()
+			delete(paused, cluster)
+			w.mu.Unlock()
+			return err
+		}
+
+		log.Infof("Pausing %s probe for: %s", service, cluster)
+		w.flushOldProbes(service, []string{cluster}, false)
+		w.metrics.ClusterProbePausedGauge.WithLabelValues(service, cluster).Set(1)
+		return nil
+	})
+}
+
+// Resume starts probing a paused cluster again
+func (w *Watcher) Resume(service, cluster string) error {
+	return w.exec(func(ctx context.Context) error {
+		paused, ok := w.paused[service]
+		if !ok {
+			return newAPIError(http.StatusNotFound, "unknown service %s", service)
+		}
+		if !paused[cluster] {
+			return newAPIError(http.StatusConflict, "%s %s is not paused", service, cluster)
+		}
+		w.mu.Lock()
+		delete(paused, cluster)
+		w.mu.Unlock()
+		if err := w.saveState(); err != nil {
+			w.mu.Lock()
+			paused[cluster] = true
+			w.mu.Unlock()
+			return err
+		}
+
+		log.Infof("Resuming %s probe for: %s", service, cluster)
+		w.metrics.ClusterProbePausedGauge.DeleteLabelValues(service, cluster)
+		for _, kind := range probe.Kinds() {
+			if kind.Name == service {
+				// Start the probe right away when the cluster is in consul
+				w.updateKindProbes(ctx, kind)
+			}
+		}
+		return nil
+	})
+}
+
+// Trigger requests an immediate run of a probing operation on a cluster
+func (w *Watcher) Trigger(service, cluster, operation string) error {
+	w.mu.RLock()
+	running, ok := w.probes[service][cluster]
+	_, pending := w.pending[service][cluster]
+	paused := w.paused[service][cluster]
+	w.mu.RUnlock()
+
+	switch {
+	case ok:
+		if err := running.probe.Trigger(operation); err != nil {
+			return newAPIError(http.StatusBadRequest, "%s", err.Error())
+		}
+		return nil
+	case pending:
+		return newAPIError(http.StatusConflict, "%s %s is pending", service, cluster)
+	case paused:
+		return newAPIError(http.StatusConflict, "%s %s is paused", service, cluster)
+	default:
+		return newAPIError(http.StatusNotFound, "unknown cluster %s %s", service, cluster)
+	}
+}
+
+// exec runs command on the WatchPools goroutine, which owns the probes, and returns its error
+func (w *Watcher) exec(command func(ctx context.Context) error) error {
+	result := make(chan error, 1)
+	select {
+	case w.commands <- func(ctx context.Context) { result <- command(ctx) }:
+	case <-w.stopped:
+		return newAPIError(http.StatusServiceUnavailable, "espoke is stopping")
+	}
+	return <-result
+}
@@ -0,0 +1,87 @@
+// GNU General Public License version 3
+
+package watcher
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/criteo-forks/espoke/common"
+	"github.com/criteo-forks/espoke/probe"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	supervisorMinBackoff = 5 * time.Second
+	supervisorMaxBackoff = 5 * time.Minute
+	// Number of restarts in a row after which a probe is reported as failed, it is still restarted
+	supervisorFailedRestarts = 5
+)
+
+// supervise runs a probe until ctx is cancelled. When the probe panics or returns on its own, it
+// is restarted after an exponential backoff which is reset once the probe ran long enough.
+func (w *Watcher) supervise(ctx context.Context, service, cluster string, running *runningProbe) {
+	defer close(running.done)
+	defer w.metrics.CleanProbeStateMetrics(service, cluster)
+
+	backoff := supervisorMinBackoff
+	restarts := 0
+	for {
+		w.metrics.SetProbeState(service, cluster, common.ProbeStateRunning)
+		running.setState(common.ProbeStateRunning)
+		started := time.Now()
+		runCtx, cancel := context.WithCancel(ctx)
+		running.setRestart(cancel)
+		err := runProbe(runCtx, running.probe)
+		restarted := runCtx.Err() != nil
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+		if restarted {
+			err = errors.New("probe restarted by the watchdog")
+		}
+
+		if time.Since(started) > supervisorMaxBackoff {
+			backoff = supervisorMinBackoff
+			restarts = 0
+		}
+		restarts++
+		if err == nil {
+			err = errors.New("probe exited")
+		}
+		log.Errorf("%s probe on %s stopped, restarting in %s: %s", service, cluster, backoff, err.Error())
+		w.metrics.ErrorsCount.Inc()
+		state := common.ProbeStateRestarting
+		if restarts >= supervisorFailedRestarts {
+			state = common.ProbeStateFailed
+		}
+		w.metrics.SetProbeState(service, cluster, state)
+		running.setState(state)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		w.metrics.ProbeRestartsCount.WithLabelValues(service, cluster).Inc()
+		running.addRestart()
+		backoff *= 2
+		if backoff > supervisorMaxBackoff {
+			backoff = supervisorMaxBackoff
+		}
+	}
+}
+
+// runProbe starts a probe and turns a panic into an error
+func runProbe(ctx context.Context, p probe.Probe) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("probe panicked: %v\n%s", r, debug.Stack())
+		}
+	}()
+	return p.Start(ctx)
+}
@@ -0,0 +1,51 @@
+// GNU General Public License version 3
+
+package watcher
+
+import (
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	watchdogInterval = 10 * time.Second
+	// A probing operation which missed this many runs marks its probe as stale
+	watchdogStaleMisses = 3
+	// A probing operation which missed this many runs gets its probe restarted
+	watchdogRestartMisses = 6
+	// Minimum durations before a probe is considered stale or restarted. A run lasts up to the
+	// request timeout, just under the probe period, whatever the interval of its operation:
+	// operations running every few seconds, eg. the latency one, skip their runs meanwhile.
+	watchdogMinStaleWindow   = time.Minute
+	watchdogMinRestartWindow = 3 * time.Minute
+)
+
+// checkProbes flags probes whose loop stopped making progress, makes the availability of their
+// nodes unknown, and restarts them when they still do not make progress
+func (w *Watcher) checkProbes() {
+	for kind, running := range w.probes {
+		for cluster, p := range running {
+			heartbeat := p.probe.Heartbeat()
+			stale := heartbeat.Check(watchdogStaleMisses, watchdogMinStaleWindow)
+			if len(stale) == 0 {
+				if p.setStale(false) {
+					log.Infof("%s probe on %s is running again", kind, cluster)
+				}
+				continue
+			}
+
+			if p.setStale(true) {
+				log.Warningf("%s probe on %s looks stuck, %s did not run", kind, cluster, strings.Join(stale, ", "))
+				w.metrics.ErrorsCount.Inc()
+				heartbeat.MarkUnknown()
+			}
+
+			if len(heartbeat.Stale(watchdogRestartMisses, watchdogMinRestartWindow)) > 0 {
+				log.Errorf("%s probe on %s is stuck, restarting it", kind, cluster)
+				p.restartRun()
+			}
+		}
+	}
+}
@@ -1,10 +1,12 @@
 package watcher
 
 import (
+	"context"
 	"github.com/criteo-forks/espoke/common"
 	"github.com/criteo-forks/espoke/probe"
 	"github.com/hashicorp/consul/api"
 	log "github.com/sirupsen/logrus"
+	"sync"
 	"time"
 )
 
@@ -14,129 +16,303 @@ type Watcher struct {
 
 	consulClient *api.Client
 
-	elasticsearchClusters map[string](chan bool)
-	kibanaClusters        map[string](chan bool)
+	credentials map[string]common.CredentialsProvider
+	transports  *common.Transports
+	metrics     *common.Metrics
+
+	// mu guards probes, pending and paused. They are only modified by the WatchPools goroutine,
+	// which reads them without locking, other goroutines go through Snapshot or exec.
+	mu sync.RWMutex
+	// probes are the running probes by kind name then cluster name
+	probes map[string]map[string]*runningProbe
+	// pending are the clusters which could not be probed yet by kind name then cluster name
+	pending map[string]map[string]*pendingProbe
+	// paused are the clusters not probed on request by kind name then cluster name
+	paused map[string]map[string]bool
+	// cleanups are the clusters removed from consul waiting for their grace period to be cleaned,
+	// by kind name then cluster name. Only used by the WatchPools goroutine.
+	cleanups map[string]map[string]*pendingCleanup
+
+	// commands are run by the WatchPools goroutine, stopped is closed once it returned
+	commands chan func(ctx context.Context)
+	stopped  chan struct{}
+
+	health *health
+}
+
+// runningProbe is a started probe along with what is needed to stop it
+type runningProbe struct {
+	probe probe.Probe
+	// config is the configuration of the cluster the probe was created or rescheduled with
+	config *common.Config
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu sync.Mutex
+	// restart cancels the current run of the probe, the supervisor then starts it again
+	restart    context.CancelFunc
+	state      string
+	restarts   int
+	stale      bool
+	staleSince time.Time
+}
+
+func (r *runningProbe) setRestart(restart context.CancelFunc) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.restart = restart
+}
+
+func (r *runningProbe) setState(state string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.state = state
+}
+
+func (r *runningProbe) addRestart() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.restarts++
+}
+
+func (r *runningProbe) setStale(stale bool) (changed bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	changed = r.stale != stale
+	r.stale = stale
+	if changed && stale {
+		r.staleSince = time.Now()
+	}
+	return changed
 }
 
-// NewWatcher creates a new watcher and prepare the consul client
-func NewWatcher(config *common.Config) (Watcher, error) {
+func (r *runningProbe) restartRun() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.restart != nil {
+		r.restart()
+	}
+}
+
+// NewWatcher creates a new watcher and prepare the consul client, the watcher and its probes
+// export their metrics in metrics
+func NewWatcher(config *common.Config, metrics *common.Metrics) (*Watcher, error) {
 	consulClient, err := common.NewClient(config.ConsulApi)
 	if err != nil {
-		return Watcher{}, err
+		return nil, err
 	}
-	return Watcher{
+
+	credentials := make(map[string]common.CredentialsProvider)
+	probes := make(map[string]map[string]*runningProbe)
+	pending := make(map[string]map[string]*pendingProbe)
+	cleanups := make(map[string]map[string]*pendingCleanup)
+	paused, err := loadState(config.StateFile)
+	if err != nil {
+		return nil, err
+	}
+	for _, kind := range probe.Kinds() {
+		probes[kind.Name] = make(map[string]*runningProbe)
+		pending[kind.Name] = make(map[string]*pendingProbe)
+		cleanups[kind.Name] = make(map[string]*pendingCleanup)
+		if paused[kind.Name] == nil {
+			paused[kind.Name] = make(map[string]bool)
+		}
+		for cluster := range paused[kind.Name] {
+			log.Infof("Probing %s %s is paused", kind.Name, cluster)
+			metrics.ClusterProbePausedGauge.WithLabelValues(kind.Name, cluster).Set(1)
+		}
+
+		if kind.Credentials == nil {
+			credentials[kind.Name], _ = common.NewCredentialsProvider("", common.Credentials{}, consulClient, config.CredentialsRefreshPeriod, metrics)
+			continue
+		}
+		spec, fallback := kind.Credentials(config)
+		credentials[kind.Name], err = common.NewCredentialsProvider(spec, fallback, consulClient, config.CredentialsRefreshPeriod, metrics)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &Watcher{
 		config: config,
 
 		consulClient: consulClient,
 
-		elasticsearchClusters: make(map[string]chan bool),
-		kibanaClusters:        make(map[string]chan bool),
+		credentials: credentials,
+		transports:  common.NewTransports(config, metrics),
+		metrics:     metrics,
+
+		probes:   probes,
+		pending:  pending,
+		paused:   paused,
+		cleanups: cleanups,
+
+		commands: make(chan func(ctx context.Context)),
+		stopped:  make(chan struct{}),
+
+		health: newHealth(),
 	}, nil
 }
 
 // WatchPools poll consul services with specified tag and create
-// probe gorountines
-func (w *Watcher) WatchPools() error {
+// probe gorountines until ctx is cancelled, then waits for probes to terminate
+func (w *Watcher) WatchPools(ctx context.Context) error {
+	defer close(w.stopped)
+	consulPeriod := w.config.ConsulPeriod
+	consulTicker := time.NewTicker(consulPeriod)
+	defer consulTicker.Stop()
+	retryTicker := time.NewTicker(pendingRetryInterval)
+	defer retryTicker.Stop()
+	watchdogTicker := time.NewTicker(watchdogInterval)
+	defer watchdogTicker.Stop()
+
+	w.updateProbes(ctx)
+	w.health.setStarted()
 	for {
-		// Elasticsearch service
-		esServicesFromConsul, err := common.GetServices(w.consulClient, w.config.ElasticsearchConsulTag)
-		if err != nil {
-			log.Error(err)
-			common.ErrorsCount.Inc()
+		w.health.beat()
+		select {
+		case <-ctx.Done():
+			w.shutdown()
+			return nil
+		case <-consulTicker.C:
+			w.updateProbes(ctx)
+		case <-retryTicker.C:
+			w.retryPendingProbes(ctx)
+		case <-watchdogTicker.C:
+			w.checkProbes()
+		case command := <-w.commands:
+			command(ctx)
+			// A reload may change the discovery interval
+			if consulPeriod != w.config.ConsulPeriod {
+				consulPeriod = w.config.ConsulPeriod
+				consulTicker.Reset(consulPeriod)
+			}
 		}
+	}
+}
+
+// updateProbes starts probes of clusters which appeared in consul and stops the ones of clusters
+// which vanished
+func (w *Watcher) updateProbes(ctx context.Context) {
+	for _, kind := range probe.Kinds() {
+		w.updateKindProbes(ctx, kind)
+	}
+}
+
+func (w *Watcher) updateKindProbes(ctx context.Context, kind probe.Kind) {
+	servicesFromConsul, err := common.GetServices(w.consulClient, kind.ConsulTag(w.config))
+	w.health.setDiscovery(kind.Name, err)
+	if err != nil {
+		log.Error(err)
+		w.metrics.ErrorsCount.Inc()
+		return
+	}
+	w.runPendingCleanups(kind.Name, servicesFromConsul)
 
-		esWatchedServices := w.getWatchedServices(w.elasticsearchClusters)
+	// Paused clusters are neither started nor removed: they stay paused until resumed, whether
+	// they are in consul or not
+	for cluster := range w.paused[kind.Name] {
+		delete(servicesFromConsul, cluster)
+	}
+	watchedServices := w.getWatchedServices(kind.Name)
 
-		esServicesToAdd, sServicesToRemove := w.getServicesToModify(esServicesFromConsul, esWatchedServices)
-		w.flushOldProbes(sServicesToRemove, w.elasticsearchClusters)
-		w.createNewEsProbes(esServicesToAdd)
+	servicesToAdd, servicesToRemove := w.getServicesToModify(servicesFromConsul, watchedServices)
+	w.flushOldProbes(kind.Name, servicesToRemove, true)
+	w.createNewProbes(ctx, kind, servicesToAdd)
+}
 
-		// Kibana service
-		kibanaServicesFromConsul, err := common.GetServices(w.consulClient, w.config.KibanaConsulTag)
-		if err != nil {
-			log.Error(err)
-			common.ErrorsCount.Inc()
+// shutdown stops every probe and waits for them to terminate, then removes the espoke indices of
+// the clusters configured so, at most ShutdownTimeout
+func (w *Watcher) shutdown() {
+	log.Info("Stopping all probes")
+	w.mu.Lock()
+	for _, pending := range w.pending {
+		for _, p := range pending {
+			p.stopPreparing()
+		}
+	}
+	w.mu.Unlock()
+	for _, running := range w.probes {
+		for _, p := range running {
+			p.cancel()
 		}
+	}
 
-		kibanaWatchedServices := w.getWatchedServices(w.kibanaClusters)
+	ctx, cancel := context.WithTimeout(context.Background(), w.config.ShutdownTimeout)
+	defer cancel()
+	for kind, running := range w.probes {
+		for name, p := range running {
+			select {
+			case <-p.done:
+			case <-ctx.Done():
+				log.Warningf("Timeout waiting for probes to terminate, %s probe on %s still running", kind, name)
+				return
+			}
+		}
+	}
+	log.Info("All probes terminated")
 
-		kibanaServicesToAdd, kibanaServicesToRemove := w.getServicesToModify(kibanaServicesFromConsul, kibanaWatchedServices)
-		w.flushOldProbes(kibanaServicesToRemove, w.kibanaClusters)
-		w.createNewKibanaProbes(kibanaServicesToAdd)
+	for kind, cleanups := range w.cleanups {
+		for name := range cleanups {
+			log.Infof("Not cleaning %s %s, removed from consul within its grace period", kind, name)
+		}
+	}
 
-		time.Sleep(w.config.ConsulPeriod)
+	// Cleaning shares the shutdown timeout with the probes termination
+	for kind, running := range w.probes {
+		for name, p := range running {
+			if cleanupOnStop(p, true) {
+				cleanup(ctx, kind, name, p)
+			}
+		}
 	}
 }
 
-func (w *Watcher) getWatchedServices(watchedClusters map[string](chan bool)) []string {
+// getWatchedServices returns the clusters either probed or pending
+func (w *Watcher) getWatchedServices(kind string) []string {
 	var currentServices []string
 
-	for k := range watchedClusters {
+	for k := range w.probes[kind] {
+		currentServices = append(currentServices, k)
+	}
+	for k := range w.pending[kind] {
 		currentServices = append(currentServices, k)
 	}
 	return currentServices
 }
 
-func (w *Watcher) createNewEsProbes(servicesToAdd map[string]common.Cluster) {
-	var probeChan chan bool
+func (w *Watcher) createNewProbes(ctx context.Context, kind probe.Kind, servicesToAdd map[string]common.Cluster) {
 	for cluster, clusterConfig := range servicesToAdd {
-		log.Printf("Creating new es probe for: %s", cluster)
-
-		endpoint, err := common.GetEndpointFromConsul(w.consulClient, clusterConfig.Name, w.config.ElasticsearchEndpointSuffix, w.config.ElasticsearchEndpointPort)
-		if err != nil {
-			log.Errorf("Could not generate endpoint from consul: %s", err.Error())
-			common.ErrorsCount.Inc()
-			continue
-		}
-
-		probeChan = make(chan bool)
-		esProbe, err := probe.NewEsProbe(cluster, endpoint, clusterConfig, w.config, w.consulClient, probeChan)
-
-		if err != nil {
-			log.Errorf("Error while creating probe: %s", err.Error())
-			common.ErrorsCount.Inc()
-			continue
-		}
-
-		err = esProbe.PrepareEsProbing()
-		if err != nil {
-			log.Errorf("Error while preparing probe: %s", err.Error())
-			common.ErrorsCount.Inc()
-			close(probeChan)
-			continue
+		if ctx.Err() != nil {
+			return
 		}
-
-		w.elasticsearchClusters[cluster] = probeChan
-		go esProbe.StartEsProbing()
+		log.Printf("Creating new %s probe for: %s", kind.Name, cluster)
+		w.startProbe(ctx, kind, cluster, &pendingProbe{clusterConfig: clusterConfig})
 	}
 }
-func (w *Watcher) createNewKibanaProbes(servicesToAdd map[string]common.Cluster) {
-	var probeChan chan bool
-	for cluster, clusterConfig := range servicesToAdd {
-		log.Printf("Creating new kibana probe for: %s", cluster)
-		probeChan = make(chan bool)
-		esProbe, err := probe.NewKibanaProbe(cluster, clusterConfig, w.config, w.consulClient, probeChan)
 
-		if err != nil {
-			log.Error(err)
-			common.ErrorsCount.Inc()
-			continue
-		}
-
-		w.kibanaClusters[cluster] = probeChan
-		go esProbe.StartKibanaProbing()
-	}
-}
-func (w *Watcher) flushOldProbes(servicesToRemove []string, watchedClusters map[string](chan bool)) {
-	var ok bool
-	var probeChan chan bool
+// flushOldProbes stops the probes of clusters, removed tells they left consul rather than being
+// paused: only then their cleanup is scheduled
+func (w *Watcher) flushOldProbes(kind string, servicesToRemove []string, removed bool) {
 	for _, name := range servicesToRemove {
-		log.Infof("Removing old probe for: %s", name)
-		probeChan, ok = watchedClusters[name]
-		if ok {
-			delete(watchedClusters, name)
-			probeChan <- false
-			close(probeChan)
+		if pending, ok := w.pending[kind][name]; ok {
+			log.Infof("Removing pending probe for: %s", name)
+			w.mu.Lock()
+			pending.stopPreparing()
+			delete(w.pending[kind], name)
+			w.mu.Unlock()
+			w.cleanClusterProbeMetrics(kind, name, pending)
+		}
+		if p, ok := w.probes[kind][name]; ok {
+			log.Infof("Removing old probe for: %s", name)
+			w.mu.Lock()
+			delete(w.probes[kind], name)
+			w.mu.Unlock()
+			p.cancel()
+			w.cleanClusterProbeMetrics(kind, name, nil)
+			if removed && cleanupOnStop(p, false) {
+				w.scheduleCleanup(kind, name, p)
+			}
 		}
 	}
 }
@@ -0,0 +1,385 @@
+// GNU General Public License version 3
+
+package watcher
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/criteo-forks/espoke/common"
+	"github.com/criteo-forks/espoke/probe"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const fakeConsulTag = "maintenance-fake"
+
+// fakeKind probes the services of the fake consul tagged with fakeConsulTag
+var fakeKind = probe.Kind{
+	Name:      "fake",
+	ConsulTag: func(config *common.Config) string { return fakeConsulTag },
+	New: func(clusterName string, clusterConfig common.Cluster, deps probe.Dependencies) (probe.Probe, error) {
+		return newFakeProbe(clusterName, clusterConfig), nil
+	},
+}
+
+func init() {
+	probe.RegisterKind(fakeKind)
+}
+
+// fakePrepareGate, when set before the watcher starts, blocks the preparation of fake probes
+// until it is closed
+var fakePrepareGate chan struct{}
+
+// fakeProbe runs until it is stopped and counts the operations triggered on it
+type fakeProbe struct {
+	name          string
+	clusterConfig common.Cluster
+	heartbeat     *probe.Heartbeat
+
+	mu        sync.Mutex
+	triggered int
+	stopped   bool
+}
+
+func newFakeProbe(name string, clusterConfig common.Cluster) *fakeProbe {
+	return &fakeProbe{name: name, clusterConfig: clusterConfig, heartbeat: &probe.Heartbeat{}}
+}
+
+func (p *fakeProbe) Name() string                     { return p.name }
+func (p *fakeProbe) Cluster() common.Cluster          { return p.clusterConfig }
+func (p *fakeProbe) Heartbeat() *probe.Heartbeat      { return p.heartbeat }
+func (p *fakeProbe) Reschedule(config *common.Config) {}
+
+func (p *fakeProbe) Prepare(ctx context.Context) error {
+	if fakePrepareGate == nil {
+		return nil
+	}
+	select {
+	case <-fakePrepareGate:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *fakeProbe) Start(ctx context.Context) error {
+	<-ctx.Done()
+	p.mu.Lock()
+	p.stopped = true
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *fakeProbe) Trigger(operation string) error {
+	if operation != "fake_operation" {
+		return fmt.Errorf("unknown operation %s", operation)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.triggered++
+	return nil
+}
+
+// fakeConsul serves the consul catalog services, clusters can be added and removed while it runs
+type fakeConsul struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	clusters map[string]bool
+}
+
+func newFakeConsul() *fakeConsul {
+	c := &fakeConsul{clusters: make(map[string]bool)}
+	c.Server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/catalog/services" {
+			http.NotFound(rw, r)
+			return
+		}
+		c.mu.Lock()
+		services := make(map[string][]string)
+		for cluster := range c.clusters {
+			services["svc-"+cluster] = []string{fakeConsulTag, "cluster_name-" + cluster}
+		}
+		c.mu.Unlock()
+		rw.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(rw).Encode(services)
+	}))
+	return c
+}
+
+func (c *fakeConsul) set(cluster string, registered bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if registered {
+		c.clusters[cluster] = true
+	} else {
+		delete(c.clusters, cluster)
+	}
+}
+
+// newTestWatcher starts a watcher on the fake consul, which is stopped with the test
+func newTestWatcher(t *testing.T, consul *fakeConsul) *Watcher {
+	config := &common.Config{
+		ConsulApi:       strings.TrimPrefix(consul.URL, "http://"),
+		ConsulPeriod:    time.Hour,
+		ShutdownTimeout: 5 * time.Second,
+		StateFile:       filepath.Join(t.TempDir(), "state.json"),
+	}
+	w, err := NewWatcher(config, common.NewMetrics(prometheus.NewRegistry()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		if err := w.WatchPools(ctx); err != nil {
+			t.Error(err)
+		}
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-w.stopped
+	})
+	return w
+}
+
+// waitFakeProbes waits for the probes of clusters to be prepared and returns the running fake
+// probes by cluster
+func waitFakeProbes(t *testing.T, w *Watcher, clusters ...string) map[string]*fakeProbe {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		probes := fakeProbes(w)
+		started := 0
+		for _, cluster := range clusters {
+			if probes[cluster] != nil {
+				started++
+			}
+		}
+		if started == len(clusters) {
+			return probes
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("only %d of the clusters %v are probed", started, clusters)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// fakeProbes returns the running fake probes by cluster
+func fakeProbes(w *Watcher) map[string]*fakeProbe {
+	probes := make(map[string]*fakeProbe)
+	_ = w.exec(func(ctx context.Context) error {
+		for cluster, running := range w.probes[fakeKind.Name] {
+			probes[cluster] = running.probe.(*fakeProbe)
+		}
+		return nil
+	})
+	return probes
+}
+
+func TestWatcherConcurrentAccess(t *testing.T) {
+	consul := newFakeConsul()
+	defer consul.Close()
+	clusters := []string{"c1", "c2", "c3"}
+	for _, cluster := range clusters {
+		consul.set(cluster, true)
+	}
+	w := newTestWatcher(t, consul)
+	admin, health, ready := w.AdminHandler(), w.HealthHandler(), w.ReadyHandler()
+
+	const iterations = 50
+	var wg sync.WaitGroup
+	run := func(f func(i int)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				f(i)
+			}
+		}()
+	}
+	serve := func(handler http.Handler, method, path string) {
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, httptest.NewRequest(method, path, nil))
+		if rw.Code >= http.StatusInternalServerError && rw.Code != http.StatusServiceUnavailable {
+			t.Errorf("%s %s answered %d: %s", method, path, rw.Code, rw.Body.String())
+		}
+	}
+
+	// Readers
+	run(func(i int) {
+		for _, snapshot := range w.Snapshot() {
+			if snapshot.Service == fakeKind.Name && snapshot.State == "" {
+				t.Errorf("cluster %s has no state", snapshot.Cluster)
+			}
+		}
+	})
+	run(func(i int) {
+		cluster := clusters[i%len(clusters)]
+		serve(admin, http.MethodGet, "/api/clusters")
+		serve(admin, http.MethodGet, "/api/clusters/fake/"+cluster)
+		serve(admin, http.MethodPost, "/api/clusters/fake/"+cluster+"/run?probe=fake_operation")
+		serve(health, http.MethodGet, "/healthz")
+		serve(ready, http.MethodGet, "/readyz")
+	})
+
+	// Writers, on the WatchPools goroutine or through the admin API
+	run(func(i int) {
+		cluster := clusters[i%len(clusters)]
+		consul.set(cluster, i%2 == 0)
+		_ = w.exec(func(ctx context.Context) error {
+			w.updateKindProbes(ctx, fakeKind)
+			return nil
+		})
+	})
+	run(func(i int) {
+		cluster := clusters[(i+1)%len(clusters)]
+		_ = w.exec(func(ctx context.Context) error {
+			w.flushOldProbes(fakeKind.Name, []string{cluster}, i%2 == 0)
+			return nil
+		})
+	})
+	run(func(i int) {
+		cluster := clusters[(i+2)%len(clusters)]
+		_ = w.Pause(fakeKind.Name, cluster)
+		serve(admin, http.MethodPost, "/api/clusters/fake/"+cluster+"/resume")
+		serve(admin, http.MethodPost, "/api/clusters/fake/"+cluster+"/pause")
+		_ = w.Resume(fakeKind.Name, cluster)
+	})
+	wg.Wait()
+
+	// Once every cluster is resumed and back in consul, all of them are probed again
+	for _, cluster := range clusters {
+		consul.set(cluster, true)
+		_ = w.Resume(fakeKind.Name, cluster)
+	}
+	_ = w.exec(func(ctx context.Context) error {
+		w.updateKindProbes(ctx, fakeKind)
+		return nil
+	})
+	waitFakeProbes(t, w, clusters...)
+	var watched int
+	for _, snapshot := range w.Snapshot() {
+		if snapshot.Service == fakeKind.Name {
+			watched++
+		}
+	}
+	if watched != len(clusters) {
+		t.Errorf("%d fake clusters watched, expected %d", watched, len(clusters))
+	}
+}
+
+func TestWatcherPauseStopsProbe(t *testing.T) {
+	consul := newFakeConsul()
+	defer consul.Close()
+	consul.set("c1", true)
+	w := newTestWatcher(t, consul)
+
+	p := waitFakeProbes(t, w, "c1")["c1"]
+	if err := w.Trigger(fakeKind.Name, "c1", "fake_operation"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Pause(fakeKind.Name, "c1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Trigger(fakeKind.Name, "c1", "fake_operation"); err == nil {
+		t.Error("triggering an operation on a paused cluster succeeded")
+	}
+
+	// The supervisor returns once the probe stopped
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		p.mu.Lock()
+		stopped, triggered := p.stopped, p.triggered
+		p.mu.Unlock()
+		if stopped {
+			if triggered != 1 {
+				t.Errorf("operation triggered %d times, expected 1", triggered)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the probe of a paused cluster is still running")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := w.Resume(fakeKind.Name, "c1"); err != nil {
+		t.Fatal(err)
+	}
+	if resumed := waitFakeProbes(t, w, "c1")["c1"]; resumed == p {
+		t.Error("resuming c1 did not start a new probe")
+	}
+}
+
+func TestWatcherSlowPrepare(t *testing.T) {
+	consul := newFakeConsul()
+	defer consul.Close()
+	consul.set("c1", true)
+	gate := make(chan struct{})
+	fakePrepareGate = gate
+	t.Cleanup(func() { fakePrepareGate = nil })
+	w := newTestWatcher(t, consul)
+
+	// The WatchPools loop keeps running while the probe is being prepared
+	state := func(cluster string) string {
+		for _, snapshot := range w.Snapshot() {
+			if snapshot.Service == fakeKind.Name && snapshot.Cluster == cluster {
+				return snapshot.State
+			}
+		}
+		return ""
+	}
+	responsive := make(chan struct{})
+	go func() {
+		defer close(responsive)
+		consul.set("c2", true)
+		_ = w.exec(func(ctx context.Context) error {
+			w.updateKindProbes(ctx, fakeKind)
+			return nil
+		})
+	}()
+	select {
+	case <-responsive:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the watcher loop is blocked by the preparation of a probe")
+	}
+	for _, cluster := range []string{"c1", "c2"} {
+		if got := state(cluster); got != ClusterStatePreparing {
+			t.Errorf("cluster %s is %q while its probe is being prepared", cluster, got)
+		}
+	}
+	w.health.mu.Lock()
+	sinceBeat := time.Since(w.health.loop)
+	w.health.mu.Unlock()
+	if sinceBeat > time.Second {
+		t.Errorf("the watcher loop did not beat for %s while a probe is being prepared", sinceBeat)
+	}
+	if live := w.Live(); len(live) > 0 {
+		t.Errorf("espoke is not live while a probe is being prepared: %v", live)
+	}
+
+	// Removing a cluster cancels its preparation
+	consul.set("c2", false)
+	_ = w.exec(func(ctx context.Context) error {
+		w.updateKindProbes(ctx, fakeKind)
+		return nil
+	})
+	if got := state("c2"); got != "" {
+		t.Errorf("cluster c2 removed from consul is still %q", got)
+	}
+
+	close(gate)
+	waitFakeProbes(t, w, "c1")
+	if got := state("c1"); got != common.ProbeStateRunning {
+		t.Errorf("cluster c1 is %q once prepared", got)
+	}
+}